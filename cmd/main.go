@@ -13,13 +13,16 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"github.com/opiproject/gospdk/spdk"
 
+	be "github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	fe "github.com/opiproject/opi-nvidia-bridge/pkg/frontend"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/locks"
 	"github.com/opiproject/opi-smbios-bridge/pkg/inventory"
-	"github.com/opiproject/opi-spdk-bridge/pkg/backend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/frontend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/middleend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
@@ -58,6 +61,13 @@ func main() {
 	var redisAddress string
 	flag.StringVar(&redisAddress, "redis_addr", "127.0.0.1:6379", "Redis address in ip_address:port format")
 
+	var emulationManagers string
+	flag.StringVar(&emulationManagers, "emulation_managers", fe.DefaultEmulationManager, "Comma separated SNAP emulation managers, the n-th one serves devices with PCIe port_id n")
+
+	var reconcilePolicy fe.ReconcilePolicy
+	flag.BoolVar(&reconcilePolicy.Recreate, "reconcile_recreate", false, "On startup recreate SNAP emulations of stored objects missing on the device instead of marking them stale")
+	flag.BoolVar(&reconcilePolicy.Adopt, "reconcile_adopt", false, "On startup add SNAP emulations missing in the store to the store instead of only reporting them")
+
 	flag.Parse()
 
 	// Create KV store for persistence
@@ -76,10 +86,10 @@ func main() {
 	}(store)
 
 	go runGatewayServer(grpcPort, httpPort)
-	runGrpcServer(grpcPort, spdkAddress, tlsFiles, store)
+	runGrpcServer(grpcPort, spdkAddress, tlsFiles, store, strings.Split(emulationManagers, ","), reconcilePolicy)
 }
 
-func runGrpcServer(grpcPort int, spdkAddress string, tlsFiles string, store gokv.Store) {
+func runGrpcServer(grpcPort int, spdkAddress string, tlsFiles string, store gokv.Store, emulationManagers []string, reconcilePolicy fe.ReconcilePolicy) {
 	tp := utils.InitTracerProvider("opi-nvidia-bridge")
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
@@ -93,9 +103,23 @@ func runGrpcServer(grpcPort int, spdkAddress string, tlsFiles string, store gokv
 	}
 
 	jsonRPC := spdk.NewClient(spdkAddress)
-	frontendOpiNvidiaServer := fe.NewServer(jsonRPC, store)
+	// volumes are locked by both servers while frontend objects start using them
+	resourceLocks := new(locks.Locks)
+	frontendOpiNvidiaServer := fe.NewServerWithEmulationManagers(jsonRPC, store, emulationManagers, resourceLocks)
+	// requests for the devices of unavailable managers are refused until SNAP
+	// reports them
+	if err := frontendOpiNvidiaServer.ValidateEmulationManagers(context.Background()); err != nil {
+		log.Printf("invalid emulation managers: %v", err)
+	}
+	report, err := frontendOpiNvidiaServer.Reconcile(context.Background(), reconcilePolicy)
+	if err != nil {
+		log.Printf("failed to reconcile store with SNAP: %v", err)
+	} else {
+		log.Printf("Reconciliation report: %v", report)
+	}
 	frontendOpiSpdkServer := frontend.NewServer(jsonRPC, store)
-	backendOpiSpdkServer := backend.NewServer(jsonRPC, store)
+	// volumes are recorded in the store so that frontend objects can refer to them
+	backendOpiSpdkServer := be.NewServer(jsonRPC, store, resourceLocks)
 	middleendOpiSpdkServer := middleend.NewServer(jsonRPC, store)
 
 	var serverOptions []grpc.ServerOption
@@ -130,6 +154,7 @@ func runGrpcServer(grpcPort int, spdkAddress string, tlsFiles string, store gokv
 
 	pb.RegisterFrontendNvmeServiceServer(s, frontendOpiNvidiaServer)
 	pb.RegisterFrontendVirtioBlkServiceServer(s, frontendOpiNvidiaServer)
+	longrunningpb.RegisterOperationsServer(s, frontendOpiNvidiaServer)
 	pb.RegisterFrontendVirtioScsiServiceServer(s, frontendOpiSpdkServer)
 	pb.RegisterNvmeRemoteControllerServiceServer(s, backendOpiSpdkServer)
 	pb.RegisterNullVolumeServiceServer(s, backendOpiSpdkServer)
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package backend implememnts the BackEnd APIs (network facing) of the storage Server
+package backend
+
+import (
+	"log"
+
+	"github.com/opiproject/gospdk/spdk"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/locks"
+	"github.com/opiproject/opi-spdk-bridge/pkg/backend"
+
+	"github.com/philippgille/gokv"
+)
+
+// Server wraps the opi-spdk-bridge backend services and records created
+// volumes in the store, so that frontend objects can refer to them by name
+type Server struct {
+	*backend.Server
+
+	store gokv.Store
+	// volumeLocks serializes deleting a volume with frontend objects starting
+	// to use it, it is shared with the frontend server
+	volumeLocks *locks.Locks
+}
+
+// NewServer creates initialized instance of BackEnd server communicating
+// with provided jsonRPC, sharing volumeLocks with the frontend server
+func NewServer(jsonRPC spdk.JSONRPC, store gokv.Store, volumeLocks *locks.Locks) *Server {
+	if store == nil {
+		log.Panic("nil for Store is not allowed")
+	}
+	if volumeLocks == nil {
+		log.Panic("nil for Locks is not allowed")
+	}
+	return &Server{
+		Server:      backend.NewServer(jsonRPC, store),
+		store:       store,
+		volumeLocks: volumeLocks,
+	}
+}
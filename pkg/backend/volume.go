@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package backend implememnts the BackEnd APIs (network facing) of the storage Server
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	"github.com/opiproject/gospdk/spdk"
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/locks"
+
+	"github.com/philippgille/gokv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// LockVolume keeps volume name from being deleted until the returned function
+// is called. The backend and frontend servers have to share volumeLocks.
+func LockVolume(volumeLocks *locks.Locks, name string) (unlock func()) {
+	return volumeLocks.Lock(volumeKey(name))
+}
+
+// volumeKey returns the store key holding the SPDK bdev name of volume name
+func volumeKey(name string) string {
+	return "//storage.opiproject.org/volumes/" + name
+}
+
+// volumeUsersKey returns the store key holding the names of frontend objects
+// which use volume name
+func volumeUsersKey(name string) string {
+	return "//storage.opiproject.org/volumes/" + name + "/users"
+}
+
+// bdevVolumeKey returns the store key holding the name of the volume backed
+// by SPDK bdev
+func bdevVolumeKey(bdev string) string {
+	return "//storage.opiproject.org/bdevs/" + bdev
+}
+
+// RegisterVolume records bdev as the SPDK bdev backing volume name
+func RegisterVolume(store gokv.Store, name string, bdev string) error {
+	err := store.Set(volumeKey(name), wrapperspb.String(bdev))
+	if err != nil {
+		return err
+	}
+	return store.Set(bdevVolumeKey(bdev), wrapperspb.String(name))
+}
+
+// UnregisterVolume removes volume name from the store
+func UnregisterVolume(store gokv.Store, name string) error {
+	bdev := new(wrapperspb.StringValue)
+	found, err := store.Get(volumeKey(name), bdev)
+	if err != nil {
+		return err
+	}
+	if found {
+		err = store.Delete(bdevVolumeKey(bdev.Value))
+		if err != nil {
+			return err
+		}
+	}
+	err = store.Delete(volumeUsersKey(name))
+	if err != nil {
+		return err
+	}
+	return store.Delete(volumeKey(name))
+}
+
+// VolumeBdev returns the SPDK bdev backing volume name
+func VolumeBdev(store gokv.Store, name string) (string, error) {
+	bdev := new(wrapperspb.StringValue)
+	found, err := store.Get(volumeKey(name), bdev)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", status.Errorf(codes.NotFound, "unable to find volume %s", name)
+	}
+	return bdev.Value, nil
+}
+
+// ResolveVolume returns the SPDK bdev backing volume name. Names which are not
+// registered volumes, such as the bdevs of NVMe remote controllers, are looked
+// up as SPDK bdevs and stand for themselves.
+func ResolveVolume(ctx context.Context, rpc spdk.JSONRPC, store gokv.Store, name string) (string, error) {
+	bdev, err := VolumeBdev(store, name)
+	if status.Code(err) != codes.NotFound {
+		return bdev, err
+	}
+	// a bdev backing a registered volume is referred to by the volume name,
+	// which keeps the volume from being deleted while it is used
+	volume := new(wrapperspb.StringValue)
+	found, err := store.Get(bdevVolumeKey(name), volume)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		msg := fmt.Sprintf("Bdev %s backs volume %s, refer to the volume instead", name, volume.Value)
+		return "", status.Errorf(codes.InvalidArgument, msg)
+	}
+	// all bdevs are listed, SPDK fails the lookup of an unknown name the same
+	// way as any other call
+	var result []spdk.BdevGetBdevsResult
+	err = rpc.Call(ctx, "bdev_get_bdevs", nil, &result)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	for i := range result {
+		if result[i].Name == name {
+			return name, nil
+		}
+	}
+	return "", status.Errorf(codes.NotFound, "unable to find volume %s", name)
+}
+
+// BdevVolume returns the volume backed by SPDK bdev, a bdev which backs no
+// registered volume stands for itself
+func BdevVolume(store gokv.Store, bdev string) (string, error) {
+	name := new(wrapperspb.StringValue)
+	found, err := store.Get(bdevVolumeKey(bdev), name)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return name.Value, nil
+	}
+	return bdev, nil
+}
+
+// AddVolumeUser records that frontend object user uses volume name
+func AddVolumeUser(volumeLocks *locks.Locks, store gokv.Store, name string, user string) error {
+	unlock := volumeLocks.Lock(volumeUsersKey(name))
+	defer unlock()
+	users := new(structpb.Struct)
+	found, err := store.Get(volumeUsersKey(name), users)
+	if err != nil {
+		return err
+	}
+	if !found || users.Fields == nil {
+		users.Fields = make(map[string]*structpb.Value)
+	}
+	users.Fields[user] = structpb.NewBoolValue(true)
+	return store.Set(volumeUsersKey(name), users)
+}
+
+// RemoveVolumeUser records that frontend object user no longer uses volume name
+func RemoveVolumeUser(volumeLocks *locks.Locks, store gokv.Store, name string, user string) error {
+	unlock := volumeLocks.Lock(volumeUsersKey(name))
+	defer unlock()
+	users := new(structpb.Struct)
+	found, err := store.Get(volumeUsersKey(name), users)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	delete(users.Fields, user)
+	return store.Set(volumeUsersKey(name), users)
+}
+
+// VolumeUsers returns sorted names of frontend objects which use volume name
+func VolumeUsers(store gokv.Store, name string) ([]string, error) {
+	users := new(structpb.Struct)
+	_, err := store.Get(volumeUsersKey(name), users)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users.Fields))
+	for user := range users.Fields {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// checkVolumeUnused fails if volume name is still used by a frontend object
+func (s *Server) checkVolumeUnused(name string) error {
+	users, err := VolumeUsers(s.store, name)
+	if err != nil {
+		return err
+	}
+	if len(users) != 0 {
+		msg := fmt.Sprintf("Could not delete volume %s, it is used by %v", name, users)
+		return status.Errorf(codes.FailedPrecondition, msg)
+	}
+	return nil
+}
+
+// CreateNullVolume creates a Null volume instance
+func (s *Server) CreateNullVolume(ctx context.Context, in *pb.CreateNullVolumeRequest) (*pb.NullVolume, error) {
+	volume, err := s.Server.CreateNullVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = RegisterVolume(s.store, volume.Name, path.Base(volume.Name))
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// DeleteNullVolume deletes a Null volume instance
+func (s *Server) DeleteNullVolume(ctx context.Context, in *pb.DeleteNullVolumeRequest) (*emptypb.Empty, error) {
+	unlock := LockVolume(s.volumeLocks, in.GetName())
+	defer unlock()
+	if err := s.checkVolumeUnused(in.GetName()); err != nil {
+		return nil, err
+	}
+	response, err := s.Server.DeleteNullVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = UnregisterVolume(s.store, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// CreateMallocVolume creates a Malloc volume instance
+func (s *Server) CreateMallocVolume(ctx context.Context, in *pb.CreateMallocVolumeRequest) (*pb.MallocVolume, error) {
+	volume, err := s.Server.CreateMallocVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = RegisterVolume(s.store, volume.Name, path.Base(volume.Name))
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// DeleteMallocVolume deletes a Malloc volume instance
+func (s *Server) DeleteMallocVolume(ctx context.Context, in *pb.DeleteMallocVolumeRequest) (*emptypb.Empty, error) {
+	unlock := LockVolume(s.volumeLocks, in.GetName())
+	defer unlock()
+	if err := s.checkVolumeUnused(in.GetName()); err != nil {
+		return nil, err
+	}
+	response, err := s.Server.DeleteMallocVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = UnregisterVolume(s.store, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// CreateAioVolume creates an Aio volume instance
+func (s *Server) CreateAioVolume(ctx context.Context, in *pb.CreateAioVolumeRequest) (*pb.AioVolume, error) {
+	volume, err := s.Server.CreateAioVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = RegisterVolume(s.store, volume.Name, path.Base(volume.Name))
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// DeleteAioVolume deletes an Aio volume instance
+func (s *Server) DeleteAioVolume(ctx context.Context, in *pb.DeleteAioVolumeRequest) (*emptypb.Empty, error) {
+	unlock := LockVolume(s.volumeLocks, in.GetName())
+	defer unlock()
+	if err := s.checkVolumeUnused(in.GetName()); err != nil {
+		return nil, err
+	}
+	response, err := s.Server.DeleteAioVolume(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	err = UnregisterVolume(s.store, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
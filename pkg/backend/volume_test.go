@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package backend implememnts the BackEnd APIs (network facing) of the storage Server
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/philippgille/gokv/gomap"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/locks"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+func TestBackEnd_MallocVolumeRegistry(t *testing.T) {
+	volumeName := utils.ResourceIDToVolumeName("mytest")
+	tests := map[string]struct {
+		spdk    []string
+		users   []string
+		errCode codes.Code
+		errMsg  string
+		deleted bool
+	}{
+		"unused volume is deleted": {
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":"mytest"}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			users:   nil,
+			errCode: codes.OK,
+			errMsg:  "",
+			deleted: true,
+		},
+		"volume in use is not deleted": {
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":"mytest"}`,
+			},
+			users:   []string{"nvmeSubsystems/subsys0/nvmeNamespaces/ns0", "volumes/virtio0"},
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Could not delete volume %s, it is used by %v", volumeName, []string{"nvmeSubsystems/subsys0/nvmeNamespaces/ns0", "volumes/virtio0"}),
+			deleted: false,
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testSocket := utils.GenerateSocketName("backend")
+			ln, jsonRPC := utils.CreateTestSpdkServer(testSocket, tt.spdk)
+			defer func() { _ = ln.Close() }()
+			options := gomap.DefaultOptions
+			options.Codec = utils.ProtoCodec{}
+			store := gomap.NewStore(options)
+			server := NewServer(jsonRPC, store, new(locks.Locks))
+			ctx := context.Background()
+
+			volume, err := server.CreateMallocVolume(ctx, &pb.CreateMallocVolumeRequest{
+				MallocVolume:   &pb.MallocVolume{BlockSize: 512, BlocksCount: 64},
+				MallocVolumeId: "mytest",
+			})
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			bdev, err := VolumeBdev(store, volume.Name)
+			if err != nil || bdev != "mytest" {
+				t.Error("bdev: expected", "mytest", "received", bdev, err)
+			}
+			for _, user := range tt.users {
+				_ = AddVolumeUser(server.volumeLocks, store, volume.Name, user)
+			}
+
+			_, err = server.DeleteMallocVolume(ctx, &pb.DeleteMallocVolumeRequest{Name: volume.Name})
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+			_, err = VolumeBdev(store, volume.Name)
+			if deleted := status.Code(err) == codes.NotFound; deleted != tt.deleted {
+				t.Error("deleted: expected", tt.deleted, "received", deleted)
+			}
+		})
+	}
+}
+
+func TestBackEnd_ResolveVolume(t *testing.T) {
+	tests := map[string]struct {
+		in      string
+		spdk    []string
+		out     string
+		errCode codes.Code
+		errMsg  string
+	}{
+		"registered volume": {
+			in:      "volume0",
+			spdk:    []string{},
+			out:     "Malloc0",
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"bdev of an NVMe remote controller": {
+			in:      "Nvme0n1",
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"name":"Nvme0n1","block_size":512,"num_blocks":131072,"uuid":"9cf6a3a4-5a3b-4f2a-9c5c-5d4f1d6f1e59"}]}`},
+			out:     "Nvme0n1",
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"bdev of a registered volume": {
+			in:      "Malloc0",
+			spdk:    []string{},
+			out:     "",
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Bdev %s backs volume %s, refer to the volume instead", "Malloc0", "volume0"),
+		},
+		"unknown bdev": {
+			in:      "Nvme1n1",
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"name":"Nvme0n1","block_size":512,"num_blocks":131072,"uuid":"9cf6a3a4-5a3b-4f2a-9c5c-5d4f1d6f1e59"}]}`},
+			out:     "",
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find volume %s", "Nvme1n1"),
+		},
+		"error code from SPDK response": {
+			in:      "Nvme1n1",
+			spdk:    []string{`{"id":%d,"error":{"code":1,"message":"myopierr"},"result":null}`},
+			out:     "",
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("bdev_get_bdevs: %v", "json response error: myopierr"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testSocket := utils.GenerateSocketName("backend")
+			ln, jsonRPC := utils.CreateTestSpdkServer(testSocket, tt.spdk)
+			defer func() { _ = ln.Close() }()
+			options := gomap.DefaultOptions
+			options.Codec = utils.ProtoCodec{}
+			store := gomap.NewStore(options)
+			_ = RegisterVolume(store, "volume0", "Malloc0")
+
+			bdev, err := ResolveVolume(context.Background(), jsonRPC, store, tt.in)
+
+			if bdev != tt.out {
+				t.Error("bdev: expected", tt.out, "received", bdev)
+			}
+			// SPDK errors are returned as they are, as Unknown once sent to a client
+			er := status.Convert(err)
+			if er.Code() != tt.errCode {
+				t.Error("error code: expected", tt.errCode, "received", er.Code())
+			}
+			if er.Message() != tt.errMsg {
+				t.Error("error message: expected", tt.errMsg, "received", er.Message())
+			}
+			// resolving a volume does not register it
+			if _, err := VolumeBdev(store, tt.in); tt.in != "volume0" && status.Code(err) != codes.NotFound {
+				t.Error("volume: expected", tt.in, "to be unregistered, received", err)
+			}
+		})
+	}
+}
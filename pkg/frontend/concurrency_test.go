@@ -0,0 +1,459 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/gomap"
+
+	"github.com/opiproject/gospdk/spdk"
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+// fakeSnap is a SNAP JSON-RPC server keeping subsystems, their controllers
+// and namespaces, and virtio-blk devices in memory. Mutating calls on a subsystem take a while, so that calls of
+// concurrent gRPC requests on the same subsystem overlap unless the bridge
+// serializes them.
+type fakeSnap struct {
+	mu sync.Mutex
+	// busy holds the NQNs with a mutating call in flight
+	busy map[string]bool
+	// overlaps counts mutating calls issued while another one was in flight
+	// for the same NQN
+	overlaps int
+	// subsystems maps the NQN of created subsystems to their controllers
+	subsystems map[string]map[int]bool
+	// models maps the NQN of created subsystems to their model number
+	models map[string]string
+	cntlid int
+	// namespaces holds the attached namespaces as nqn/cntlid/nsid
+	namespaces map[string]bool
+	// virtioBlks maps the serials of created virtio-blk devices to their bdev
+	virtioBlks map[string]string
+	// nvmfNamespaces maps the NVMe-oF namespaces, as nqn/nsid, to their bdev
+	nvmfNamespaces map[string]string
+	// gate, when set, holds mutating subsystem and namespace calls after
+	// they are sent to entered until it is closed
+	gate    chan struct{}
+	entered chan string
+	// fail, when set, names the method whose next call fails
+	fail string
+}
+
+var _ spdk.JSONRPC = (*fakeSnap)(nil)
+
+func newFakeSnap() *fakeSnap {
+	return &fakeSnap{
+		busy:           make(map[string]bool),
+		subsystems:     make(map[string]map[int]bool),
+		models:         make(map[string]string),
+		namespaces:     make(map[string]bool),
+		virtioBlks:     make(map[string]string),
+		nvmfNamespaces: make(map[string]string),
+	}
+}
+
+func (f *fakeSnap) GetID() uint64 {
+	return 0
+}
+
+func (f *fakeSnap) GetVersion(_ context.Context) string {
+	return "TBD"
+}
+
+func (f *fakeSnap) StartUnixListener() net.Listener {
+	return nil
+}
+
+func (f *fakeSnap) Call(_ context.Context, method string, args, result any) error {
+	var params struct {
+		Nqn    string `json:"nqn"`
+		Subnqn string `json:"subnqn"`
+		Cntlid int    `json:"cntlid"`
+		Nsid   int    `json:"nsid"`
+		Name   string `json:"name"`
+		Serial string `json:"serial"`
+		Model  string `json:"model_number"`
+		Bdev   string `json:"bdev"`
+		// Namespace is set by nvmf_subsystem_add_ns
+		Namespace struct {
+			Nsid     int    `json:"nsid"`
+			BdevName string `json:"bdev_name"`
+		} `json:"namespace"`
+	}
+	f.mu.Lock()
+	fail := f.fail == method
+	if fail {
+		f.fail = ""
+	}
+	f.mu.Unlock()
+	if fail {
+		return fmt.Errorf("%s failed", method)
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	_ = json.Unmarshal(data, &params)
+	nqn := params.Nqn + params.Subnqn
+
+	var answer any
+	switch method {
+	case "spdk_get_version":
+		answer = spdk.GetVersionResult{Version: "TBD"}
+	case "subsystem_nvme_list":
+		answer = f.list()
+	case "subsystem_nvme_create", "subsystem_nvme_delete",
+		"controller_nvme_create", "controller_nvme_delete":
+		answer = f.mutate(method, nqn, params.Cntlid, params.Model)
+	case "controller_nvme_namespace_attach", "controller_nvme_namespace_detach":
+		answer = f.mutateNamespace(method, fmt.Sprintf("%s/%d/%d", nqn, params.Cntlid, params.Nsid))
+	case "controller_virtio_blk_create":
+		answer = f.mutateVirtioBlk(method, params.Serial, params.Bdev)
+	case "controller_virtio_blk_delete":
+		answer = f.mutateVirtioBlk(method, path.Base(params.Name), "")
+	case "nvmf_subsystem_add_ns":
+		answer = f.mutateNvmfNamespace(method, fmt.Sprintf("%s/%d", nqn, params.Namespace.Nsid), params.Namespace.BdevName)
+	case "nvmf_subsystem_remove_ns":
+		answer = f.mutateNvmfNamespace(method, fmt.Sprintf("%s/%d", nqn, params.Nsid), "")
+	default:
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	data, err = json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+// list returns the created subsystems
+func (f *fakeSnap) list() []models.NvdaSubsystemNvmeListResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := []models.NvdaSubsystemNvmeListResult{}
+	for nqn := range f.subsystems {
+		result = append(result, models.NvdaSubsystemNvmeListResult{Nqn: nqn})
+	}
+	return result
+}
+
+// mutate applies method to subsystem nqn while recording it as in flight
+func (f *fakeSnap) mutate(method string, nqn string, cntlid int, model string) any {
+	f.mu.Lock()
+	if f.busy[nqn] {
+		f.overlaps++
+	}
+	f.busy[nqn] = true
+	f.mu.Unlock()
+
+	if f.gate != nil {
+		f.entered <- method
+		<-f.gate
+	}
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.busy, nqn)
+	controllers, found := f.subsystems[nqn]
+	switch method {
+	case "subsystem_nvme_create":
+		if found {
+			return false
+		}
+		f.subsystems[nqn] = make(map[int]bool)
+		f.models[nqn] = model
+		return true
+	case "subsystem_nvme_delete":
+		if !found || len(controllers) != 0 {
+			return false
+		}
+		delete(f.subsystems, nqn)
+		delete(f.models, nqn)
+		return true
+	case "controller_nvme_create":
+		if !found {
+			return models.NvdaControllerNvmeCreateResult{Cntlid: -1}
+		}
+		f.cntlid++
+		controllers[f.cntlid] = true
+		return models.NvdaControllerNvmeCreateResult{Cntlid: f.cntlid}
+	default:
+		if !controllers[cntlid] {
+			return false
+		}
+		delete(controllers, cntlid)
+		return true
+	}
+}
+
+// mutateNamespace attaches or detaches namespace nqn/cntlid/nsid
+func (f *fakeSnap) mutateNamespace(method string, namespace string) bool {
+	if f.gate != nil {
+		f.entered <- method
+		<-f.gate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if method == "controller_nvme_namespace_attach" {
+		f.namespaces[namespace] = true
+		return true
+	}
+	if !f.namespaces[namespace] {
+		return false
+	}
+	delete(f.namespaces, namespace)
+	return true
+}
+
+// mutateVirtioBlk creates virtio-blk device serial on bdev or deletes it
+func (f *fakeSnap) mutateVirtioBlk(method string, serial string, bdev string) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if method == "controller_virtio_blk_create" {
+		f.virtioBlks[serial] = bdev
+		return "VblkEmu0pf0"
+	}
+	if _, found := f.virtioBlks[serial]; !found {
+		return false
+	}
+	delete(f.virtioBlks, serial)
+	return true
+}
+
+// mutateNvmfNamespace adds NVMe-oF namespace nqn/nsid on bdev or removes it
+func (f *fakeSnap) mutateNvmfNamespace(method string, namespace string, bdev string) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.nvmfNamespaces[namespace]
+	if method == "nvmf_subsystem_add_ns" {
+		if found {
+			return -1
+		}
+		f.nvmfNamespaces[namespace] = bdev
+		return 1
+	}
+	if !found {
+		return false
+	}
+	delete(f.nvmfNamespaces, namespace)
+	return true
+}
+
+// syncStore serializes access to the wrapped store, gomap.Store.Delete does
+// not take the lock of the map
+type syncStore struct {
+	gokv.Store
+	mu sync.RWMutex
+}
+
+func (s *syncStore) Set(k string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Store.Set(k, v)
+}
+
+func (s *syncStore) Get(k string, v interface{}) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.Get(k, v)
+}
+
+func (s *syncStore) Delete(k string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Store.Delete(k)
+}
+
+func createConcurrentTestEnvironment(t *testing.T) (*fakeSnap, *Server, *frontendClient) {
+	snap := newFakeSnap()
+	options := gomap.DefaultOptions
+	options.Codec = utils.ProtoCodec{}
+	server := NewServer(snap, &syncStore{Store: gomap.NewStore(options)})
+
+	conn, err := grpc.DialContext(context.Background(),
+		"",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialer(server)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.CloseGrpcConnection(conn) })
+	return snap, server, &frontendClient{
+		pb.NewFrontendNvmeServiceClient(conn),
+		pb.NewFrontendVirtioBlkServiceClient(conn),
+		longrunningpb.NewOperationsClient(conn),
+	}
+}
+
+func TestFrontEnd_ConcurrentCreateNvmeSubsystem(t *testing.T) {
+	snap, _, client := createConcurrentTestEnvironment(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		// every subsystem is created by several clients at once
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := client.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+					NvmeSubsystemId: fmt.Sprintf("subsystem-%d", i),
+					NvmeSubsystem: &pb.NvmeSubsystem{
+						Spec: &pb.NvmeSubsystemSpec{Nqn: fmt.Sprintf("nqn.2022-09.io.spdk:opi%d", i)},
+					},
+				})
+				if err != nil {
+					t.Error("unexpected error", err)
+				}
+			}(i)
+		}
+	}
+	// other subsystems race for the same NQN, only one of them may get it
+	created := make(chan string, 3)
+	for j := 0; j < 3; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			response, err := client.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+				NvmeSubsystemId: fmt.Sprintf("subsystem-same-nqn-%d", j),
+				NvmeSubsystem: &pb.NvmeSubsystem{
+					Spec: &pb.NvmeSubsystemSpec{Nqn: "nqn.2022-09.io.spdk:same"},
+				},
+			})
+			if err == nil {
+				created <- response.Name
+			}
+		}(j)
+	}
+	wg.Wait()
+	close(created)
+
+	if len(created) != 1 {
+		t.Error("subsystems with the same NQN: expected 1, received", len(created))
+	}
+	response, err := client.ListNvmeSubsystems(ctx, &pb.ListNvmeSubsystemsRequest{PageSize: 100})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(response.NvmeSubsystems) != 11 {
+		t.Error("listed subsystems: expected", 11, "received", len(response.NvmeSubsystems))
+	}
+	if len(snap.subsystems) != 11 {
+		t.Error("SNAP subsystems: expected", 11, "received", len(snap.subsystems))
+	}
+	if snap.overlaps != 0 {
+		t.Error("overlapping SNAP calls: expected none, received", snap.overlaps)
+	}
+}
+
+func TestFrontEnd_ConcurrentNvmeSubsystemAndControllers(t *testing.T) {
+	snap, server, client := createConcurrentTestEnvironment(t)
+	ctx := context.Background()
+	subsystem := &pb.NvmeSubsystem{Spec: testSubsystem.Spec}
+
+	_, err := client.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+		NvmeSubsystemId: testSubsystemID,
+		NvmeSubsystem:   subsystem,
+	})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < 5; k++ {
+				// errors are expected while the subsystem is being deleted
+				controller, err := client.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           testSubsystemName,
+					NvmeControllerId: fmt.Sprintf("controller-%d", i),
+					NvmeController: &pb.NvmeController{
+						Spec: &pb.NvmeControllerSpec{
+							Endpoint: &pb.NvmeControllerSpec_PcieId{
+								PcieId: &pb.PciEndpoint{
+									PhysicalFunction: wrapperspb.Int32(int32(i)),
+									VirtualFunction:  wrapperspb.Int32(0),
+									PortId:           wrapperspb.Int32(0),
+								},
+							},
+							Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+						},
+					},
+				})
+				if err == nil && k%2 == 0 {
+					_, _ = client.DeleteNvmeController(ctx, &pb.DeleteNvmeControllerRequest{
+						Name: controller.Name,
+					})
+				}
+			}
+		}(i)
+	}
+	for j := 0; j < 2; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 5; k++ {
+				_, _ = client.DeleteNvmeSubsystem(ctx, &pb.DeleteNvmeSubsystemRequest{
+					Name:         testSubsystemName,
+					AllowMissing: true,
+				})
+				_, _ = client.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+					NvmeSubsystemId: testSubsystemID,
+					NvmeSubsystem:   subsystem,
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if snap.overlaps != 0 {
+		t.Error("overlapping SNAP calls: expected none, received", snap.overlaps)
+	}
+	// the bridge and SNAP have to agree on what exists
+	subsys := new(pb.NvmeSubsystem)
+	stored, err := server.store.Get(testSubsystemName, subsys)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, exists := snap.subsystems[subsystem.Spec.Nqn]
+	if stored != exists {
+		t.Fatal("subsystem: stored", stored, "in SNAP", exists)
+	}
+	if !exists {
+		return
+	}
+	controllers, err := server.storedNvmeControllers(subsys)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(controllers) != len(snap.subsystems[subsystem.Spec.Nqn]) {
+		t.Error("controllers: stored", len(controllers), "in SNAP", len(snap.subsystems[subsystem.Spec.Nqn]))
+	}
+	for _, controller := range controllers {
+		if !snap.subsystems[subsystem.Spec.Nqn][int(controller.Spec.GetNvmeControllerId())] {
+			t.Error("controller", controller.Name, "is not in SNAP")
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// DefaultEmulationManager is the emulation manager of the first port of a
+// single port card
+const DefaultEmulationManager = "mlx5_0"
+
+// PciBdfHeader is the gRPC response header reporting the PCI address at which
+// the host sees the device returned by GetNvmeController or GetVirtioBlk, as
+// observed in SNAP, since the API has no status field for it
+const PciBdfHeader = "pci-bdf"
+
+// emulationManager returns the SNAP emulation manager serving the port of
+// endpoint. A manager SNAP did not report when last validated is validated
+// again, so that requests for it are refused until SNAP reports it.
+func (s *Server) emulationManager(ctx context.Context, endpoint *pb.PciEndpoint) (string, error) {
+	port := int(endpoint.GetPortId().GetValue())
+	if port < 0 || port >= len(s.emulationManagers) {
+		msg := fmt.Sprintf("No emulation manager configured for port %d", port)
+		return "", status.Errorf(codes.InvalidArgument, msg)
+	}
+	manager := s.emulationManagers[port]
+	if s.emulationManagerUnavailable(manager) {
+		err := s.ValidateEmulationManagers(ctx)
+		if err != nil && s.emulationManagerUnavailable(manager) {
+			msg := fmt.Sprintf("Emulation manager %s configured for port %d is not reported by SNAP", manager, port)
+			return "", status.Errorf(codes.FailedPrecondition, msg)
+		}
+	}
+	return manager, nil
+}
+
+// emulationManagerUnavailable reports whether SNAP did not report manager when
+// the emulation managers were last validated
+func (s *Server) emulationManagerUnavailable(manager string) bool {
+	s.unavailableManagersMu.Lock()
+	defer s.unavailableManagersMu.Unlock()
+	return s.unavailableManagers[manager]
+}
+
+// emulationPort returns the port served by SNAP emulation manager, unknown
+// managers are reported as port 0
+func (s *Server) emulationPort(manager string) int32 {
+	for i, m := range s.emulationManagers {
+		if m == manager {
+			return int32(i)
+		}
+	}
+	return 0
+}
+
+// ValidateEmulationManagers checks that all configured emulation managers are
+// reported by the SNAP service. Requests for the devices of the managers which
+// are not reported are refused until a later validation finds them.
+func (s *Server) ValidateEmulationManagers(ctx context.Context) error {
+	var result []models.NvdaEmulationManagersListResult
+	err := s.rpc.Call(ctx, "emulation_managers_list", nil, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	available := make(map[string]bool)
+	for i := range result {
+		available[result[i].EmulationManager] = true
+	}
+	unavailable := make(map[string]bool)
+	for port, manager := range s.emulationManagers {
+		if !available[manager] {
+			unavailable[manager] = true
+			if err == nil {
+				err = fmt.Errorf("emulation manager %s configured for port %d is not reported by SNAP", manager, port)
+			}
+		}
+	}
+	s.unavailableManagersMu.Lock()
+	s.unavailableManagers = unavailable
+	s.unavailableManagersMu.Unlock()
+	return err
+}
+
+// validateVirtualFunction checks that the virtual function of endpoint exists
+// on its physical function of emulationType. Virtual function 0 stands for the
+// physical function itself.
+func (s *Server) validateVirtualFunction(ctx context.Context, manager string, emulationType string, endpoint *pb.PciEndpoint) error {
+	pf := endpoint.GetPhysicalFunction().GetValue()
+	vf := endpoint.GetVirtualFunction().GetValue()
+	if pf < 0 || vf < 0 {
+		msg := fmt.Sprintf("Invalid PCIe endpoint: physical function %d, virtual function %d", pf, vf)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if vf == 0 {
+		return nil
+	}
+	params := models.NvdaEmulationFunctionsListParams{
+		EmulationManager: manager,
+	}
+	var result []models.NvdaEmulationFunctionsListResult
+	err := s.rpc.Call(ctx, "emulation_functions_list", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	for i := range result {
+		r := &result[i]
+		if r.EmulationType != emulationType || r.PfIndex != int(pf) {
+			continue
+		}
+		if int(vf) > r.NumVfs {
+			msg := fmt.Sprintf("Virtual function %d is out of range, physical function %d has %d virtual functions", vf, pf, r.NumVfs)
+			return status.Errorf(codes.InvalidArgument, msg)
+		}
+		return nil
+	}
+	msg := fmt.Sprintf("Could not find %s physical function %d on %s", emulationType, pf, manager)
+	return status.Errorf(codes.InvalidArgument, msg)
+}
+
+// snapVfID converts the virtual function of endpoint to SNAP vf_id, which
+// counts virtual functions from 0 and is omitted for the physical function
+func snapVfID(endpoint *pb.PciEndpoint) *int {
+	vf := int(endpoint.GetVirtualFunction().GetValue())
+	if vf <= 0 {
+		return nil
+	}
+	vfID := vf - 1
+	return &vfID
+}
+
+// pciEndpoint returns the PCIe endpoint of a SNAP controller
+func (s *Server) pciEndpoint(r *models.NvdaControllerListResult) *pb.PciEndpoint {
+	vf := int32(0)
+	if r.VfIndex != nil {
+		vf = int32(*r.VfIndex) + 1
+	}
+	return &pb.PciEndpoint{
+		PhysicalFunction: wrapperspb.Int32(int32(r.PciIndex)),
+		VirtualFunction:  wrapperspb.Int32(vf),
+		PortId:           wrapperspb.Int32(s.emulationPort(r.EmulationManager)),
+	}
+}
+
+// reportPciBdf sends bdf, the observed PCI address of a device, in PciBdfHeader
+func reportPciBdf(ctx context.Context, bdf string) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs(PciBdfHeader, bdf)); err != nil {
+		log.Printf("Could not report PCI address: %v", err)
+	}
+}
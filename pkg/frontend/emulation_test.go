@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+func TestFrontEnd_ValidateEmulationManagers(t *testing.T) {
+	tests := map[string]struct {
+		managers []string
+		spdk     []string
+		errMsg   string
+	}{
+		"all managers reported": {
+			managers: []string{"mlx5_0", "mlx5_1"},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"emulation_manager":"mlx5_0","hotplug_support":true,"supported_types":["nvme","virtio_blk"]},{"emulation_manager":"mlx5_1","hotplug_support":true,"supported_types":["nvme","virtio_blk"]}]}`},
+			errMsg:   "",
+		},
+		"manager not reported": {
+			managers: []string{"mlx5_0", "mlx5_2"},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"emulation_manager":"mlx5_0","hotplug_support":true,"supported_types":["nvme","virtio_blk"]}]}`},
+			errMsg:   fmt.Sprintf("emulation manager %s configured for port %d is not reported by SNAP", "mlx5_2", 1),
+		},
+		"spdk error": {
+			managers: []string{"mlx5_0"},
+			spdk:     []string{`{"id":%d,"error":{"code":1,"message":"myopierr"},"result":[]}`},
+			errMsg:   fmt.Sprintf("emulation_managers_list: %v", "json response error: myopierr"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			testEnv.opiSpdkServer.emulationManagers = tt.managers
+
+			err := testEnv.opiSpdkServer.ValidateEmulationManagers(testEnv.ctx)
+
+			if tt.errMsg == "" && err != nil {
+				t.Error("unexpected error", err)
+			}
+			if tt.errMsg != "" && (err == nil || err.Error() != tt.errMsg) {
+				t.Error("error: expected", tt.errMsg, "received", err)
+			}
+		})
+	}
+}
+
+func TestFrontEnd_UnavailableEmulationManager(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	onlyFirst := `{"id":%d,"error":{"code":0,"message":""},"result":[{"emulation_manager":"mlx5_0","hotplug_support":true,"supported_types":["nvme","virtio_blk"]}]}`
+	both := `{"id":%d,"error":{"code":0,"message":""},"result":[{"emulation_manager":"mlx5_0","hotplug_support":true,"supported_types":["nvme","virtio_blk"]},{"emulation_manager":"mlx5_2","hotplug_support":true,"supported_types":["nvme","virtio_blk"]}]}`
+	tests := map[string]struct {
+		port    int32
+		spdk    []string
+		errCode codes.Code
+		errMsg  string
+	}{
+		"available manager": {
+			port:    0,
+			spdk:    []string{onlyFirst, `{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"manager still not reported": {
+			port:    1,
+			spdk:    []string{onlyFirst, onlyFirst},
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Emulation manager %s configured for port %d is not reported by SNAP", "mlx5_2", 1),
+		},
+		"manager reported later": {
+			port:    1,
+			spdk:    []string{onlyFirst, both, `{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"validation error": {
+			port:    1,
+			spdk:    []string{onlyFirst, `{"id":%d,"error":{"code":1,"message":"myopierr"},"result":[]}`},
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Emulation manager %s configured for port %d is not reported by SNAP", "mlx5_2", 1),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			testEnv.opiSpdkServer.emulationManagers = []string{"mlx5_0", "mlx5_2"}
+			if err := testEnv.opiSpdkServer.ValidateEmulationManagers(testEnv.ctx); err == nil {
+				t.Fatal("expected mlx5_2 to be unavailable")
+			}
+
+			virtioBlk := utils.ProtoClone(&testVirtioCtrl)
+			virtioBlk.PcieId.PortId = wrapperspb.Int32(tt.port)
+			request := &pb.CreateVirtioBlkRequest{VirtioBlk: virtioBlk, VirtioBlkId: testVirtioCtrlID}
+			_, err := testEnv.client.CreateVirtioBlk(testEnv.ctx, request)
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+		})
+	}
+}
@@ -7,38 +7,161 @@
 package frontend
 
 import (
+	"context"
 	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
 
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"github.com/philippgille/gokv"
+	"go.einride.tech/aip/resourceid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/opiproject/gospdk/spdk"
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/locks"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 )
 
 // Server contains frontend related OPI services
 type Server struct {
 	pb.UnimplementedFrontendNvmeServiceServer
 	pb.UnimplementedFrontendVirtioBlkServiceServer
-	VirtioCtrls map[string]*pb.VirtioBlk
-	NQNs        map[string]bool
-	Pagination  map[string]int
-	store       gokv.Store
-	rpc         spdk.JSONRPC
+	longrunningpb.UnimplementedOperationsServer
+	store             gokv.Store
+	rpc               spdk.JSONRPC
+	emulationManagers []string
+	// unavailableManagers holds the configured emulation managers which SNAP
+	// did not report when they were last validated
+	unavailableManagers   map[string]bool
+	unavailableManagersMu sync.Mutex
+	// locks serializes concurrent RPCs acting on the same resources, it is
+	// shared with the backend server which locks the volumes it deletes
+	locks *locks.Locks
+	// operations holds the long-running operations executed by this server
+	operations map[string]*runningOperation
+	// operationRetention is how long done operations are kept
+	operationRetention time.Duration
+	// leaseRenewing is set while the lease of serverID is renewed
+	leaseRenewing bool
+	operationsMu  sync.Mutex
+	// serverID identifies this server as the owner of the operations it runs
+	serverID string
 }
 
 // NewServer creates initialized instance of Nvme server
 func NewServer(jsonRPC spdk.JSONRPC, store gokv.Store) *Server {
+	return NewServerWithEmulationManagers(jsonRPC, store, []string{DefaultEmulationManager}, new(locks.Locks))
+}
+
+// NewServerWithEmulationManagers creates initialized instance of Nvme server
+// where emulationManagers[i] serves the devices with PciEndpoint.PortId i,
+// sharing resourceLocks with the backend server
+func NewServerWithEmulationManagers(jsonRPC spdk.JSONRPC, store gokv.Store, emulationManagers []string, resourceLocks *locks.Locks) *Server {
 	if jsonRPC == nil {
 		log.Panic("nil for JSONRPC is not allowed")
 	}
 	if store == nil {
 		log.Panic("nil for Store is not allowed")
 	}
+	if len(emulationManagers) == 0 {
+		log.Panic("empty list of emulation managers is not allowed")
+	}
+	if resourceLocks == nil {
+		log.Panic("nil for Locks is not allowed")
+	}
 	return &Server{
-		VirtioCtrls: make(map[string]*pb.VirtioBlk),
-		NQNs:        make(map[string]bool),
-		Pagination:  make(map[string]int),
-		store:       store,
-		rpc:         jsonRPC,
+		store:              store,
+		rpc:                operationRPC{jsonRPC},
+		emulationManagers:  emulationManagers,
+		locks:              resourceLocks,
+		operations:         make(map[string]*runningOperation),
+		operationRetention: defaultOperationRetention,
+		serverID:           resourceid.NewSystemGenerated(),
+	}
+}
+
+// lockNvme locks the subsystem of the NVMe resource name, then name itself
+// when it is a controller or a namespace
+func (s *Server) lockNvme(name string) (unlock func()) {
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(name),
+	)
+	return s.locks.Lock(subsysName, name)
+}
+
+// addVolumeStats accumulates counters of bdev into stats. SNAP reports 64-bit
+// counters while VolumeStats fields are int32, so the sums saturate instead of
+// wrapping around into negative values. The flush, error and queue depth
+// counters have no VolumeStats field, see volumeCounters.
+func addVolumeStats(stats *pb.VolumeStats, bdev *models.NvdaControllerStatsBdev) {
+	stats.ReadBytesCount = saturatingAdd(stats.ReadBytesCount, bdev.BytesRead)
+	stats.ReadOpsCount = saturatingAdd(stats.ReadOpsCount, bdev.ReadIos)
+	stats.WriteBytesCount = saturatingAdd(stats.WriteBytesCount, bdev.BytesWritten)
+	stats.WriteOpsCount = saturatingAdd(stats.WriteOpsCount, bdev.WriteIos)
+	stats.UnmapBytesCount = saturatingAdd(stats.UnmapBytesCount, bdev.BytesUnmapped)
+	stats.UnmapOpsCount = saturatingAdd(stats.UnmapOpsCount, bdev.NumUnmapOps)
+	stats.ReadLatencyTicks = saturatingAdd(stats.ReadLatencyTicks, bdev.ReadLatencyTicks)
+	stats.WriteLatencyTicks = saturatingAdd(stats.WriteLatencyTicks, bdev.WriteLatencyTicks)
+	stats.UnmapLatencyTicks = saturatingAdd(stats.UnmapLatencyTicks, bdev.UnmapLatencyTicks)
+}
+
+// The Stats RPCs send the SNAP counters which VolumeStats has no field for in
+// these gRPC response headers, as decimal 64-bit values summed over the same
+// bdevs as the returned VolumeStats
+const (
+	// FlushOpsHeader reports the number of flush requests
+	FlushOpsHeader = "flush-ops-count"
+	// ReadErrorsHeader reports the number of failed read requests
+	ReadErrorsHeader = "read-errors-count"
+	// WriteErrorsHeader reports the number of failed write requests
+	WriteErrorsHeader = "write-errors-count"
+	// FlushErrorsHeader reports the number of failed flush requests
+	FlushErrorsHeader = "flush-errors-count"
+	// QueueDepthHeader reports the number of requests in flight
+	QueueDepthHeader = "queue-depth"
+)
+
+// volumeCounters accumulates the SNAP bdev counters VolumeStats has no
+// field for
+type volumeCounters struct {
+	flushOps    uint64
+	readErrors  uint64
+	writeErrors uint64
+	flushErrors uint64
+	queueDepth  uint64
+}
+
+// add accumulates counters of bdev
+func (c *volumeCounters) add(bdev *models.NvdaControllerStatsBdev) {
+	c.flushOps += bdev.FlushIos
+	c.readErrors += bdev.ErrReadIos
+	c.writeErrors += bdev.ErrWriteIos
+	c.flushErrors += bdev.ErrFlushIos
+	c.queueDepth += bdev.QueueDepth
+}
+
+// report sends the counters in their response headers
+func (c *volumeCounters) report(ctx context.Context) {
+	header := metadata.Pairs(
+		FlushOpsHeader, strconv.FormatUint(c.flushOps, 10),
+		ReadErrorsHeader, strconv.FormatUint(c.readErrors, 10),
+		WriteErrorsHeader, strconv.FormatUint(c.writeErrors, 10),
+		FlushErrorsHeader, strconv.FormatUint(c.flushErrors, 10),
+		QueueDepthHeader, strconv.FormatUint(c.queueDepth, 10),
+	)
+	if err := grpc.SetHeader(ctx, header); err != nil {
+		log.Printf("Could not report stats counters: %v", err)
+	}
+}
+
+func saturatingAdd(sum int32, value uint64) int32 {
+	if sum < 0 || value > uint64(math.MaxInt32-sum) {
+		return math.MaxInt32
 	}
+	return sum + int32(value)
 }
@@ -11,8 +11,10 @@ import (
 	"net"
 	"os"
 
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/wrapperspb"
@@ -21,12 +23,14 @@ import (
 
 	"github.com/opiproject/gospdk/spdk"
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 )
 
 type frontendClient struct {
 	pb.FrontendNvmeServiceClient
 	pb.FrontendVirtioBlkServiceClient
+	longrunningpb.OperationsClient
 }
 
 type testEnv struct {
@@ -55,6 +59,12 @@ func createTestEnvironment(spdkResponses []string) *testEnv {
 	options.Codec = utils.ProtoCodec{}
 	store := gomap.NewStore(options)
 	env.opiSpdkServer = NewServer(env.jsonRPC, store)
+	// volumes referenced by the test objects, named after their bdevs
+	for _, volume := range []string{"Malloc0", "Malloc1", "Malloc2", "Malloc42", "Malloc43"} {
+		if err := backend.RegisterVolume(store, volume, volume); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx,
@@ -70,16 +80,29 @@ func createTestEnvironment(spdkResponses []string) *testEnv {
 	env.client = &frontendClient{
 		pb.NewFrontendNvmeServiceClient(env.conn),
 		pb.NewFrontendVirtioBlkServiceClient(env.conn),
+		longrunningpb.NewOperationsClient(env.conn),
 	}
 
 	return env
 }
 
+// volumeCountersHeader returns the counters sent in the FlushOpsHeader,
+// ReadErrorsHeader, WriteErrorsHeader, FlushErrorsHeader and QueueDepthHeader
+// response headers, in that order, or nil if they were not sent
+func volumeCountersHeader(header metadata.MD) []string {
+	var counters []string
+	for _, key := range []string{FlushOpsHeader, ReadErrorsHeader, WriteErrorsHeader, FlushErrorsHeader, QueueDepthHeader} {
+		counters = append(counters, header.Get(key)...)
+	}
+	return counters
+}
+
 func dialer(opiSpdkServer *Server) func(context.Context, string) (net.Conn, error) {
 	listener := bufconn.Listen(1024 * 1024)
 	server := grpc.NewServer()
 	pb.RegisterFrontendNvmeServiceServer(server, opiSpdkServer)
 	pb.RegisterFrontendVirtioBlkServiceServer(server, opiSpdkServer)
+	longrunningpb.RegisterOperationsServer(server, opiSpdkServer)
 
 	go func() {
 		if err := server.Serve(listener); err != nil {
@@ -147,6 +170,8 @@ var (
 			OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
 		},
 	}
+	testEmulationFunctions = `{"id":%d,"error":{"code":0,"message":""},"result":[{"emulation_type":"nvme","pf_index":1,"pci_bdf":"af:00.2","num_vfs":4},{"emulation_type":"virtio_blk","pf_index":42,"pci_bdf":"af:00.3","num_vfs":4}]}`
+
 	testVirtioCtrlID   = "virtio-blk-42"
 	testVirtioCtrlName = utils.ResourceIDToVolumeName(testVirtioCtrlID)
 	testVirtioCtrl     = pb.VirtioBlk{
@@ -158,12 +183,19 @@ var (
 		VolumeNameRef: "Malloc42",
 		MaxIoQps:      1,
 	}
+	testVirtioCtrlWithName = pb.VirtioBlk{
+		Name:          testVirtioCtrlName,
+		PcieId:        testVirtioCtrl.PcieId,
+		VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+		MaxIoQps:      testVirtioCtrl.MaxIoQps,
+	}
 
 	checkGlobalTestProtoObjectsNotChanged = utils.CheckTestProtoObjectsNotChanged(
 		&testSubsystem,
 		&testController,
 		&testNamespace,
 		&testVirtioCtrl,
+		&testVirtioCtrlWithName,
 		&testSubsystemWithStatus,
 		&testControllerWithStatus,
 		&testNamespaceWithStatus,
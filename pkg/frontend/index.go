@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"sort"
+
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// gokv.Store can not enumerate its keys, so the names of stored objects are
+// additionally kept under a per collection index key
+const (
+	nvmeSubsystemIndex  = "//storage.opiproject.org/index/subsystems"
+	nvmeControllerIndex = "//storage.opiproject.org/index/controllers"
+	nvmeNamespaceIndex  = "//storage.opiproject.org/index/namespaces"
+	virtioBlkIndex      = "//storage.opiproject.org/index/virtioblks"
+	operationIndex      = "//storage.opiproject.org/index/operations"
+)
+
+// nqnKey returns the store key holding the name of the subsystem which owns
+// nqn, so that NQN uniqueness survives restarts. The owner is read and then
+// written under the in-process lock of the key, gokv.Store has no atomic
+// create, so only one bridge may use a store.
+func nqnKey(nqn string) string {
+	return "//storage.opiproject.org/nqns/" + nqn
+}
+
+// getNqnOwner returns the name of the subsystem which owns nqn or an empty
+// string if there is none
+func (s *Server) getNqnOwner(nqn string) (string, error) {
+	owner := new(wrapperspb.StringValue)
+	_, err := s.store.Get(nqnKey(nqn), owner)
+	if err != nil {
+		return "", err
+	}
+	return owner.Value, nil
+}
+
+// setNqnOwner records name as the owner of nqn
+func (s *Server) setNqnOwner(nqn string, name string) error {
+	return s.store.Set(nqnKey(nqn), wrapperspb.String(name))
+}
+
+// moveVolumeUser records that user switched from volume from to volume to
+func (s *Server) moveVolumeUser(user string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	err := backend.AddVolumeUser(s.locks, s.store, to, user)
+	if err != nil {
+		return err
+	}
+	return backend.RemoveVolumeUser(s.locks, s.store, from, user)
+}
+
+// addToIndex records name in the index stored under key
+func (s *Server) addToIndex(key string, name string) error {
+	unlock := s.locks.Lock(key)
+	defer unlock()
+	index := new(structpb.Struct)
+	found, err := s.store.Get(key, index)
+	if err != nil {
+		return err
+	}
+	if !found || index.Fields == nil {
+		index.Fields = make(map[string]*structpb.Value)
+	}
+	index.Fields[name] = structpb.NewBoolValue(true)
+	return s.store.Set(key, index)
+}
+
+// removeFromIndex removes name from the index stored under key
+func (s *Server) removeFromIndex(key string, name string) error {
+	unlock := s.locks.Lock(key)
+	defer unlock()
+	index := new(structpb.Struct)
+	found, err := s.store.Get(key, index)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	delete(index.Fields, name)
+	return s.store.Set(key, index)
+}
+
+// listIndex returns sorted names recorded in the index stored under key
+func (s *Server) listIndex(key string) ([]string, error) {
+	index := new(structpb.Struct)
+	_, err := s.store.Get(key, index)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(index.Fields))
+	for name := range index.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -17,7 +17,6 @@ import (
 	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 
-	"github.com/google/uuid"
 	"go.einride.tech/aip/fieldbehavior"
 	"go.einride.tech/aip/fieldmask"
 	"go.einride.tech/aip/resourceid"
@@ -29,12 +28,18 @@ import (
 
 func sortNvmeControllers(controllers []*pb.NvmeController) {
 	sort.Slice(controllers, func(i int, j int) bool {
-		return *controllers[i].Spec.NvmeControllerId < *controllers[j].Spec.NvmeControllerId
+		ci := controllers[i].GetSpec().GetNvmeControllerId()
+		cj := controllers[j].GetSpec().GetNvmeControllerId()
+		if ci != cj {
+			return ci < cj
+		}
+		// fabrics controllers have no cntlid
+		return controllers[i].GetName() < controllers[j].GetName()
 	})
 }
 
 // CreateNvmeController creates an Nvme controller
-func (s *Server) CreateNvmeController(ctx context.Context, in *pb.CreateNvmeControllerRequest) (*pb.NvmeController, error) {
+func (s *Server) CreateNvmeController(ctx context.Context, in *pb.CreateNvmeControllerRequest) (_ *pb.NvmeController, err error) {
 	// check input correctness
 	if err := s.validateCreateNvmeControllerRequest(in); err != nil {
 		return nil, err
@@ -48,6 +53,20 @@ func (s *Server) CreateNvmeController(ctx context.Context, in *pb.CreateNvmeCont
 	in.NvmeController.Name = utils.ResourceIDToControllerName(
 		utils.GetSubsystemIDFromNvmeName(in.Parent), resourceID,
 	)
+	if asyncRequested(ctx) {
+		// the operation creates the object under the name returned now
+		request := utils.ProtoClone(in)
+		request.NvmeControllerId = resourceID
+		err := s.startOperation(ctx, request, true, func(ctx context.Context) (proto.Message, error) {
+			return s.CreateNvmeController(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return in.NvmeController, nil
+	}
+	unlock := s.lockNvme(in.NvmeController.Name)
+	defer unlock()
 	// idempotent API when called with same key, should return same object
 	controller := new(pb.NvmeController)
 	found, err := s.store.Get(in.NvmeController.Name, controller)
@@ -69,28 +88,45 @@ func (s *Server) CreateNvmeController(ctx context.Context, in *pb.CreateNvmeCont
 		return nil, err
 	}
 
-	params := models.NvdaControllerNvmeCreateParams{
-		Nqn:              subsys.Spec.Nqn,
-		EmulationManager: "mlx5_0",
-		PfID:             int(in.GetNvmeController().GetSpec().GetPcieId().GetPhysicalFunction().GetValue()),
-		// VfID:             int(in.NvmeController.Spec.PcieId.VirtualFunction),
-		// MaxNamespaces:    int(in.NvmeController.Spec.MaxNsq),
-		// NrIoQueues:       int(in.NvmeController.Spec.MaxNcq),
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	response := utils.ProtoClone(in.NvmeController)
+	if in.NvmeController.Spec.GetFabricsId() != nil {
+		err = s.createNvmeFabricsController(ctx, subsys, in.NvmeController)
+		if err != nil {
+			return nil, err
+		}
+		undo.add("CTRL "+in.NvmeController.Name, func(ctx context.Context) error {
+			return s.deleteNvmeFabricsController(ctx, subsys, in.NvmeController)
+		})
+	} else {
+		spec, err := s.createNvmeControllerEmulation(ctx, subsys, in.NvmeController)
+		if err != nil {
+			return nil, err
+		}
+		undo.add("CTRL "+in.NvmeController.Name, func(ctx context.Context) error {
+			return s.deleteNvmeControllerEmulation(ctx, subsys.Spec.Nqn, int(*spec.NvmeControllerId))
+		})
+		// attachments are recorded as namespaces get attached
+		undo.add("attachments of "+in.NvmeController.Name, func(context.Context) error {
+			return s.removeNvmeControllerAttachments(subsys, in.NvmeController.Name)
+		})
+		// shared namespaces are visible on every controller of the subsystem
+		err = s.attachNvmeSubsystemNamespaces(ctx, subsys, in.NvmeController.Name, int(*spec.NvmeControllerId))
+		if err != nil {
+			return nil, err
+		}
+		response.Spec = spec
 	}
-	var result models.NvdaControllerNvmeCreateResult
-	err = s.rpc.Call(ctx, "controller_nvme_create", &params, &result)
+	response.Status = &pb.NvmeControllerStatus{Active: true}
+	err = s.store.Set(in.NvmeController.Name, response)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if result.Cntlid < 0 {
-		msg := fmt.Sprintf("Could not create CTRL: %s", in.NvmeController.Name)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
-	}
-	response := utils.ProtoClone(in.NvmeController)
-	response.Spec.NvmeControllerId = proto.Int32(int32(result.Cntlid))
-	response.Status = &pb.NvmeControllerStatus{Active: true}
-	err = s.store.Set(in.NvmeController.Name, response)
+	undo.add("record of "+in.NvmeController.Name, func(context.Context) error {
+		return s.store.Delete(in.NvmeController.Name)
+	})
+	err = s.addToIndex(nvmeControllerIndex, in.NvmeController.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -103,6 +139,18 @@ func (s *Server) DeleteNvmeController(ctx context.Context, in *pb.DeleteNvmeCont
 	if err := s.validateDeleteNvmeControllerRequest(in); err != nil {
 		return nil, err
 	}
+	if asyncRequested(ctx) {
+		request := utils.ProtoClone(in)
+		err := s.startOperation(ctx, request, false, func(ctx context.Context) (proto.Message, error) {
+			return s.DeleteNvmeController(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+	unlock := s.lockNvme(in.Name)
+	defer unlock()
 	// fetch object from the database
 	controller := new(pb.NvmeController)
 	found, err := s.store.Get(in.Name, controller)
@@ -128,22 +176,27 @@ func (s *Server) DeleteNvmeController(ctx context.Context, in *pb.DeleteNvmeCont
 		return nil, err
 	}
 
-	params := models.NvdaControllerNvmeDeleteParams{
-		Subnqn: subsys.Spec.Nqn,
-		Cntlid: int(*controller.Spec.NvmeControllerId),
+	if controller.Spec.GetFabricsId() != nil {
+		err = s.deleteNvmeFabricsController(ctx, subsys, controller)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = s.deleteNvmeControllerEmulation(ctx, subsys.Spec.Nqn, int(*controller.Spec.NvmeControllerId))
+		if err != nil {
+			return nil, err
+		}
+		err = s.removeNvmeControllerAttachments(subsys, controller.Name)
+		if err != nil {
+			return nil, err
+		}
 	}
-	var result models.NvdaControllerNvmeDeleteResult
-	err = s.rpc.Call(ctx, "controller_nvme_delete", &params, &result)
+	// remove from the Database
+	err = s.store.Delete(controller.Name)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if !result {
-		msg := fmt.Sprintf("Could not delete NQN:ID %s:%d", subsys.Spec.Nqn, *controller.Spec.NvmeControllerId)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
-	}
-	// remove from the Database
-	err = s.store.Delete(controller.Name)
+	err = s.removeFromIndex(nvmeControllerIndex, controller.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -151,11 +204,13 @@ func (s *Server) DeleteNvmeController(ctx context.Context, in *pb.DeleteNvmeCont
 }
 
 // UpdateNvmeController updates an Nvme controller
-func (s *Server) UpdateNvmeController(_ context.Context, in *pb.UpdateNvmeControllerRequest) (*pb.NvmeController, error) {
+func (s *Server) UpdateNvmeController(ctx context.Context, in *pb.UpdateNvmeControllerRequest) (*pb.NvmeController, error) {
 	// check input correctness
 	if err := s.validateUpdateNvmeControllerRequest(in); err != nil {
 		return nil, err
 	}
+	unlock := s.lockNvme(in.NvmeController.Name)
+	defer unlock()
 	// fetch object from the database
 	controller := new(pb.NvmeController)
 	found, err := s.store.Get(in.NvmeController.Name, controller)
@@ -164,18 +219,62 @@ func (s *Server) UpdateNvmeController(_ context.Context, in *pb.UpdateNvmeContro
 	}
 	if !found {
 		if in.AllowMissing {
-			log.Printf("TODO: in case of AllowMissing, create a new resource, don;t return error")
+			// see https://google.aip.dev/134#create-or-update
+			log.Printf("NvmeController %v not found, creating it since AllowMissing is set", in.NvmeController.Name)
+			unlock()
+			return s.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+				Parent: utils.ResourceIDToSubsystemName(
+					utils.GetSubsystemIDFromNvmeName(in.NvmeController.Name),
+				),
+				NvmeController:   in.NvmeController,
+				NvmeControllerId: path.Base(in.NvmeController.Name),
+			})
 		}
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.NvmeController.Name)
 		return nil, err
 	}
-	resourceID := path.Base(controller.Name)
 	// update_mask = 2
 	if err := fieldmask.Validate(in.UpdateMask, in.NvmeController); err != nil {
 		return nil, err
 	}
-	log.Printf("TODO: use resourceID=%v", resourceID)
-	return nil, status.Errorf(codes.Unimplemented, "UpdateNvmeController method is not implemented")
+	response := utils.ProtoClone(controller)
+	fieldmask.Update(in.UpdateMask, response, in.NvmeController)
+	// name, controller id and status are not client settable
+	response.Name = controller.Name
+	response.Spec.NvmeControllerId = controller.Spec.NvmeControllerId
+	response.Status = controller.Status
+	if err := s.validateNvmeControllerSpec(response.Spec); err != nil {
+		return nil, err
+	}
+	if !proto.Equal(controller.Spec.MinLimit, response.Spec.MinLimit) ||
+		!proto.Equal(controller.Spec.MaxLimit, response.Spec.MaxLimit) {
+		msg := fmt.Sprintf("Could not update CTRL: %s, QoS limits are not supported by SNAP emulation", controller.Name)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	if (controller.Spec.GetFabricsId() == nil) != (response.Spec.GetFabricsId() == nil) {
+		msg := fmt.Sprintf("Could not update CTRL: %s, changing between PCIe and fabrics endpoints is not supported", controller.Name)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	if response.Spec.GetFabricsId() != nil {
+		if controller.Spec.Trtype != response.Spec.Trtype ||
+			!proto.Equal(controller.Spec.GetFabricsId(), response.Spec.GetFabricsId()) {
+			err = s.relistenNvmeFabricsController(ctx, controller, response)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if nvmeControllerNeedsRecreate(controller.Spec, response.Spec) {
+		spec, err := s.recreateNvmeController(ctx, controller, response)
+		if err != nil {
+			return nil, err
+		}
+		response.Spec = spec
+	}
+	err = s.store.Set(response.Name, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // ListNvmeControllers lists Nvme controllers
@@ -185,7 +284,7 @@ func (s *Server) ListNvmeControllers(ctx context.Context, in *pb.ListNvmeControl
 		return nil, err
 	}
 	// fetch object from the database
-	size, offset, perr := utils.ExtractPagination(in.PageSize, in.PageToken, s.Pagination)
+	size, offset, perr := extractPagination(in.PageSize, in.PageToken, in.Parent+"/nvmeControllers")
 	if perr != nil {
 		return nil, perr
 	}
@@ -198,28 +297,34 @@ func (s *Server) ListNvmeControllers(ctx context.Context, in *pb.ListNvmeControl
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Parent)
 		return nil, err
 	}
+	controllers, err := s.storedNvmeControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
 	var result []models.NvdaControllerListResult
 	err = s.rpc.Call(ctx, "controller_list", nil, &result)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Received from SPDK: %v", result)
-	token, hasMoreElements := "", false
-	log.Printf("Limiting result len(%d) to [%d:%d]", len(result), offset, size)
-	result, hasMoreElements = utils.LimitPagination(result, offset, size)
-	if hasMoreElements {
-		token = uuid.New().String()
-		s.Pagination[token] = offset + size
-	}
-	Blobarray := make([]*pb.NvmeController, len(result))
+	// SNAP controllers are only active while the device reports them
+	emulated := make(map[int]bool)
 	for i := range result {
 		r := &result[i]
 		if r.Subnqn == subsys.Spec.Nqn && r.Type == "nvme" {
-			Blobarray[i] = &pb.NvmeController{Spec: &pb.NvmeControllerSpec{NvmeControllerId: proto.Int32(int32(r.Cntlid))}}
+			emulated[r.Cntlid] = true
+		}
+	}
+	for _, controller := range controllers {
+		if controller.Spec.GetPcieId() != nil {
+			controller.Status = &pb.NvmeControllerStatus{
+				Active: emulated[int(controller.Spec.GetNvmeControllerId())],
+			}
 		}
 	}
-	sortNvmeControllers(Blobarray)
-	return &pb.ListNvmeControllersResponse{NvmeControllers: Blobarray}, nil
+	sortNvmeControllers(controllers)
+	controllers, token := limitPagination(controllers, offset, size, in.Parent+"/nvmeControllers")
+	return &pb.ListNvmeControllersResponse{NvmeControllers: controllers, NextPageToken: token}, nil
 }
 
 // GetNvmeController gets an Nvme controller
@@ -238,6 +343,23 @@ func (s *Server) GetNvmeController(ctx context.Context, in *pb.GetNvmeController
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
 		return nil, err
 	}
+	if controller.Spec.GetFabricsId() != nil {
+		// NVMe-oF controllers are created per host connection, the listener
+		// is all there is to report
+		return controller, nil
+	}
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(in.Name),
+	)
+	subsys := new(pb.NvmeSubsystem)
+	found, err = s.store.Get(subsysName, subsys)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+		return nil, err
+	}
 	var result []models.NvdaControllerListResult
 	err = s.rpc.Call(ctx, "controller_list", nil, &result)
 	if err != nil {
@@ -246,24 +368,311 @@ func (s *Server) GetNvmeController(ctx context.Context, in *pb.GetNvmeController
 	log.Printf("Received from SPDK: %v", result)
 	for i := range result {
 		r := &result[i]
-		if r.Cntlid == int(*controller.Spec.NvmeControllerId) && r.Type == "nvme" {
-			return &pb.NvmeController{
-				Spec: &pb.NvmeControllerSpec{
-					NvmeControllerId: proto.Int32(int32(r.Cntlid)),
-				},
-				Status: &pb.NvmeControllerStatus{Active: true}}, nil
+		if r.Subnqn == subsys.Spec.Nqn && r.Cntlid == int(*controller.Spec.NvmeControllerId) && r.Type == "nvme" {
+			// the endpoint is the function SNAP emulates the controller on
+			controller.Spec.Endpoint = &pb.NvmeControllerSpec_PcieId{PcieId: s.pciEndpoint(r)}
+			reportPciBdf(ctx, r.PciBdf)
+			controller.Status = &pb.NvmeControllerStatus{Active: true}
+			return controller, nil
 		}
 	}
-	msg := fmt.Sprintf("Could not find NvmeControllerId: %d", *controller.Spec.NvmeControllerId)
-	return nil, status.Errorf(codes.InvalidArgument, msg)
+	// not emulated by SNAP, the controller is reported as it was requested
+	controller.Status = &pb.NvmeControllerStatus{Active: false}
+	return controller, nil
 }
 
 // StatsNvmeController gets an Nvme controller stats
-func (s *Server) StatsNvmeController(_ context.Context, in *pb.StatsNvmeControllerRequest) (*pb.StatsNvmeControllerResponse, error) {
+func (s *Server) StatsNvmeController(ctx context.Context, in *pb.StatsNvmeControllerRequest) (*pb.StatsNvmeControllerResponse, error) {
 	// check input correctness
 	if err := s.validateStatsNvmeControllerRequest(in); err != nil {
 		return nil, err
 	}
 	// fetch object from the database
-	return nil, status.Errorf(codes.Unimplemented, "StatsNvmeController method is not implemented")
+	controller := new(pb.NvmeController)
+	found, err := s.store.Get(in.Name, controller)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
+		return nil, err
+	}
+	if controller.Spec.GetFabricsId() != nil {
+		msg := fmt.Sprintf("Could not get stats of CTRL: %s, stats of fabrics controllers are not supported", controller.Name)
+		return nil, status.Errorf(codes.Unimplemented, msg)
+	}
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(in.Name),
+	)
+	subsys := new(pb.NvmeSubsystem)
+	found, err = s.store.Get(subsysName, subsys)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+		return nil, err
+	}
+	var result []models.NvdaControllerListResult
+	err = s.rpc.Call(ctx, "controller_list", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	for i := range result {
+		r := &result[i]
+		if r.Subnqn == subsys.Spec.Nqn && r.Cntlid == int(*controller.Spec.NvmeControllerId) && r.Type == "nvme" {
+			stats, _, err := s.nvmeControllersStats(ctx, map[string]bool{r.Name: true})
+			if err != nil {
+				return nil, err
+			}
+			return &pb.StatsNvmeControllerResponse{Stats: stats}, nil
+		}
+	}
+	msg := fmt.Sprintf("Could not find NvmeControllerId: %d", *controller.Spec.NvmeControllerId)
+	return nil, status.Errorf(codes.InvalidArgument, msg)
+}
+
+// nvmeControllerNeedsRecreate reports whether the difference between two specs
+// can only be applied by deleting and recreating the SNAP emulation, since SNAP
+// does not support changing the endpoint or queue layout of a live controller
+func nvmeControllerNeedsRecreate(current, desired *pb.NvmeControllerSpec) bool {
+	return !proto.Equal(current.GetPcieId(), desired.GetPcieId()) ||
+		current.MaxNsq != desired.MaxNsq ||
+		current.MaxNcq != desired.MaxNcq ||
+		current.Sqes != desired.Sqes ||
+		current.Cqes != desired.Cqes ||
+		current.MaxNamespaces != desired.MaxNamespaces
+}
+
+// recreateNvmeController replaces the SNAP emulation of controller with the one
+// described by desired and returns the spec of the new emulation. The controller
+// has to be idle, namespaces attached to it would be silently lost otherwise.
+// If the new emulation can not be created, the original one is restored.
+func (s *Server) recreateNvmeController(ctx context.Context, controller *pb.NvmeController, desired *pb.NvmeController) (_ *pb.NvmeControllerSpec, err error) {
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(controller.Name),
+	)
+	subsys := new(pb.NvmeSubsystem)
+	found, err := s.store.Get(subsysName, subsys)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+		return nil, err
+	}
+	params := models.NvdaControllerNvmeNamespaceListParams{
+		Subnqn: subsys.Spec.Nqn,
+		Cntlid: int(*controller.Spec.NvmeControllerId),
+	}
+	var result models.NvdaControllerNvmeNamespaceListResult
+	err = s.rpc.Call(ctx, "controller_nvme_namespace_list", &params, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if len(result.Namespaces) != 0 {
+		msg := fmt.Sprintf("Could not update CTRL: %s, it has %d namespaces attached", controller.Name, len(result.Namespaces))
+		return nil, status.Errorf(codes.FailedPrecondition, msg)
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.deleteNvmeControllerEmulation(ctx, subsys.Spec.Nqn, int(*controller.Spec.NvmeControllerId))
+	if err != nil {
+		return nil, err
+	}
+	// the original emulation may come back with another cntlid, which the
+	// stored controller has to follow
+	undo.add("deletion of CTRL "+controller.Name, func(ctx context.Context) error {
+		spec, err := s.createNvmeControllerEmulation(ctx, subsys, controller)
+		if err != nil {
+			return err
+		}
+		if spec.GetNvmeControllerId() == controller.Spec.GetNvmeControllerId() {
+			return nil
+		}
+		restored := utils.ProtoClone(controller)
+		restored.Spec = spec
+		return s.store.Set(controller.Name, restored)
+	})
+	return s.createNvmeControllerEmulation(ctx, subsys, desired)
+}
+
+// relistenNvmeFabricsController moves the NVMe-oF listener of controller to
+// the address of desired. The new listener is added before the old one is
+// removed, so that the subsystem stays reachable.
+func (s *Server) relistenNvmeFabricsController(ctx context.Context, controller *pb.NvmeController, desired *pb.NvmeController) error {
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(controller.Name),
+	)
+	subsys := new(pb.NvmeSubsystem)
+	found, err := s.store.Get(subsysName, subsys)
+	if err != nil {
+		return err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+		return err
+	}
+	err = s.addNvmeListener(ctx, subsys, desired)
+	if err != nil {
+		return err
+	}
+	err = s.removeNvmeListener(ctx, subsys, controller)
+	if err != nil {
+		if derr := s.removeNvmeListener(detachedContext{ctx}, subsys, desired); derr != nil {
+			log.Printf("Could not remove listener of %s: %v", desired.Name, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// createNvmeControllerEmulation creates SNAP emulation for controller under
+// subsys and returns the spec of the emulation, which is the controller spec
+// with the assigned cntlid. The queue and namespace limits are passed to SNAP
+// as requested, they are not checked against the capabilities of the device,
+// which SNAP does not report.
+func (s *Server) createNvmeControllerEmulation(ctx context.Context, subsys *pb.NvmeSubsystem, controller *pb.NvmeController) (*pb.NvmeControllerSpec, error) {
+	if err := s.validateNvmeControllerLimits(subsys, controller); err != nil {
+		return nil, err
+	}
+	endpoint := controller.GetSpec().GetPcieId()
+	manager, err := s.emulationManager(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	err = s.validateVirtualFunction(ctx, manager, "nvme", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	params := models.NvdaControllerNvmeCreateParams{
+		Nqn:              subsys.Spec.Nqn,
+		EmulationManager: manager,
+		PfID:             int(endpoint.GetPhysicalFunction().GetValue()),
+		VfID:             snapVfID(endpoint),
+		MaxNamespaces:    int(controller.Spec.MaxNamespaces),
+		NrIoQueues:       int(nvmeControllerIoQueues(controller.Spec)),
+	}
+	var result models.NvdaControllerNvmeCreateResult
+	err = s.rpc.Call(ctx, "controller_nvme_create", &params, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if result.Cntlid < 0 {
+		msg := fmt.Sprintf("Could not create CTRL: %s", controller.Name)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	spec := utils.ProtoClone(controller.Spec)
+	spec.NvmeControllerId = proto.Int32(int32(result.Cntlid))
+	// SNAP creates as many submission as completion queues
+	if params.NrIoQueues > 0 {
+		spec.MaxNsq = int32(params.NrIoQueues)
+		spec.MaxNcq = int32(params.NrIoQueues)
+	}
+	return spec, nil
+}
+
+// nvmeControllerIoQueues returns the number of I/O queue pairs requested by
+// spec, SNAP creates submission and completion queues in pairs
+func nvmeControllerIoQueues(spec *pb.NvmeControllerSpec) int32 {
+	if spec.MaxNcq > 0 {
+		return spec.MaxNcq
+	}
+	return spec.MaxNsq
+}
+
+// deleteNvmeControllerEmulation deletes SNAP emulation of controller cntlid
+// under subsystem nqn
+func (s *Server) deleteNvmeControllerEmulation(ctx context.Context, nqn string, cntlid int) error {
+	params := models.NvdaControllerNvmeDeleteParams{
+		Subnqn: nqn,
+		Cntlid: cntlid,
+	}
+	var result models.NvdaControllerNvmeDeleteResult
+	err := s.rpc.Call(ctx, "controller_nvme_delete", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete NQN:ID %s:%d", nqn, cntlid)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// storedNvmeControllers returns the stored controllers of subsys
+func (s *Server) storedNvmeControllers(subsys *pb.NvmeSubsystem) ([]*pb.NvmeController, error) {
+	names, err := s.listIndex(nvmeControllerIndex)
+	if err != nil {
+		return nil, err
+	}
+	subsysID := utils.GetSubsystemIDFromNvmeName(subsys.Name)
+	controllers := []*pb.NvmeController{}
+	for _, name := range names {
+		if utils.GetSubsystemIDFromNvmeName(name) != subsysID {
+			continue
+		}
+		controller := new(pb.NvmeController)
+		found, err := s.store.Get(name, controller)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers, nil
+}
+
+// nvmeSubsystemControllers returns the active SNAP controllers of subsys
+// sorted by cntlid
+func (s *Server) nvmeSubsystemControllers(subsys *pb.NvmeSubsystem) ([]*pb.NvmeController, error) {
+	stored, err := s.storedNvmeControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	controllers := []*pb.NvmeController{}
+	for _, controller := range stored {
+		if controller.Spec.GetPcieId() == nil || controller.Spec.GetNvmeControllerId() < 0 {
+			continue
+		}
+		// stale controllers do not exist on the device
+		if controller.Status != nil && !controller.Status.Active {
+			continue
+		}
+		controllers = append(controllers, controller)
+	}
+	sortNvmeControllers(controllers)
+	return controllers, nil
+}
+
+// nvmeControllersStats sums I/O counters of every namespace of the SNAP
+// controllers listed in names and returns the controllers that contributed.
+// The counters VolumeStats has no field for are sent in response headers.
+func (s *Server) nvmeControllersStats(ctx context.Context, names map[string]bool) (*pb.VolumeStats, []string, error) {
+	var result models.NvdaControllerNvmeStatsResult
+	err := s.rpc.Call(ctx, "controller_nvme_get_iostat", nil, &result)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	stats := &pb.VolumeStats{}
+	counters := &volumeCounters{}
+	contributors := []string{}
+	for _, c := range result.Controllers {
+		if !names[c.Name] {
+			continue
+		}
+		contributors = append(contributors, c.Name)
+		for i := range c.Bdevs {
+			addVolumeStats(stats, &c.Bdevs[i])
+			counters.add(&c.Bdevs[i])
+		}
+	}
+	counters.report(ctx)
+	return stats, contributors, nil
 }
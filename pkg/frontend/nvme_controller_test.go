@@ -10,12 +10,16 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
@@ -32,8 +36,15 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 		Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
 		NvmeControllerId: proto.Int32(17),
 	}
+	limitedSubsystem := &pb.NvmeSubsystem{
+		Name: utils.ResourceIDToSubsystemName("limited-subsystem"),
+		Spec: &pb.NvmeSubsystemSpec{
+			Nqn:           "nqn.2022-09.io.spdk:opi4",
+			MaxNamespaces: 2,
+		},
+	}
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
-	t.Cleanup(utils.CheckTestProtoObjectsNotChanged(spec, controllerSpec)(t, t.Name()))
+	t.Cleanup(utils.CheckTestProtoObjectsNotChanged(spec, controllerSpec, limitedSubsystem)(t, t.Name()))
 
 	tests := map[string]struct {
 		id      string
@@ -44,6 +55,7 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 		errMsg  string
 		exist   bool
 		subsys  string
+		attach  bool
 	}{
 		"illegal resource_id": {
 			id: "CapitalLettersNotAllowed",
@@ -67,19 +79,139 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 				Spec: spec,
 			},
 			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": -1}}`},
+			spdk:    []string{testEmulationFunctions, `{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": -1}}`},
 			errCode: codes.InvalidArgument,
 			errMsg:  fmt.Sprintf("Could not create CTRL: %v", testControllerName),
 			exist:   false,
 			subsys:  testSubsystemName,
 		},
+		"port without emulation manager": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint: &pb.NvmeControllerSpec_PcieId{
+						PcieId: &pb.PciEndpoint{
+							PhysicalFunction: wrapperspb.Int32(1),
+							VirtualFunction:  wrapperspb.Int32(2),
+							PortId:           wrapperspb.Int32(1),
+						},
+					},
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("No emulation manager configured for port %d", 1),
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
+		"queue limits": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:      testController.Spec.Endpoint,
+					Trtype:        pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq:        64,
+					MaxNamespaces: 8,
+				},
+			},
+			out: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:         testController.Spec.Endpoint,
+					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					NvmeControllerId: proto.Int32(17),
+					MaxNsq:           64,
+					MaxNcq:           64,
+					MaxNamespaces:    8,
+				},
+				Status: &pb.NvmeControllerStatus{
+					Active: true,
+				},
+			},
+			spdk:    []string{testEmulationFunctions, `{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
+		"different number of submission and completion queues": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint: testController.Spec.Endpoint,
+					Trtype:   pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNsq:   16,
+					MaxNcq:   8,
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("MaxNsq value (%d) has to be equal to MaxNcq value (%d), SNAP creates I/O queues in pairs", 16, 8),
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
+		"too many queues": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint: testController.Spec.Endpoint,
+					Trtype:   pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq:   65536,
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("MaxNcq value (%d) is out of range, have to be between 0 and %d", 65536, 65535),
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
+		"namespaces above subsystem limit": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:      testController.Spec.Endpoint,
+					Trtype:        pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNamespaces: 4,
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("MaxNamespaces value (%d) exceeds the limit of subsystem %s (%d)", 4, limitedSubsystem.Name, 2),
+			exist:   false,
+			subsys:  limitedSubsystem.Name,
+		},
+		"physical function without nvme emulation": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint: &pb.NvmeControllerSpec_PcieId{
+						PcieId: &pb.PciEndpoint{
+							PhysicalFunction: wrapperspb.Int32(42),
+							VirtualFunction:  wrapperspb.Int32(1),
+							PortId:           wrapperspb.Int32(0),
+						},
+					},
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+				},
+			},
+			out:     nil,
+			spdk:    []string{testEmulationFunctions},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not find nvme physical function %d on %s", 42, "mlx5_0"),
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
 		"valid request with empty SPDK response": {
 			id: testControllerID,
 			in: &pb.NvmeController{
 				Spec: spec,
 			},
 			out:     nil,
-			spdk:    []string{""},
+			spdk:    []string{testEmulationFunctions, ""},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_create: %v", "EOF"),
 			exist:   false,
@@ -91,7 +223,7 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 				Spec: spec,
 			},
 			out:     nil,
-			spdk:    []string{`{"id":0,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`},
+			spdk:    []string{testEmulationFunctions, `{"id":0,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_create: %v", "json response ID mismatch"),
 			exist:   false,
@@ -103,7 +235,7 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 				Spec: spec,
 			},
 			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":-32602,"message":"Invalid parameters"}}`},
+			spdk:    []string{testEmulationFunctions, `{"id":%d,"error":{"code":-32602,"message":"Invalid parameters"}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_create: %v", "json response error: Invalid parameters"),
 			exist:   false,
@@ -125,11 +257,54 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 					Active: true,
 				},
 			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`},
+			spdk:    []string{testEmulationFunctions, `{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
+		"existing namespaces are attached to the new controller": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: controllerSpec,
+			},
+			out: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:         testController.Spec.Endpoint,
+					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					NvmeControllerId: proto.Int32(17),
+				},
+				Status: &pb.NvmeControllerStatus{
+					Active: true,
+				},
+			},
+			spdk: []string{testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
 			errCode: codes.OK,
 			errMsg:  "",
 			exist:   false,
 			subsys:  testSubsystemName,
+			attach:  true,
+		},
+		"failed namespace attach deletes the new controller": {
+			id: testControllerID,
+			in: &pb.NvmeController{
+				Spec: controllerSpec,
+			},
+			out: nil,
+			spdk: []string{testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf0", "cntlid": 17}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create NS: %v", testNamespaceName),
+			exist:   false,
+			subsys:  testSubsystemName,
+			attach:  true,
 		},
 		"already exists": {
 			id: testControllerID,
@@ -196,14 +371,14 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 							Adrfam:  pb.NvmeAddressFamily_NVME_ADDRESS_FAMILY_IPV4,
 						},
 					},
-					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP,
+					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_FC,
 					NvmeControllerId: proto.Int32(1),
 				},
 			},
 			out:     nil,
 			spdk:    []string{},
 			errCode: codes.Unknown,
-			errMsg:  fmt.Sprintf("not supported transport type: %v", pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP),
+			errMsg:  fmt.Sprintf("not supported transport type: %v", pb.NvmeTransportType_NVME_TRANSPORT_TYPE_FC),
 			exist:   false,
 			subsys:  testSubsystemName,
 		},
@@ -238,7 +413,11 @@ func TestFrontEnd_CreateNvmeController(t *testing.T) {
 			defer testEnv.Close()
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
+			_ = testEnv.opiSpdkServer.store.Set(limitedSubsystem.Name, limitedSubsystem)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			if tt.attach {
+				_ = testEnv.opiSpdkServer.addToIndex(nvmeNamespaceIndex, testNamespaceName)
+			}
 			if tt.exist {
 				_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			}
@@ -392,6 +571,9 @@ func TestFrontEnd_UpdateNvmeController(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		missing bool
+		// stored is the controller expected in the store afterwards
+		stored *pb.NvmeController
 	}{
 		"invalid fieldmask": {
 			mask: &fieldmaskpb.FieldMask{Paths: []string{"*", "author"}},
@@ -404,16 +586,139 @@ func TestFrontEnd_UpdateNvmeController(t *testing.T) {
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("invalid field path: %s", "'*' must not be used with other paths"),
 		},
-		"unimplemented method": {
+		"valid request without changes": {
 			mask: nil,
 			in: &pb.NvmeController{
 				Name: testControllerName,
 				Spec: testController.Spec,
 			},
+			out:     &testControllerWithStatus,
+			spdk:    []string{},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with recreate": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_ncq", "spec.max_namespaces"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype:        pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq:        8,
+					MaxNamespaces: 4,
+				},
+			},
+			out: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:         testController.Spec.Endpoint,
+					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					NvmeControllerId: proto.Int32(18),
+					MaxNsq:           8,
+					MaxNcq:           8,
+					MaxNamespaces:    4,
+				},
+				Status: &pb.NvmeControllerStatus{
+					Active: true,
+				},
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"","cntlid":17,"Namespaces":null}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf1", "cntlid": 18}}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"recreate with attached namespaces": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_ncq"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq: 8,
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf1", "cntlid": 17, "Namespaces": [{"nsid": 22, "bdev": "Malloc1", "bdev_type": "spdk", "qn": "", "protocol": ""}]}}`,
+			},
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Could not update CTRL: %v, it has %d namespaces attached", testControllerName, 1),
+		},
+		"recreate with invalid SPDK response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_ncq"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq: 8,
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"","cntlid":17,"Namespaces":null}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not delete NQN:ID %v", "nqn.2022-09.io.spdk:opi3:17"),
+		},
+		"recreate with failed create restores the original": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_ncq"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxNcq: 8,
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"","cntlid":17,"Namespaces":null}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "", "cntlid": -1}}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf1", "cntlid": 19}}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create CTRL: %v", testControllerName),
+			stored: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:         testController.Spec.Endpoint,
+					Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					NvmeControllerId: proto.Int32(19),
+				},
+				Status: testControllerWithStatus.Status,
+			},
+		},
+		"qos limits change": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_limit"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype:   pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					MaxLimit: &pb.QosLimit{RdIopsKiops: 1},
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not update CTRL: %v, QoS limits are not supported by SNAP emulation", testControllerName),
+		},
+		"not supported transport type": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.trtype"}},
+			in: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_FC,
+				},
+			},
 			out:     nil,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "UpdateNvmeController"),
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("not supported transport type: %v", pb.NvmeTransportType_NVME_TRANSPORT_TYPE_FC),
 		},
 		"valid request with unknown key": {
 			mask: nil,
@@ -426,6 +731,22 @@ func TestFrontEnd_UpdateNvmeController(t *testing.T) {
 			errCode: codes.NotFound,
 			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToControllerName(testSubsystemID, "unknown-controller-id")),
 		},
+		"unknown key with missing allowed": {
+			mask: nil,
+			in: &pb.NvmeController{
+				Name: utils.ResourceIDToControllerName(testSubsystemID, "new-controller-id"),
+				Spec: testController.Spec,
+			},
+			out: &pb.NvmeController{
+				Name:   utils.ResourceIDToControllerName(testSubsystemID, "new-controller-id"),
+				Spec:   testController.Spec,
+				Status: &pb.NvmeControllerStatus{Active: true},
+			},
+			spdk:    []string{testEmulationFunctions, `{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf1", "cntlid": 17}}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			missing: true,
+		},
 		"malformed name": {
 			mask: nil,
 			in: &pb.NvmeController{
@@ -449,7 +770,7 @@ func TestFrontEnd_UpdateNvmeController(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
-			request := &pb.UpdateNvmeControllerRequest{NvmeController: tt.in, UpdateMask: tt.mask}
+			request := &pb.UpdateNvmeControllerRequest{NvmeController: tt.in, UpdateMask: tt.mask, AllowMissing: tt.missing}
 			response, err := testEnv.client.UpdateNvmeController(testEnv.ctx, request)
 
 			if !proto.Equal(response, tt.out) {
@@ -466,12 +787,39 @@ func TestFrontEnd_UpdateNvmeController(t *testing.T) {
 			} else {
 				t.Error("expected grpc error status")
 			}
+
+			if tt.stored != nil {
+				stored := new(pb.NvmeController)
+				_, _ = testEnv.opiSpdkServer.store.Get(testControllerName, stored)
+				if !proto.Equal(stored, tt.stored) {
+					t.Error("stored: expected", tt.stored, "received", stored)
+				}
+			}
 		})
 	}
 }
 
 func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	existingToken := encodePageToken(testSubsystemName+"/nvmeControllers", 1, time.Now())
+	stored := make([]*pb.NvmeController, 3)
+	for i := range stored {
+		stored[i] = utils.ProtoClone(&testControllerWithStatus)
+		stored[i].Name = utils.ResourceIDToControllerName(testSubsystemID, fmt.Sprintf("controller-%d", i+1))
+		stored[i].Spec.NvmeControllerId = proto.Int32(int32(i + 1))
+	}
+	other := utils.ProtoClone(&testControllerWithStatus)
+	other.Name = utils.ResourceIDToControllerName("other-subsystem", "controller-1")
+	other.Spec.NvmeControllerId = proto.Int32(1)
+	inactive := func(controllers ...*pb.NvmeController) []*pb.NvmeController {
+		result := make([]*pb.NvmeController, len(controllers))
+		for i, controller := range controllers {
+			result[i] = utils.ProtoClone(controller)
+			result[i].Status.Active = false
+		}
+		return result
+	}
+	controllerList := `{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi4", "cntlid": 1, "name": "NvmeEmu0pf4", "type": "nvme", "pci_index": 4, "pci_bdf": "ca:00.6"},{"subnqn": "", "cntlid": 0, "name": "VblkEmu0pf42", "type": "virtio_blk", "pci_index": 42, "pci_bdf": "ca:01.2"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf2", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf3", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`
 	tests := map[string]struct {
 		in      string
 		out     []*pb.NvmeController
@@ -480,10 +828,12 @@ func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 		errMsg  string
 		size    int32
 		token   string
+		next    bool
+		fabrics bool
 	}{
 		"valid request with empty result SPDK response": {
 			in:      testSubsystemName,
-			out:     nil,
+			out:     inactive(stored...),
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
 			errCode: codes.OK,
 			errMsg:  "",
@@ -536,84 +886,61 @@ func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 			token:   "unknown-pagination-token",
 		},
 		"pagination": {
-			in: testSubsystemName,
-			out: []*pb.NvmeController{
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(1),
-					},
-				},
-			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			in:      testSubsystemName,
+			out:     stored[:1],
+			spdk:    []string{controllerList},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
 			token:   "",
+			next:    true,
 		},
 		"pagination overflow": {
-			in: testSubsystemName,
-			out: []*pb.NvmeController{
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(1),
-					},
-				},
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(2),
-					},
-				},
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(3),
-					},
-				},
-			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			in:      testSubsystemName,
+			out:     stored,
+			spdk:    []string{controllerList},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1000,
 			token:   "",
 		},
 		"pagination offset": {
-			in: testSubsystemName,
-			out: []*pb.NvmeController{
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(2),
-					},
-				},
-			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			in:      testSubsystemName,
+			out:     stored[1:2],
+			spdk:    []string{controllerList},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
-			token:   "existing-pagination-token",
+			token:   existingToken,
+			next:    true,
+		},
+		"pagination last page": {
+			in:      testSubsystemName,
+			out:     stored[1:],
+			spdk:    []string{controllerList},
+			errCode: codes.OK,
+			errMsg:  "",
+			size:    2,
+			token:   existingToken,
 		},
 		"valid request with valid SPDK response": {
-			in: testSubsystemName,
-			out: []*pb.NvmeController{
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(1),
-					},
-				},
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(2),
-					},
-				},
-				{
-					Spec: &pb.NvmeControllerSpec{
-						NvmeControllerId: proto.Int32(3),
-					},
-				},
-			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			in:      testSubsystemName,
+			out:     stored,
+			spdk:    []string{controllerList},
+			errCode: codes.OK,
+			errMsg:  "",
+			size:    0,
+			token:   "",
+		},
+		"fabrics controllers are listed": {
+			in:      testSubsystemName,
+			out:     append([]*pb.NvmeController{&testFabricsController}, stored...),
+			spdk:    []string{controllerList},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    0,
 			token:   "",
+			fabrics: true,
 		},
 		"valid request with unknown key": {
 			in:      utils.ResourceIDToControllerName(testSubsystemID, "unknown-controller-id"),
@@ -642,9 +969,15 @@ func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 			defer testEnv.Close()
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
-			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			for _, controller := range append(stored, other) {
+				_ = testEnv.opiSpdkServer.store.Set(controller.Name, controller)
+				_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, controller.Name)
+			}
+			if tt.fabrics {
+				_ = testEnv.opiSpdkServer.store.Set(testFabricsControllerName, &testFabricsController)
+				_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testFabricsControllerName)
+			}
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
-			testEnv.opiSpdkServer.Pagination["existing-pagination-token"] = 1
 
 			request := &pb.ListNvmeControllersRequest{Parent: tt.in, PageSize: tt.size, PageToken: tt.token}
 			response, err := testEnv.client.ListNvmeControllers(testEnv.ctx, request)
@@ -654,8 +987,8 @@ func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 			}
 
 			// Empty NextPageToken indicates end of results list
-			if tt.size != 1 && response.GetNextPageToken() != "" {
-				t.Error("Expected end of results, received non-empty next page token", response.GetNextPageToken())
+			if tt.next != (response.GetNextPageToken() != "") {
+				t.Error("next page token: expected", tt.next, "received", response.GetNextPageToken())
 			}
 
 			if er, ok := status.FromError(err); ok {
@@ -672,6 +1005,44 @@ func TestFrontEnd_ListNvmeControllers(t *testing.T) {
 	}
 }
 
+func TestFrontEnd_ListNvmeControllersPages(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	empty := `{"id":%d,"error":{"code":0,"message":""},"result":[]}`
+	testEnv := createTestEnvironment([]string{empty, empty, empty})
+	defer testEnv.Close()
+
+	_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
+	expected := []string{}
+	for i := 3; i > 0; i-- {
+		controller := utils.ProtoClone(&testControllerWithStatus)
+		controller.Name = utils.ResourceIDToControllerName(testSubsystemID, fmt.Sprintf("controller-%d", i))
+		controller.Spec.NvmeControllerId = proto.Int32(int32(i))
+		_ = testEnv.opiSpdkServer.store.Set(controller.Name, controller)
+		_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, controller.Name)
+		expected = append([]string{controller.Name}, expected...)
+	}
+
+	received := []string{}
+	token := ""
+	for {
+		request := &pb.ListNvmeControllersRequest{Parent: testSubsystemName, PageSize: 1, PageToken: token}
+		response, err := testEnv.client.ListNvmeControllers(testEnv.ctx, request)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		for _, controller := range response.NvmeControllers {
+			received = append(received, controller.Name)
+		}
+		token = response.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Error("pages: expected", expected, "received", received)
+	}
+}
+
 func TestFrontEnd_GetNvmeController(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
 	tests := map[string]struct {
@@ -680,13 +1051,18 @@ func TestFrontEnd_GetNvmeController(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		pciBdf  []string
 	}{
-		"valid request with invalid SPDK response": {
-			in:      testControllerName,
-			out:     nil,
+		"valid request with controller missing from SPDK response": {
+			in: testControllerName,
+			out: &pb.NvmeController{
+				Name:   testControllerName,
+				Spec:   testControllerWithStatus.Spec,
+				Status: &pb.NvmeControllerStatus{Active: false},
+			},
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
-			errCode: codes.InvalidArgument,
-			errMsg:  fmt.Sprintf("Could not find NvmeControllerId: %v", "17"),
+			errCode: codes.OK,
+			errMsg:  "",
 		},
 		"valid request with empty SPDK response": {
 			in:      testControllerName,
@@ -710,16 +1086,29 @@ func TestFrontEnd_GetNvmeController(t *testing.T) {
 			errMsg:  fmt.Sprintf("controller_list: %v", "json response error: myopierr"),
 		},
 		"valid request with valid SPDK response": {
+			in:      testControllerName,
+			out:     &testControllerWithStatus,
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "vf_index": 1, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			pciBdf:  []string{"ca:00.4"},
+		},
+		"valid request with controller id reused by another subsystem": {
+			in:      testControllerName,
+			out:     &testControllerWithStatus,
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi4", "cntlid": 17, "name": "NvmeEmu0pf3", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "vf_index": 1, "pci_bdf": "ca:00.4"}]}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			pciBdf:  []string{"ca:00.4"},
+		},
+		"valid request with controller id only in another subsystem": {
 			in: testControllerName,
 			out: &pb.NvmeController{
-				Spec: &pb.NvmeControllerSpec{
-					NvmeControllerId: proto.Int32(17),
-				},
-				Status: &pb.NvmeControllerStatus{
-					Active: true,
-				},
+				Name:   testControllerName,
+				Spec:   testControllerWithStatus.Spec,
+				Status: &pb.NvmeControllerStatus{Active: false},
 			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 3, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi4", "cntlid": 17, "name": "NvmeEmu0pf3", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`},
 			errCode: codes.OK,
 			errMsg:  "",
 		},
@@ -756,12 +1145,16 @@ func TestFrontEnd_GetNvmeController(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
+			var header metadata.MD
 			request := &pb.GetNvmeControllerRequest{Name: tt.in}
-			response, err := testEnv.client.GetNvmeController(testEnv.ctx, request)
+			response, err := testEnv.client.GetNvmeController(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response, tt.out) {
 				t.Error("response: expected", tt.out, "received", response)
 			}
+			if pciBdf := header.Get(PciBdfHeader); !reflect.DeepEqual(pciBdf, tt.pciBdf) {
+				t.Error("PCI address: expected", tt.pciBdf, "received", pciBdf)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -785,13 +1178,46 @@ func TestFrontEnd_StatsNvmeController(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		// counters are the expected counters without VolumeStats field
+		counters []string
 	}{
-		"unimplemented method": {
+		"valid request with valid SPDK response": {
+			in: testControllerName,
+			out: &pb.StatsNvmeControllerResponse{Stats: &pb.VolumeStats{
+				ReadOpsCount:  12400,
+				WriteOpsCount: 54354,
+			}},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf2", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"}]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc0","read_ios":1,"completed_read_ios":1,"write_ios":1,"completed_write_ios":1,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]},{"name":"NvmeEmu0pf2","bdevs":[{"bdev_name":"Malloc0","read_ios":55,"completed_read_ios":55,"write_ios":33,"completed_write_ios":33,"flush_ios":7,"completed_flush_ios":7,"err_read_ios":1,"err_write_ios":2,"err_flush_ios":0,"queue_depth":4},{"bdev_name":"Malloc1","read_ios":12345,"completed_read_ios":12345,"write_ios":54321,"completed_write_ios":54321,"flush_ios":5000000000,"completed_flush_ios":5000000000,"err_read_ios":0,"err_write_ios":3,"err_flush_ios":1,"queue_depth":2}]}]}}`,
+			},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"5000000007", "1", "5", "1", "6"},
+		},
+		"valid request with unknown controller in SPDK response": {
 			in:      testControllerName,
 			out:     nil,
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 1, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"}]}`},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not find NvmeControllerId: %d", 17),
+		},
+		"valid request with error code from SPDK iostat response": {
+			in:  testControllerName,
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf2", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"}]}`,
+				`{"id":%d,"error":{"code":1,"message":"myopierr"}}`,
+			},
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "json response error: myopierr"),
+		},
+		"valid request with unknown key": {
+			in:      utils.ResourceIDToControllerName(testSubsystemID, "unknown-controller-id"),
+			out:     nil,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "StatsNvmeController"),
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToControllerName(testSubsystemID, "unknown-controller-id")),
 		},
 		"malformed name": {
 			in:      "-ABC-DEF",
@@ -813,11 +1239,15 @@ func TestFrontEnd_StatsNvmeController(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
 			request := &pb.StatsNvmeControllerRequest{Name: tt.in}
-			response, err := testEnv.client.StatsNvmeController(testEnv.ctx, request)
+			var header metadata.MD
+			response, err := testEnv.client.StatsNvmeController(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response, tt.out) {
 				t.Error("response: expected", tt.out, "received", response)
 			}
+			if counters := volumeCountersHeader(header); !reflect.DeepEqual(counters, tt.counters) {
+				t.Error("counters: expected", tt.counters, "received", counters)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -13,6 +13,9 @@ import (
 	"go.einride.tech/aip/resourcename"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (s *Server) validateCreateNvmeControllerRequest(in *pb.CreateNvmeControllerRequest) error {
@@ -27,12 +30,8 @@ func (s *Server) validateCreateNvmeControllerRequest(in *pb.CreateNvmeController
 		}
 	}
 
-	if in.NvmeController.Spec.Trtype != pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE {
-		return fmt.Errorf("not supported transport type: %v", in.NvmeController.Spec.Trtype)
-	}
-
-	if in.NvmeController.Spec.GetPcieId() == nil {
-		return errors.New("invalid endpoint type passed for transport")
+	if err := s.validateNvmeControllerSpec(in.NvmeController.Spec); err != nil {
+		return err
 	}
 
 	// Validate that a resource name conforms to the restrictions outlined in AIP-122.
@@ -74,3 +73,65 @@ func (s *Server) validateStatsNvmeControllerRequest(in *pb.StatsNvmeControllerRe
 	// Validate that a resource name conforms to the restrictions outlined in AIP-122.
 	return resourcename.Validate(in.Name)
 }
+
+// limits of the NVMe specification, the number of I/O queues is reported to the
+// host as a 16-bit 0's based value and only 64 byte submission and 16 byte
+// completion queue entries are defined
+const (
+	maxNvmeIoQueues = 65535
+	nvmeSqes        = 6
+	nvmeCqes        = 4
+)
+
+func (s *Server) validateNvmeControllerSpec(spec *pb.NvmeControllerSpec) error {
+	switch spec.Trtype {
+	case pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE:
+		if spec.GetPcieId() == nil {
+			return errors.New("invalid endpoint type passed for transport")
+		}
+	case pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP,
+		pb.NvmeTransportType_NVME_TRANSPORT_TYPE_RDMA:
+		if spec.GetFabricsId() == nil {
+			return errors.New("invalid endpoint type passed for transport")
+		}
+	default:
+		return fmt.Errorf("not supported transport type: %v", spec.Trtype)
+	}
+
+	// check queue and namespace limits
+	if spec.MaxNsq < 0 || spec.MaxNsq > maxNvmeIoQueues {
+		msg := fmt.Sprintf("MaxNsq value (%d) is out of range, have to be between 0 and %d", spec.MaxNsq, maxNvmeIoQueues)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.MaxNcq < 0 || spec.MaxNcq > maxNvmeIoQueues {
+		msg := fmt.Sprintf("MaxNcq value (%d) is out of range, have to be between 0 and %d", spec.MaxNcq, maxNvmeIoQueues)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.MaxNsq != 0 && spec.MaxNcq != 0 && spec.MaxNsq != spec.MaxNcq {
+		msg := fmt.Sprintf("MaxNsq value (%d) has to be equal to MaxNcq value (%d), SNAP creates I/O queues in pairs", spec.MaxNsq, spec.MaxNcq)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.MaxNamespaces < 0 {
+		msg := fmt.Sprintf("MaxNamespaces value (%d) has to be positive", spec.MaxNamespaces)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.Sqes != 0 && spec.Sqes != nvmeSqes {
+		msg := fmt.Sprintf("Sqes value (%d) is not supported, only %d is", spec.Sqes, nvmeSqes)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.Cqes != 0 && spec.Cqes != nvmeCqes {
+		msg := fmt.Sprintf("Cqes value (%d) is not supported, only %d is", spec.Cqes, nvmeCqes)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+
+	return nil
+}
+
+// validateNvmeControllerLimits checks controller limits against its subsystem
+func (s *Server) validateNvmeControllerLimits(subsys *pb.NvmeSubsystem, controller *pb.NvmeController) error {
+	if subsys.Spec.MaxNamespaces > 0 && int64(controller.Spec.MaxNamespaces) > subsys.Spec.MaxNamespaces {
+		msg := fmt.Sprintf("MaxNamespaces value (%d) exceeds the limit of subsystem %s (%d)", controller.Spec.MaxNamespaces, subsys.Name, subsys.Spec.MaxNamespaces)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
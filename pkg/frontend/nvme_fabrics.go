@@ -0,0 +1,282 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/opiproject/gospdk/spdk"
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Controllers with FabricsId endpoints are not SNAP emulations, they are
+// listeners of an SPDK NVMe-oF subsystem with the same NQN as the SNAP one.
+// The NVMe-oF subsystem is created with the first listener of a subsystem,
+// holds every namespace of the subsystem and is deleted with the last one.
+// Its serial number, model number and namespace limit are the ones of the
+// subsystem when it is created, UpdateNvmeSubsystem refuses to change them
+// while it exists.
+
+// nvmeFabricsTrtype returns the SPDK name of NVMe-oF transport trtype
+func nvmeFabricsTrtype(trtype pb.NvmeTransportType) string {
+	switch trtype {
+	case pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP:
+		return "tcp"
+	case pb.NvmeTransportType_NVME_TRANSPORT_TYPE_RDMA:
+		return "rdma"
+	default:
+		return ""
+	}
+}
+
+// nvmeListenerParams returns SPDK listener parameters of controller
+func nvmeListenerParams(subsys *pb.NvmeSubsystem, controller *pb.NvmeController) spdk.NvmfSubsystemAddListenerParams {
+	params := spdk.NvmfSubsystemAddListenerParams{}
+	params.Nqn = subsys.Spec.Nqn
+	params.ListenAddress.Trtype = nvmeFabricsTrtype(controller.Spec.Trtype)
+	params.ListenAddress.Traddr = controller.Spec.GetFabricsId().GetTraddr()
+	params.ListenAddress.Trsvcid = controller.Spec.GetFabricsId().GetTrsvcid()
+	params.ListenAddress.Adrfam = utils.OpiAdressFamilyToSpdk(
+		controller.Spec.GetFabricsId().GetAdrfam(),
+	)
+	return params
+}
+
+// nvmeSubsystemFabricsControllers returns the stored fabrics controllers of
+// subsys except the one named skip
+func (s *Server) nvmeSubsystemFabricsControllers(subsys *pb.NvmeSubsystem, skip string) ([]*pb.NvmeController, error) {
+	controllers, err := s.storedNvmeControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	result := []*pb.NvmeController{}
+	for _, controller := range controllers {
+		if controller.Spec.GetFabricsId() != nil && controller.Name != skip {
+			result = append(result, controller)
+		}
+	}
+	return result, nil
+}
+
+// createNvmeFabricsController adds an NVMe-oF listener for controller,
+// creating the NVMe-oF subsystem first if controller is its first listener
+func (s *Server) createNvmeFabricsController(ctx context.Context, subsys *pb.NvmeSubsystem, controller *pb.NvmeController) error {
+	others, err := s.nvmeSubsystemFabricsControllers(subsys, controller.Name)
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		err = s.createNvmfSubsystem(ctx, subsys)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.addNvmeListener(ctx, subsys, controller)
+	if err != nil && len(others) == 0 {
+		if derr := s.deleteNvmfSubsystem(detachedContext{ctx}, subsys.Spec.Nqn); derr != nil {
+			log.Printf("Could not delete NVMe-oF subsystem %s: %v", subsys.Spec.Nqn, derr)
+		}
+	}
+	return err
+}
+
+// deleteNvmeFabricsController removes the NVMe-oF listener of controller and
+// the NVMe-oF subsystem together with its last listener
+func (s *Server) deleteNvmeFabricsController(ctx context.Context, subsys *pb.NvmeSubsystem, controller *pb.NvmeController) error {
+	err := s.removeNvmeListener(ctx, subsys, controller)
+	if err != nil {
+		return err
+	}
+	others, err := s.nvmeSubsystemFabricsControllers(subsys, controller.Name)
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		return s.deleteNvmfSubsystem(ctx, subsys.Spec.Nqn)
+	}
+	return nil
+}
+
+// addNvmeListener adds the NVMe-oF listener of controller
+func (s *Server) addNvmeListener(ctx context.Context, subsys *pb.NvmeSubsystem, controller *pb.NvmeController) error {
+	params := nvmeListenerParams(subsys, controller)
+	var result spdk.NvmfSubsystemAddListenerResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_add_listener", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not create CTRL: %s", controller.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// removeNvmeListener removes the NVMe-oF listener of controller
+func (s *Server) removeNvmeListener(ctx context.Context, subsys *pb.NvmeSubsystem, controller *pb.NvmeController) error {
+	params := nvmeListenerParams(subsys, controller)
+	var result spdk.NvmfSubsystemAddListenerResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_remove_listener", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete CTRL: %s", controller.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// createNvmfSubsystem creates the NVMe-oF subsystem of subsys with its host
+// allow-list and all its stored namespaces
+func (s *Server) createNvmfSubsystem(ctx context.Context, subsys *pb.NvmeSubsystem) error {
+	hosts, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		return err
+	}
+	params := spdk.NvmfCreateSubsystemParams{
+		Nqn:           subsys.Spec.Nqn,
+		SerialNumber:  subsys.Spec.SerialNumber,
+		ModelNumber:   subsys.Spec.ModelNumber,
+		AllowAnyHost:  hosts.AllowAnyHost,
+		MaxNamespaces: int(subsys.Spec.MaxNamespaces),
+	}
+	var result spdk.NvmfCreateSubsystemResult
+	err = s.rpc.Call(ctx, "nvmf_create_subsystem", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not create NQN: %s", subsys.Spec.Nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	for _, host := range hosts.Hosts {
+		err = s.addNvmfHost(ctx, subsys.Spec.Nqn, host)
+		if err != nil {
+			break
+		}
+	}
+	var namespaces []*pb.NvmeNamespace
+	if err == nil {
+		namespaces, err = s.nvmeSubsystemNamespaces(subsys)
+	}
+	if err == nil {
+		for _, namespace := range namespaces {
+			err = s.addNvmfNamespace(ctx, subsys.Spec.Nqn, namespace)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if derr := s.deleteNvmfSubsystem(detachedContext{ctx}, subsys.Spec.Nqn); derr != nil {
+			log.Printf("Could not delete NVMe-oF subsystem %s: %v", subsys.Spec.Nqn, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteNvmfSubsystem deletes NVMe-oF subsystem nqn
+func (s *Server) deleteNvmfSubsystem(ctx context.Context, nqn string) error {
+	params := spdk.NvmfDeleteSubsystemParams{
+		Nqn: nqn,
+	}
+	var result spdk.NvmfDeleteSubsystemResult
+	err := s.rpc.Call(ctx, "nvmf_delete_subsystem", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete NQN: %s", nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// addNvmfNamespace adds namespace to NVMe-oF subsystem nqn
+func (s *Server) addNvmfNamespace(ctx context.Context, nqn string, namespace *pb.NvmeNamespace) error {
+	bdev, err := backend.ResolveVolume(ctx, s.rpc, s.store, namespace.Spec.VolumeNameRef)
+	if err != nil {
+		return err
+	}
+	params := spdk.NvmfSubsystemAddNsParams{
+		Nqn: nqn,
+	}
+	params.Namespace.Nsid = int(namespace.Spec.HostNsid)
+	params.Namespace.BdevName = bdev
+	var result spdk.NvmfSubsystemAddNsResult
+	err = s.rpc.Call(ctx, "nvmf_subsystem_add_ns", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if result < 0 {
+		msg := fmt.Sprintf("Could not create NS: %s", namespace.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// removeNvmfNamespace removes namespace from NVMe-oF subsystem nqn
+func (s *Server) removeNvmfNamespace(ctx context.Context, nqn string, namespace *pb.NvmeNamespace) error {
+	params := spdk.NvmfSubsystemRemoveNsParams{
+		Nqn:  nqn,
+		Nsid: int(namespace.Spec.HostNsid),
+	}
+	var result spdk.NvmfSubsystemRemoveNsResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_remove_ns", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete NS: %s", namespace.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// exportsNvmeFabrics reports whether subsys has an NVMe-oF subsystem, which
+// is the case as long as it has fabrics controllers
+func (s *Server) exportsNvmeFabrics(subsys *pb.NvmeSubsystem) (bool, error) {
+	controllers, err := s.nvmeSubsystemFabricsControllers(subsys, "")
+	if err != nil {
+		return false, err
+	}
+	return len(controllers) != 0, nil
+}
+
+// exportNvmfNamespace adds namespace to the NVMe-oF subsystem of subsys if
+// there is one
+func (s *Server) exportNvmfNamespace(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace) error {
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil || !exported {
+		return err
+	}
+	return s.addNvmfNamespace(ctx, subsys.Spec.Nqn, namespace)
+}
+
+// unexportNvmfNamespace removes namespace from the NVMe-oF subsystem of
+// subsys if there is one
+func (s *Server) unexportNvmfNamespace(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace) error {
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil || !exported {
+		return err
+	}
+	return s.removeNvmfNamespace(ctx, subsys.Spec.Nqn, namespace)
+}
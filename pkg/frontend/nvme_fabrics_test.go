@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+var (
+	testFabricsControllerID   = "controller-fabrics"
+	testFabricsControllerName = utils.ResourceIDToControllerName(testSubsystemID, testFabricsControllerID)
+	testFabricsController     = pb.NvmeController{
+		Name: testFabricsControllerName,
+		Spec: &pb.NvmeControllerSpec{
+			Endpoint: &pb.NvmeControllerSpec_FabricsId{
+				FabricsId: &pb.FabricsEndpoint{
+					Traddr:  "127.0.0.1",
+					Trsvcid: "4420",
+					Adrfam:  pb.NvmeAddressFamily_NVME_ADDRESS_FAMILY_IPV4,
+				},
+			},
+			Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP,
+		},
+		Status: &pb.NvmeControllerStatus{Active: true},
+	}
+)
+
+func TestFrontEnd_NvmeFabricsController(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	t.Cleanup(utils.CheckTestProtoObjectsNotChanged(&testFabricsController)(t, t.Name()))
+	secondFabricsController := utils.ProtoClone(&testFabricsController)
+	secondFabricsController.Name = utils.ResourceIDToControllerName(testSubsystemID, "controller-fabrics-second")
+	secondFabricsController.Spec.GetFabricsId().Trsvcid = "4421"
+
+	tests := map[string]struct {
+		existing []*pb.NvmeController
+		op       func(env *testEnv) error
+		spdk     []string
+		stored   bool
+		errCode  codes.Code
+		errMsg   string
+	}{
+		"create the first listener of a subsystem": {
+			existing: nil,
+			op: func(env *testEnv) error {
+				_, err := env.client.CreateNvmeController(env.ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           testSubsystemName,
+					NvmeController:   &pb.NvmeController{Spec: testFabricsController.Spec},
+					NvmeControllerId: testFabricsControllerID,
+				})
+				return err
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":22}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"create another listener of a subsystem": {
+			existing: []*pb.NvmeController{secondFabricsController},
+			op: func(env *testEnv) error {
+				_, err := env.client.CreateNvmeController(env.ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           testSubsystemName,
+					NvmeController:   &pb.NvmeController{Spec: testFabricsController.Spec},
+					NvmeControllerId: testFabricsControllerID,
+				})
+				return err
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"failed listener deletes the NVMe-oF subsystem": {
+			existing: nil,
+			op: func(env *testEnv) error {
+				_, err := env.client.CreateNvmeController(env.ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           testSubsystemName,
+					NvmeController:   &pb.NvmeController{Spec: testFabricsController.Spec},
+					NvmeControllerId: testFabricsControllerID,
+				})
+				return err
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":22}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			stored:  false,
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create CTRL: %s", testFabricsControllerName),
+		},
+		"delete the last listener of a subsystem": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				_, err := env.client.DeleteNvmeController(env.ctx, &pb.DeleteNvmeControllerRequest{Name: testFabricsControllerName})
+				return err
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			stored:  false,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"delete a listener keeps the NVMe-oF subsystem": {
+			existing: []*pb.NvmeController{&testFabricsController, secondFabricsController},
+			op: func(env *testEnv) error {
+				_, err := env.client.DeleteNvmeController(env.ctx, &pb.DeleteNvmeControllerRequest{Name: testFabricsControllerName})
+				return err
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			stored:  false,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"get returns the stored listener": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				response, err := env.client.GetNvmeController(env.ctx, &pb.GetNvmeControllerRequest{Name: testFabricsControllerName})
+				if err == nil && !proto.Equal(response, &testFabricsController) {
+					return fmt.Errorf("expected %v, received %v", &testFabricsController, response)
+				}
+				return err
+			},
+			spdk:    []string{},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"stats are not supported": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				_, err := env.client.StatsNvmeController(env.ctx, &pb.StatsNvmeControllerRequest{Name: testFabricsControllerName})
+				return err
+			},
+			spdk:    []string{},
+			stored:  true,
+			errCode: codes.Unimplemented,
+			errMsg:  fmt.Sprintf("Could not get stats of CTRL: %s, stats of fabrics controllers are not supported", testFabricsControllerName),
+		},
+		"move a listener": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				desired := utils.ProtoClone(&testFabricsController)
+				desired.Spec.GetFabricsId().Trsvcid = "4430"
+				_, err := env.client.UpdateNvmeController(env.ctx, &pb.UpdateNvmeControllerRequest{NvmeController: desired})
+				return err
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"namespaces are created in the NVMe-oF subsystem": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				_ = env.opiSpdkServer.store.Delete(testNamespaceName)
+				_ = env.opiSpdkServer.removeFromIndex(nvmeNamespaceIndex, testNamespaceName)
+				_, err := env.client.CreateNvmeNamespace(env.ctx, &pb.CreateNvmeNamespaceRequest{
+					Parent:          testSubsystemName,
+					NvmeNamespace:   &pb.NvmeNamespace{Spec: testNamespace.Spec},
+					NvmeNamespaceId: testNamespaceID,
+				})
+				return err
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":22}`},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"namespaces are deleted from the NVMe-oF subsystem": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				_, err := env.client.DeleteNvmeNamespace(env.ctx, &pb.DeleteNvmeNamespaceRequest{Name: testNamespaceName})
+				return err
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			stored:  true,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"per controller attach is rejected": {
+			existing: []*pb.NvmeController{&testFabricsController},
+			op: func(env *testEnv) error {
+				ctx := metadata.AppendToOutgoingContext(env.ctx, NvmeNamespaceVisibilityHeader, testFabricsControllerName)
+				_, err := env.client.UpdateNvmeNamespace(ctx, &pb.UpdateNvmeNamespaceRequest{
+					NvmeNamespace: &pb.NvmeNamespace{Name: testNamespaceName, Spec: testNamespace.Spec},
+				})
+				return err
+			},
+			spdk:    []string{},
+			stored:  true,
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Controller %s is an NVMe-oF endpoint, its namespaces can not be managed per controller", testFabricsControllerName),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			server := testEnv.opiSpdkServer
+			_ = server.store.Set(testSubsystemName, &testSubsystemWithStatus)
+			_ = server.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			_ = server.addToIndex(nvmeNamespaceIndex, testNamespaceName)
+			for _, controller := range tt.existing {
+				_ = server.store.Set(controller.Name, controller)
+				_ = server.addToIndex(nvmeControllerIndex, controller.Name)
+			}
+
+			err := tt.op(testEnv)
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status, received", err)
+			}
+
+			found, _ := server.store.Get(testFabricsControllerName, new(pb.NvmeController))
+			if found != tt.stored {
+				t.Error("stored: expected", tt.stored, "received", found)
+			}
+		})
+	}
+}
@@ -15,15 +15,17 @@ import (
 	"strconv"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 
-	"github.com/google/uuid"
 	"go.einride.tech/aip/fieldbehavior"
 	"go.einride.tech/aip/fieldmask"
 	"go.einride.tech/aip/resourceid"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -34,7 +36,7 @@ func sortNvmeNamespaces(namespaces []*pb.NvmeNamespace) {
 }
 
 // CreateNvmeNamespace creates an Nvme namespace
-func (s *Server) CreateNvmeNamespace(ctx context.Context, in *pb.CreateNvmeNamespaceRequest) (*pb.NvmeNamespace, error) {
+func (s *Server) CreateNvmeNamespace(ctx context.Context, in *pb.CreateNvmeNamespaceRequest) (_ *pb.NvmeNamespace, err error) {
 	// check input correctness
 	if err := s.validateCreateNvmeNamespaceRequest(in); err != nil {
 		return nil, err
@@ -48,6 +50,25 @@ func (s *Server) CreateNvmeNamespace(ctx context.Context, in *pb.CreateNvmeNames
 	in.NvmeNamespace.Name = utils.ResourceIDToNamespaceName(
 		utils.GetSubsystemIDFromNvmeName(in.Parent), resourceID,
 	)
+	attachment, err := requestedNvmeNamespaceAttachment(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if asyncRequested(ctx) {
+		// the operation creates the object under the name returned now
+		request := utils.ProtoClone(in)
+		request.NvmeNamespaceId = resourceID
+		err := s.startOperation(ctx, request, true, func(ctx context.Context) (proto.Message, error) {
+			ctx = metadata.NewIncomingContext(ctx, nvmeNamespaceAttachmentMetadata(attachment))
+			return s.CreateNvmeNamespace(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return in.NvmeNamespace, nil
+	}
+	unlock := s.lockNvme(in.NvmeNamespace.Name)
+	defer unlock()
 	// idempotent API when called with same key, should return same object
 	namespace := new(pb.NvmeNamespace)
 	found, err := s.store.Get(in.NvmeNamespace.Name, namespace)
@@ -68,27 +89,55 @@ func (s *Server) CreateNvmeNamespace(ctx context.Context, in *pb.CreateNvmeNames
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Parent)
 		return nil, err
 	}
-	// TODO: do lookup through VolumeId key instead of using it's value
-	params := models.NvdaControllerNvmeNamespaceAttachParams{
-		BdevType: "spdk",
-		Bdev:     in.NvmeNamespace.Spec.VolumeNameRef,
-		Nsid:     int(in.NvmeNamespace.Spec.HostNsid),
-		Subnqn:   subsys.Spec.Nqn,
-		Cntlid:   0,
-		UUID:     in.NvmeNamespace.Spec.Uuid,
-		Nguid:    in.NvmeNamespace.Spec.Nguid,
-		Eui64:    strconv.FormatInt(in.NvmeNamespace.Spec.Eui64, 10),
+	unlockVolume := backend.LockVolume(s.locks, in.NvmeNamespace.Spec.VolumeNameRef)
+	defer unlockVolume()
+	// fail early even if there are no controllers to attach the volume to yet
+	_, err = backend.ResolveVolume(ctx, s.rpc, s.store, in.NvmeNamespace.Spec.VolumeNameRef)
+	if err != nil {
+		return nil, err
 	}
-	var result models.NvdaControllerNvmeNamespaceAttachResult
-	err = s.rpc.Call(ctx, "controller_nvme_namespace_attach", &params, &result)
+	// new namespaces are shared by every controller of the subsystem unless
+	// the client made them private
+	if attachment == nil {
+		attachment = &nvmeNamespaceAttachment{Shared: true}
+	}
+	err = s.validateNvmeNamespaceAttachment(in.NvmeNamespace.Name, attachment)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if !result {
-		msg := fmt.Sprintf("Could not create NS: %s", in.NvmeNamespace.Name)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
+	controllers, err := s.nvmeSubsystemControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	if attachment.Shared {
+		attachment.Controllers = nvmeControllerNames(controllers)
+	} else {
+		private := []*pb.NvmeController{}
+		for _, controller := range controllers {
+			for _, name := range attachment.Controllers {
+				if controller.Name == name {
+					private = append(private, controller)
+				}
+			}
+		}
+		controllers = private
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.attachNvmeNamespace(ctx, subsys, in.NvmeNamespace, controllers)
+	if err != nil {
+		return nil, err
 	}
+	undo.add("NS "+in.NvmeNamespace.Name, func(ctx context.Context) error {
+		return s.detachNvmeNamespace(ctx, subsys, in.NvmeNamespace, controllers)
+	})
+	err = s.exportNvmfNamespace(ctx, subsys, in.NvmeNamespace)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("NVMe-oF NS "+in.NvmeNamespace.Name, func(ctx context.Context) error {
+		return s.unexportNvmfNamespace(ctx, subsys, in.NvmeNamespace)
+	})
 	response := utils.ProtoClone(in.NvmeNamespace)
 	response.Status = &pb.NvmeNamespaceStatus{
 		State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
@@ -98,6 +147,27 @@ func (s *Server) CreateNvmeNamespace(ctx context.Context, in *pb.CreateNvmeNames
 	if err != nil {
 		return nil, err
 	}
+	undo.add("record of "+in.NvmeNamespace.Name, func(context.Context) error {
+		return s.store.Delete(in.NvmeNamespace.Name)
+	})
+	err = s.setNvmeNamespaceAttachment(in.NvmeNamespace.Name, attachment)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("attachment of "+in.NvmeNamespace.Name, func(context.Context) error {
+		return s.store.Delete(nvmeNamespaceAttachmentKey(in.NvmeNamespace.Name))
+	})
+	err = s.addToIndex(nvmeNamespaceIndex, in.NvmeNamespace.Name)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("index entry of "+in.NvmeNamespace.Name, func(context.Context) error {
+		return s.removeFromIndex(nvmeNamespaceIndex, in.NvmeNamespace.Name)
+	})
+	err = backend.AddVolumeUser(s.locks, s.store, response.Spec.VolumeNameRef, response.Name)
+	if err != nil {
+		return nil, err
+	}
 	return response, nil
 }
 
@@ -107,6 +177,18 @@ func (s *Server) DeleteNvmeNamespace(ctx context.Context, in *pb.DeleteNvmeNames
 	if err := s.validateDeleteNvmeNamespaceRequest(in); err != nil {
 		return nil, err
 	}
+	if asyncRequested(ctx) {
+		request := utils.ProtoClone(in)
+		err := s.startOperation(ctx, request, false, func(ctx context.Context) (proto.Message, error) {
+			return s.DeleteNvmeNamespace(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+	unlock := s.lockNvme(in.Name)
+	defer unlock()
 	// fetch object from the database
 	namespace := new(pb.NvmeNamespace)
 	found, err := s.store.Get(in.Name, namespace)
@@ -133,36 +215,50 @@ func (s *Server) DeleteNvmeNamespace(ctx context.Context, in *pb.DeleteNvmeNames
 		return nil, err
 	}
 
-	// TODO: fix hard-coded Cntlid
-	params := models.NvdaControllerNvmeNamespaceDetachParams{
-		Nsid:   int(namespace.Spec.HostNsid),
-		Subnqn: subsys.Spec.Nqn,
-		Cntlid: 0,
+	controllers, err := s.nvmeNamespaceControllers(subsys, namespace.Name)
+	if err != nil {
+		return nil, err
 	}
-	var result models.NvdaControllerNvmeNamespaceDetachResult
-	err = s.rpc.Call(ctx, "controller_nvme_namespace_detach", &params, &result)
+	err = s.unexportNvmfNamespace(ctx, subsys, namespace)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if !result {
-		msg := fmt.Sprintf("Could not delete NS: %s", in.Name)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
+	err = s.detachNvmeNamespace(ctx, subsys, namespace, controllers)
+	if err != nil {
+		return nil, err
 	}
 	// remove from the Database
 	err = s.store.Delete(namespace.Name)
 	if err != nil {
 		return nil, err
 	}
+	err = s.store.Delete(nvmeNamespaceAttachmentKey(namespace.Name))
+	if err != nil {
+		return nil, err
+	}
+	err = s.removeFromIndex(nvmeNamespaceIndex, namespace.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = backend.RemoveVolumeUser(s.locks, s.store, namespace.Spec.VolumeNameRef, namespace.Name)
+	if err != nil {
+		return nil, err
+	}
 	return &emptypb.Empty{}, nil
 }
 
 // UpdateNvmeNamespace updates an Nvme namespace
-func (s *Server) UpdateNvmeNamespace(_ context.Context, in *pb.UpdateNvmeNamespaceRequest) (*pb.NvmeNamespace, error) {
+func (s *Server) UpdateNvmeNamespace(ctx context.Context, in *pb.UpdateNvmeNamespaceRequest) (_ *pb.NvmeNamespace, err error) {
 	// check input correctness
 	if err := s.validateUpdateNvmeNamespaceRequest(in); err != nil {
 		return nil, err
 	}
+	attachment, err := requestedNvmeNamespaceAttachment(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockNvme(in.NvmeNamespace.Name)
+	defer unlock()
 	// fetch object from the database
 	namespace := new(pb.NvmeNamespace)
 	found, err := s.store.Get(in.NvmeNamespace.Name, namespace)
@@ -171,18 +267,88 @@ func (s *Server) UpdateNvmeNamespace(_ context.Context, in *pb.UpdateNvmeNamespa
 	}
 	if !found {
 		if in.AllowMissing {
-			log.Printf("TODO: in case of AllowMissing, create a new resource, don;t return error")
+			// see https://google.aip.dev/134#create-or-update
+			log.Printf("NvmeNamespace %v not found, creating it since AllowMissing is set", in.NvmeNamespace.Name)
+			unlock()
+			return s.CreateNvmeNamespace(ctx, &pb.CreateNvmeNamespaceRequest{
+				Parent: utils.ResourceIDToSubsystemName(
+					utils.GetSubsystemIDFromNvmeName(in.NvmeNamespace.Name),
+				),
+				NvmeNamespace:   in.NvmeNamespace,
+				NvmeNamespaceId: path.Base(in.NvmeNamespace.Name),
+			})
 		}
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.NvmeNamespace.Name)
 		return nil, err
 	}
-	resourceID := path.Base(namespace.Name)
 	// update_mask = 2
 	if err := fieldmask.Validate(in.UpdateMask, in.NvmeNamespace); err != nil {
 		return nil, err
 	}
-	log.Printf("TODO: use resourceID=%v", resourceID)
-	return nil, status.Errorf(codes.Unimplemented, "UpdateNvmeNamespace method is not implemented")
+	response := utils.ProtoClone(namespace)
+	fieldmask.Update(in.UpdateMask, response, in.NvmeNamespace)
+	// name and status are not client settable
+	response.Name = namespace.Name
+	response.Status = namespace.Status
+	// naming the volume explicitly in the mask re-attaches it even when the
+	// reference did not change, so that a grown bdev is picked up by the host
+	refresh := false
+	for _, p := range in.GetUpdateMask().GetPaths() {
+		if p == "spec.volume_name_ref" {
+			refresh = true
+		}
+	}
+	unlockVolume := backend.LockVolume(s.locks, response.Spec.VolumeNameRef)
+	defer unlockVolume()
+	changed := refresh || !proto.Equal(namespace.Spec, response.Spec)
+	if changed || attachment != nil {
+		subsysName := utils.ResourceIDToSubsystemName(
+			utils.GetSubsystemIDFromNvmeName(namespace.Name),
+		)
+		subsys := new(pb.NvmeSubsystem)
+		found, err = s.store.Get(subsysName, subsys)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+			return nil, err
+		}
+		var undo rollback
+		defer undo.runOnError(ctx, &err)
+		if attachment != nil {
+			err = s.validateNvmeNamespaceAttachment(namespace.Name, attachment)
+			if err != nil {
+				return nil, err
+			}
+			previous, err := s.storedNvmeNamespaceAttachment(subsys, namespace.Name)
+			if err != nil {
+				return nil, err
+			}
+			err = s.changeNvmeNamespaceAttachment(ctx, subsys, namespace, attachment)
+			if err != nil {
+				return nil, err
+			}
+			undo.add("attachment of "+namespace.Name, func(ctx context.Context) error {
+				return s.changeNvmeNamespaceAttachment(ctx, subsys, namespace, previous)
+			})
+		}
+		if changed {
+			err = s.reattachNvmeNamespace(ctx, subsys, namespace, response)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = s.store.Set(response.Name, response)
+	if err != nil {
+		return nil, err
+	}
+	err = s.moveVolumeUser(response.Name, namespace.Spec.VolumeNameRef, response.Spec.VolumeNameRef)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // ListNvmeNamespaces lists Nvme namespaces
@@ -192,7 +358,7 @@ func (s *Server) ListNvmeNamespaces(ctx context.Context, in *pb.ListNvmeNamespac
 		return nil, err
 	}
 	// fetch object from the database
-	size, offset, perr := utils.ExtractPagination(in.PageSize, in.PageToken, s.Pagination)
+	size, offset, perr := extractPagination(in.PageSize, in.PageToken, in.Parent+"/nvmeNamespaces")
 	if perr != nil {
 		return nil, perr
 	}
@@ -205,31 +371,23 @@ func (s *Server) ListNvmeNamespaces(ctx context.Context, in *pb.ListNvmeNamespac
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Parent)
 		return nil, err
 	}
-	// TODO: fix hard-coded Cntlid
-	params := models.NvdaControllerNvmeNamespaceListParams{
-		Subnqn: subsys.Spec.Nqn,
-		Cntlid: 0,
-	}
-	var result models.NvdaControllerNvmeNamespaceListResult
-	err = s.rpc.Call(ctx, "controller_nvme_namespace_list", &params, &result)
+	result, visibility, err := s.listNvmeNamespaces(ctx, subsys)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	token, hasMoreElements := "", false
-	log.Printf("Limiting result len(%d) to [%d:%d]", len(result.Namespaces), offset, size)
-	result.Namespaces, hasMoreElements = utils.LimitPagination(result.Namespaces, offset, size)
-	if hasMoreElements {
-		token = uuid.New().String()
-		s.Pagination[token] = offset + size
-	}
 	Blobarray := make([]*pb.NvmeNamespace, len(result.Namespaces))
 	for i := range result.Namespaces {
 		r := &result.Namespaces[i]
 		Blobarray[i] = &pb.NvmeNamespace{Spec: &pb.NvmeNamespaceSpec{HostNsid: int32(r.Nsid)}}
 	}
 	sortNvmeNamespaces(Blobarray)
-	return &pb.ListNvmeNamespacesResponse{NvmeNamespaces: Blobarray}, nil
+	Blobarray, token := limitPagination(Blobarray, offset, size, in.Parent+"/nvmeNamespaces")
+	nsids := make([]int, len(Blobarray))
+	for i, namespace := range Blobarray {
+		nsids[i] = int(namespace.Spec.HostNsid)
+	}
+	reportNvmeNamespaceControllers(ctx, visibility, nsids)
+	return &pb.ListNvmeNamespacesResponse{NvmeNamespaces: Blobarray, NextPageToken: token}, nil
 }
 
 // GetNvmeNamespace gets an Nvme namespace
@@ -261,67 +419,306 @@ func (s *Server) GetNvmeNamespace(ctx context.Context, in *pb.GetNvmeNamespaceRe
 		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
 		return nil, err
 	}
-	// TODO: fix hard-coded Cntlid
-	params := models.NvdaControllerNvmeNamespaceListParams{
-		Subnqn: subsys.Spec.Nqn,
-		Cntlid: 0,
-	}
-	var result models.NvdaControllerNvmeNamespaceListResult
-	err = s.rpc.Call(ctx, "controller_nvme_namespace_list", &params, &result)
+	result, visibility, err := s.listNvmeNamespaces(ctx, subsys)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
 	for i := range result.Namespaces {
 		r := &result.Namespaces[i]
 		if r.Nsid == int(namespace.Spec.HostNsid) {
-			return &pb.NvmeNamespace{
-				Spec: &pb.NvmeNamespaceSpec{
-					HostNsid: int32(r.Nsid),
-				},
-				Status: &pb.NvmeNamespaceStatus{
-					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
-					OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
-				},
-			}, nil
+			reportNvmeNamespaceControllers(ctx, visibility, []int{r.Nsid})
+			// attached in SNAP, so it is visible to hosts
+			namespace.Status = &pb.NvmeNamespaceStatus{
+				State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+				OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
+			}
+			return namespace, nil
 		}
 	}
-	msg := fmt.Sprintf("Could not find HostNsid: %d", namespace.Spec.HostNsid)
-	return nil, status.Errorf(codes.InvalidArgument, msg)
+	// not attached in SNAP, so hosts do not see it
+	namespace.Status = &pb.NvmeNamespaceStatus{
+		State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+		OperState: pb.NvmeNamespaceStatus_OPER_STATE_OFFLINE,
+	}
+	return namespace, nil
 }
 
-// StatsNvmeNamespace gets an Nvme namespace stats
+// StatsNvmeNamespace gets an Nvme namespace stats, summed over the
+// controllers the namespace is attached to
 func (s *Server) StatsNvmeNamespace(ctx context.Context, in *pb.StatsNvmeNamespaceRequest) (*pb.StatsNvmeNamespaceResponse, error) {
 	// check input correctness
 	if err := s.validateStatsNvmeNamespaceRequest(in); err != nil {
 		return nil, err
 	}
 	// fetch object from the database
-	namespace := new(pb.NvmeNamespace)
-	found, err := s.store.Get(in.Name, namespace)
+	subsys, namespace, err := s.getNvmeNamespaceAndSubsystem(in.Name)
 	if err != nil {
 		return nil, err
 	}
-	if !found {
-		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
+	bdev, err := backend.ResolveVolume(ctx, s.rpc, s.store, namespace.Spec.VolumeNameRef)
+	if err != nil {
+		return nil, err
+	}
+	attached, err := s.nvmeNamespaceControllers(subsys, namespace.Name)
+	if err != nil {
 		return nil, err
 	}
+	cntlids := make(map[int]bool)
+	for _, controller := range attached {
+		cntlids[int(controller.Spec.GetNvmeControllerId())] = true
+	}
+	var list []models.NvdaControllerListResult
+	err = s.rpc.Call(ctx, "controller_list", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", list)
+	names := make(map[string]bool)
+	for i := range list {
+		r := &list[i]
+		if r.Subnqn == subsys.Spec.Nqn && r.Type == "nvme" && cntlids[r.Cntlid] {
+			names[r.Name] = true
+		}
+	}
 	var result models.NvdaControllerNvmeStatsResult
 	err = s.rpc.Call(ctx, "controller_nvme_get_iostat", nil, &result)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Received from SPDK: %v", result)
+	stats := &pb.VolumeStats{}
+	counters := &volumeCounters{}
+	found := false
 	for _, c := range result.Controllers {
-		for _, r := range c.Bdevs {
-			if r.BdevName == namespace.Spec.VolumeNameRef {
-				return &pb.StatsNvmeNamespaceResponse{Stats: &pb.VolumeStats{
-					ReadOpsCount:  int32(r.ReadIos),
-					WriteOpsCount: int32(r.WriteIos),
-				}}, nil
+		if !names[c.Name] {
+			continue
+		}
+		for i := range c.Bdevs {
+			r := &c.Bdevs[i]
+			if r.BdevName == bdev {
+				addVolumeStats(stats, r)
+				counters.add(r)
+				found = true
+			}
+		}
+	}
+	if !found {
+		msg := fmt.Sprintf("Could not find BdevName: %s", bdev)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	counters.report(ctx)
+	return &pb.StatsNvmeNamespaceResponse{Stats: stats}, nil
+}
+
+// reattachNvmeNamespace detaches namespace and attaches desired in its place
+// on the same controllers and in the NVMe-oF subsystem. SNAP has no native
+// resize or modify call, detach followed by attach makes the controller report
+// a Namespace Attribute Changed event to the host. If a step fails the
+// original namespace is attached back.
+func (s *Server) reattachNvmeNamespace(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace, desired *pb.NvmeNamespace) (err error) {
+	controllers, err := s.nvmeNamespaceControllers(subsys, namespace.Name)
+	if err != nil {
+		return err
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.detachNvmeNamespace(ctx, subsys, namespace, controllers)
+	if err != nil {
+		return err
+	}
+	undo.add("NS "+namespace.Name, func(ctx context.Context) error {
+		return s.attachNvmeNamespace(ctx, subsys, namespace, controllers)
+	})
+	err = s.attachNvmeNamespace(ctx, subsys, desired, controllers)
+	if err != nil {
+		return err
+	}
+	undo.add("updated NS "+desired.Name, func(ctx context.Context) error {
+		return s.detachNvmeNamespace(ctx, subsys, desired, controllers)
+	})
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil || !exported {
+		return err
+	}
+	err = s.removeNvmfNamespace(ctx, subsys.Spec.Nqn, namespace)
+	if err != nil {
+		return err
+	}
+	undo.add("NVMe-oF NS "+namespace.Name, func(ctx context.Context) error {
+		return s.addNvmfNamespace(ctx, subsys.Spec.Nqn, namespace)
+	})
+	return s.addNvmfNamespace(ctx, subsys.Spec.Nqn, desired)
+}
+
+// attachNvmeNamespace attaches namespace to controllers of subsys, either to
+// all of them or to none
+func (s *Server) attachNvmeNamespace(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace, controllers []*pb.NvmeController) error {
+	for i, controller := range controllers {
+		err := s.attachNvmeNamespaceToController(ctx, subsys.Spec.Nqn, int(controller.Spec.GetNvmeControllerId()), namespace)
+		if err != nil {
+			// do not leave the namespace visible on part of the controllers
+			for _, attached := range controllers[:i] {
+				if derr := s.detachNvmeNamespaceFromController(detachedContext{ctx}, subsys.Spec.Nqn, int(attached.Spec.GetNvmeControllerId()), namespace); derr != nil {
+					log.Printf("Could not detach NS %s from %s: %v", namespace.Name, attached.Name, derr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// detachNvmeNamespace detaches namespace from controllers of subsys
+func (s *Server) detachNvmeNamespace(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace, controllers []*pb.NvmeController) error {
+	for _, controller := range controllers {
+		err := s.detachNvmeNamespaceFromController(ctx, subsys.Spec.Nqn, int(controller.Spec.GetNvmeControllerId()), namespace)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachNvmeNamespaceToController attaches namespace to controller cntlid of
+// subsystem nqn
+func (s *Server) attachNvmeNamespaceToController(ctx context.Context, nqn string, cntlid int, namespace *pb.NvmeNamespace) error {
+	bdev, err := backend.ResolveVolume(ctx, s.rpc, s.store, namespace.Spec.VolumeNameRef)
+	if err != nil {
+		return err
+	}
+	params := models.NvdaControllerNvmeNamespaceAttachParams{
+		BdevType: "spdk",
+		Bdev:     bdev,
+		Nsid:     int(namespace.Spec.HostNsid),
+		Subnqn:   nqn,
+		Cntlid:   cntlid,
+		UUID:     namespace.Spec.Uuid,
+		Nguid:    namespace.Spec.Nguid,
+		Eui64:    strconv.FormatInt(namespace.Spec.Eui64, 10),
+	}
+	var result models.NvdaControllerNvmeNamespaceAttachResult
+	err = s.rpc.Call(ctx, "controller_nvme_namespace_attach", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not create NS: %s", namespace.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// detachNvmeNamespaceFromController detaches namespace from controller cntlid
+// of subsystem nqn
+func (s *Server) detachNvmeNamespaceFromController(ctx context.Context, nqn string, cntlid int, namespace *pb.NvmeNamespace) error {
+	params := models.NvdaControllerNvmeNamespaceDetachParams{
+		Nsid:   int(namespace.Spec.HostNsid),
+		Subnqn: nqn,
+		Cntlid: cntlid,
+	}
+	var result models.NvdaControllerNvmeNamespaceDetachResult
+	err := s.rpc.Call(ctx, "controller_nvme_namespace_detach", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete NS: %s", namespace.Name)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// attachNvmeSubsystemNamespaces attaches the shared namespaces of subsys to
+// the newly created controller name with cntlid
+func (s *Server) attachNvmeSubsystemNamespaces(ctx context.Context, subsys *pb.NvmeSubsystem, name string, cntlid int) error {
+	namespaces, err := s.nvmeSubsystemNamespaces(subsys)
+	if err != nil {
+		return err
+	}
+	attached := []*pb.NvmeNamespace{}
+	for _, namespace := range namespaces {
+		attachment, found, err := s.getNvmeNamespaceAttachment(namespace.Name)
+		if err != nil {
+			return err
+		}
+		if found && !attachment.Shared {
+			continue
+		}
+		err = s.attachNvmeNamespaceToController(ctx, subsys.Spec.Nqn, cntlid, namespace)
+		if err != nil {
+			for _, ns := range attached {
+				if derr := s.detachNvmeNamespaceFromController(detachedContext{ctx}, subsys.Spec.Nqn, cntlid, ns); derr != nil {
+					log.Printf("Could not detach NS %s: %v", ns.Name, derr)
+				}
+			}
+			return err
+		}
+		attached = append(attached, namespace)
+	}
+	for _, namespace := range attached {
+		err = s.addNvmeNamespaceAttachment(namespace.Name, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nvmeSubsystemNamespaces returns the stored namespaces of subsys
+func (s *Server) nvmeSubsystemNamespaces(subsys *pb.NvmeSubsystem) ([]*pb.NvmeNamespace, error) {
+	names, err := s.listIndex(nvmeNamespaceIndex)
+	if err != nil {
+		return nil, err
+	}
+	subsysID := utils.GetSubsystemIDFromNvmeName(subsys.Name)
+	namespaces := []*pb.NvmeNamespace{}
+	for _, name := range names {
+		if utils.GetSubsystemIDFromNvmeName(name) != subsysID {
+			continue
+		}
+		namespace := new(pb.NvmeNamespace)
+		found, err := s.store.Get(name, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+// listNvmeNamespaces lists namespaces attached to the controllers of subsys
+// and returns the names of the controllers which see each of them, keyed by
+// nsid. Private namespaces are attached to a subset of the controllers only,
+// so every controller is asked.
+func (s *Server) listNvmeNamespaces(ctx context.Context, subsys *pb.NvmeSubsystem) (*models.NvdaControllerNvmeNamespaceListResult, map[int][]string, error) {
+	controllers, err := s.nvmeSubsystemControllers(subsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	var namespaces models.NvdaControllerNvmeNamespaceListResult
+	visibility := make(map[int][]string)
+	for _, controller := range controllers {
+		params := models.NvdaControllerNvmeNamespaceListParams{
+			Subnqn: subsys.Spec.Nqn,
+			Cntlid: int(controller.Spec.GetNvmeControllerId()),
+		}
+		var result models.NvdaControllerNvmeNamespaceListResult
+		err = s.rpc.Call(ctx, "controller_nvme_namespace_list", &params, &result)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Received from SPDK: %v", result)
+		for i := range result.Namespaces {
+			r := &result.Namespaces[i]
+			if _, ok := visibility[r.Nsid]; !ok {
+				namespaces.Namespaces = append(namespaces.Namespaces, *r)
 			}
+			visibility[r.Nsid] = append(visibility[r.Nsid], controller.Name)
 		}
 	}
-	msg := fmt.Sprintf("Could not find BdevName: %s", namespace.Spec.VolumeNameRef)
-	return nil, status.Errorf(codes.InvalidArgument, msg)
+	return &namespaces, visibility, nil
 }
@@ -0,0 +1,347 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NvmeNamespaceControllersHeader is the gRPC response header reporting which
+// controllers see a namespace, one "<nsid>=<controller>,<controller>" value
+// per namespace returned by GetNvmeNamespace or ListNvmeNamespaces
+const NvmeNamespaceControllersHeader = "nvme-namespace-controllers"
+
+// NvmeNamespaceVisibilityHeader is the gRPC request metadata key setting the
+// controllers which see the namespace of CreateNvmeNamespace and
+// UpdateNvmeNamespace, one value per controller name for a private namespace
+// or a single "*" value for a namespace shared by every controller of the
+// subsystem. New namespaces are shared unless it is set.
+const NvmeNamespaceVisibilityHeader = "nvme-namespace-visibility"
+
+// nvmeNamespaceAttachment is the row of the controller and namespace
+// attachment matrix describing one namespace
+type nvmeNamespaceAttachment struct {
+	// Shared namespaces are attached to every controller of the subsystem,
+	// including the ones created later. Private namespaces are attached to
+	// Controllers only.
+	Shared      bool
+	Controllers []string
+}
+
+// nvmeNamespaceAttachmentKey returns the store key holding the attachment of
+// namespace name
+func nvmeNamespaceAttachmentKey(name string) string {
+	return "//storage.opiproject.org/attachments/" + name
+}
+
+// getNvmeNamespaceAttachment returns the attachment of namespace name
+func (s *Server) getNvmeNamespaceAttachment(name string) (*nvmeNamespaceAttachment, bool, error) {
+	value := new(structpb.Struct)
+	found, err := s.store.Get(nvmeNamespaceAttachmentKey(name), value)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	attachment := &nvmeNamespaceAttachment{
+		Shared: value.Fields["shared"].GetBoolValue(),
+	}
+	for _, v := range value.Fields["controllers"].GetListValue().GetValues() {
+		attachment.Controllers = append(attachment.Controllers, v.GetStringValue())
+	}
+	return attachment, true, nil
+}
+
+// setNvmeNamespaceAttachment records the attachment of namespace name
+func (s *Server) setNvmeNamespaceAttachment(name string, attachment *nvmeNamespaceAttachment) error {
+	controllers := make([]*structpb.Value, 0, len(attachment.Controllers))
+	sort.Strings(attachment.Controllers)
+	for _, controller := range attachment.Controllers {
+		controllers = append(controllers, structpb.NewStringValue(controller))
+	}
+	value := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"shared":      structpb.NewBoolValue(attachment.Shared),
+		"controllers": structpb.NewListValue(&structpb.ListValue{Values: controllers}),
+	}}
+	return s.store.Set(nvmeNamespaceAttachmentKey(name), value)
+}
+
+// addNvmeNamespaceAttachment records that namespace name is attached to
+// controller
+func (s *Server) addNvmeNamespaceAttachment(name string, controller string) error {
+	attachment, found, err := s.getNvmeNamespaceAttachment(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		attachment = &nvmeNamespaceAttachment{Shared: true}
+	}
+	for _, c := range attachment.Controllers {
+		if c == controller {
+			return nil
+		}
+	}
+	attachment.Controllers = append(attachment.Controllers, controller)
+	return s.setNvmeNamespaceAttachment(name, attachment)
+}
+
+// removeNvmeControllerAttachments records that no namespace of subsys is
+// attached to the deleted controller
+func (s *Server) removeNvmeControllerAttachments(subsys *pb.NvmeSubsystem, controller string) error {
+	namespaces, err := s.nvmeSubsystemNamespaces(subsys)
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		attachment, found, err := s.getNvmeNamespaceAttachment(namespace.Name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		controllers := attachment.Controllers[:0]
+		for _, c := range attachment.Controllers {
+			if c != controller {
+				controllers = append(controllers, c)
+			}
+		}
+		attachment.Controllers = controllers
+		err = s.setNvmeNamespaceAttachment(namespace.Name, attachment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nvmeNamespaceControllers returns the active controllers of subsys which
+// namespace name is attached to. Namespaces without a recorded attachment
+// are shared.
+func (s *Server) nvmeNamespaceControllers(subsys *pb.NvmeSubsystem, name string) ([]*pb.NvmeController, error) {
+	controllers, err := s.nvmeSubsystemControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	attachment, found, err := s.getNvmeNamespaceAttachment(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return controllers, nil
+	}
+	attached := make(map[string]bool)
+	for _, c := range attachment.Controllers {
+		attached[c] = true
+	}
+	result := []*pb.NvmeController{}
+	for _, controller := range controllers {
+		if attached[controller.Name] {
+			result = append(result, controller)
+		}
+	}
+	return result, nil
+}
+
+// nvmeControllerNames returns the names of controllers
+func nvmeControllerNames(controllers []*pb.NvmeController) []string {
+	names := make([]string, len(controllers))
+	for i, controller := range controllers {
+		names[i] = controller.Name
+	}
+	return names
+}
+
+// reportNvmeNamespaceControllers sends the controllers which see namespaces
+// nsids in the NvmeNamespaceControllersHeader response header
+func reportNvmeNamespaceControllers(ctx context.Context, visibility map[int][]string, nsids []int) {
+	values := make([]string, 0, 2*len(nsids))
+	for _, nsid := range nsids {
+		values = append(values, NvmeNamespaceControllersHeader,
+			fmt.Sprintf("%d=%s", nsid, strings.Join(visibility[nsid], ",")))
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(values...)); err != nil {
+		log.Printf("Could not report namespace controllers: %v", err)
+	}
+}
+
+// requestedNvmeNamespaceAttachment returns the attachment the client set in
+// NvmeNamespaceVisibilityHeader, or nil if it did not set the header
+func requestedNvmeNamespaceAttachment(ctx context.Context) (*nvmeNamespaceAttachment, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(NvmeNamespaceVisibilityHeader)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) == 1 && values[0] == "*" {
+		return &nvmeNamespaceAttachment{Shared: true}, nil
+	}
+	attachment := &nvmeNamespaceAttachment{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if value == "" || value == "*" {
+			msg := fmt.Sprintf("Invalid %s value %q, expected controller names or a single \"*\"", NvmeNamespaceVisibilityHeader, value)
+			return nil, status.Errorf(codes.InvalidArgument, msg)
+		}
+		if !seen[value] {
+			seen[value] = true
+			attachment.Controllers = append(attachment.Controllers, value)
+		}
+	}
+	return attachment, nil
+}
+
+// nvmeNamespaceAttachmentMetadata returns the request metadata setting
+// attachment, so that it reaches asynchronous operations
+func nvmeNamespaceAttachmentMetadata(attachment *nvmeNamespaceAttachment) metadata.MD {
+	if attachment == nil {
+		return metadata.MD{}
+	}
+	if attachment.Shared {
+		return metadata.Pairs(NvmeNamespaceVisibilityHeader, "*")
+	}
+	return metadata.MD{NvmeNamespaceVisibilityHeader: attachment.Controllers}
+}
+
+// validateNvmeNamespaceAttachment checks that the controllers of a private
+// attachment of namespace name are stored PCIe controllers of its subsystem
+func (s *Server) validateNvmeNamespaceAttachment(name string, attachment *nvmeNamespaceAttachment) error {
+	if attachment.Shared {
+		return nil
+	}
+	for _, controllerName := range attachment.Controllers {
+		if utils.GetSubsystemIDFromNvmeName(name) != utils.GetSubsystemIDFromNvmeName(controllerName) {
+			msg := fmt.Sprintf("Namespace %s and controller %s belong to different subsystems", name, controllerName)
+			return status.Errorf(codes.InvalidArgument, msg)
+		}
+		controller := new(pb.NvmeController)
+		found, err := s.store.Get(controllerName, controller)
+		if err != nil {
+			return err
+		}
+		if !found {
+			err := status.Errorf(codes.NotFound, "unable to find key %s", controllerName)
+			return err
+		}
+		// NVMe-oF listeners expose every namespace of the subsystem
+		if controller.Spec.GetFabricsId() != nil {
+			msg := fmt.Sprintf("Controller %s is an NVMe-oF endpoint, its namespaces can not be managed per controller", controllerName)
+			return status.Errorf(codes.FailedPrecondition, msg)
+		}
+	}
+	return nil
+}
+
+// storedNvmeNamespaceAttachment returns the recorded attachment of namespace
+// name of subsys. Namespaces without a record are shared by the active
+// controllers.
+func (s *Server) storedNvmeNamespaceAttachment(subsys *pb.NvmeSubsystem, name string) (*nvmeNamespaceAttachment, error) {
+	attachment, found, err := s.getNvmeNamespaceAttachment(name)
+	if err != nil || found {
+		return attachment, err
+	}
+	controllers, err := s.nvmeSubsystemControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	names := nvmeControllerNames(controllers)
+	sort.Strings(names)
+	return &nvmeNamespaceAttachment{Shared: true, Controllers: names}, nil
+}
+
+// changeNvmeNamespaceAttachment moves namespace of locked subsys from its
+// recorded attachment to desired. It is attached to the active controllers
+// desired adds and detached from the ones it drops, controllers which are
+// not active are only recorded.
+func (s *Server) changeNvmeNamespaceAttachment(ctx context.Context, subsys *pb.NvmeSubsystem, namespace *pb.NvmeNamespace, desired *nvmeNamespaceAttachment) (err error) {
+	controllers, err := s.nvmeSubsystemControllers(subsys)
+	if err != nil {
+		return err
+	}
+	current, err := s.storedNvmeNamespaceAttachment(subsys, namespace.Name)
+	if err != nil {
+		return err
+	}
+	if desired.Shared {
+		desired = &nvmeNamespaceAttachment{Shared: true, Controllers: nvmeControllerNames(controllers)}
+	}
+	had := make(map[string]bool)
+	for _, c := range current.Controllers {
+		had[c] = true
+	}
+	wanted := make(map[string]bool)
+	for _, c := range desired.Controllers {
+		wanted[c] = true
+	}
+	attach := []*pb.NvmeController{}
+	detach := []*pb.NvmeController{}
+	for _, c := range controllers {
+		if wanted[c.Name] && !had[c.Name] {
+			attach = append(attach, c)
+		}
+		if had[c.Name] && !wanted[c.Name] {
+			detach = append(detach, c)
+		}
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.attachNvmeNamespace(ctx, subsys, namespace, attach)
+	if err != nil {
+		return err
+	}
+	undo.add("NS "+namespace.Name, func(ctx context.Context) error {
+		return s.detachNvmeNamespace(ctx, subsys, namespace, attach)
+	})
+	for _, controller := range detach {
+		cntlid := int(controller.Spec.GetNvmeControllerId())
+		err = s.detachNvmeNamespaceFromController(ctx, subsys.Spec.Nqn, cntlid, namespace)
+		if err != nil {
+			return err
+		}
+		undo.add("NS "+namespace.Name+" detach from "+controller.Name, func(ctx context.Context) error {
+			return s.attachNvmeNamespaceToController(ctx, subsys.Spec.Nqn, cntlid, namespace)
+		})
+	}
+	return s.setNvmeNamespaceAttachment(namespace.Name, desired)
+}
+
+// getNvmeNamespaceAndSubsystem fetches namespace and its subsystem from the
+// database
+func (s *Server) getNvmeNamespaceAndSubsystem(namespaceName string) (*pb.NvmeSubsystem, *pb.NvmeNamespace, error) {
+	namespace := new(pb.NvmeNamespace)
+	found, err := s.store.Get(namespaceName, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", namespaceName)
+		return nil, nil, err
+	}
+	subsysName := utils.ResourceIDToSubsystemName(
+		utils.GetSubsystemIDFromNvmeName(namespaceName),
+	)
+	subsys := new(pb.NvmeSubsystem)
+	found, err = s.store.Get(subsysName, subsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", subsysName)
+		return nil, nil, err
+	}
+	return subsys, namespace, nil
+}
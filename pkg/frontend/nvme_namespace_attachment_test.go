@@ -0,0 +1,323 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+var testSecondControllerName = utils.ResourceIDToControllerName(testSubsystemID, "controller-second")
+
+// seedTwoControllers stores the test subsystem with two controllers and the
+// test namespace attached to controllers
+func seedTwoControllers(s *Server, attachment *nvmeNamespaceAttachment) {
+	second := utils.ProtoClone(&testControllerWithStatus)
+	second.Name = testSecondControllerName
+	second.Spec.NvmeControllerId = proto.Int32(18)
+	_ = s.store.Set(testSubsystemName, &testSubsystemWithStatus)
+	_ = s.store.Set(testControllerName, &testControllerWithStatus)
+	_ = s.store.Set(second.Name, second)
+	_ = s.addToIndex(nvmeControllerIndex, testControllerName)
+	_ = s.addToIndex(nvmeControllerIndex, second.Name)
+	_ = s.store.Set(testNamespaceName, &testNamespaceWithStatus)
+	_ = s.addToIndex(nvmeNamespaceIndex, testNamespaceName)
+	if attachment != nil {
+		_ = s.setNvmeNamespaceAttachment(testNamespaceName, attachment)
+	}
+}
+
+// storedAttachment returns the attachment of the test namespace recorded by s
+func storedAttachment(t *testing.T, s *Server) ([]string, bool) {
+	t.Helper()
+	attachment, err := s.storedNvmeNamespaceAttachment(&testSubsystemWithStatus, testNamespaceName)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	return attachment.Controllers, attachment.Shared
+}
+
+func TestFrontEnd_NvmeNamespaceAttachment(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	otherController := utils.ResourceIDToControllerName("other-subsystem", "controller")
+	tests := map[string]struct {
+		attachment  *nvmeNamespaceAttachment
+		inactive    string
+		visibility  []string
+		spdk        []string
+		controllers []string
+		shared      bool
+		errCode     codes.Code
+		errMsg      string
+	}{
+		"hiding a shared namespace makes it private": {
+			attachment:  nil,
+			inactive:    "",
+			visibility:  []string{testControllerName},
+			spdk:        []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			controllers: []string{testControllerName},
+			shared:      false,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"unchanged private namespace": {
+			attachment:  &nvmeNamespaceAttachment{Controllers: []string{testControllerName}},
+			inactive:    "",
+			visibility:  []string{testControllerName},
+			spdk:        []string{},
+			controllers: []string{testControllerName},
+			shared:      false,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"attach a private namespace to another controller": {
+			attachment:  &nvmeNamespaceAttachment{Controllers: []string{testControllerName}},
+			inactive:    "",
+			visibility:  []string{testControllerName, testSecondControllerName},
+			spdk:        []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      false,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"move a private namespace to another controller": {
+			attachment: &nvmeNamespaceAttachment{Controllers: []string{testControllerName}},
+			inactive:   "",
+			visibility: []string{testSecondControllerName},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			controllers: []string{testSecondControllerName},
+			shared:      false,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"share a private namespace": {
+			attachment:  &nvmeNamespaceAttachment{Controllers: []string{testSecondControllerName}},
+			inactive:    "",
+			visibility:  []string{"*"},
+			spdk:        []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      true,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"inactive controllers are only recorded": {
+			attachment:  &nvmeNamespaceAttachment{Controllers: []string{testControllerName, testSecondControllerName}},
+			inactive:    testSecondControllerName,
+			visibility:  []string{testControllerName, testSecondControllerName},
+			spdk:        []string{},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      false,
+			errCode:     codes.OK,
+			errMsg:      "",
+		},
+		"failed attach keeps the namespace private": {
+			attachment:  &nvmeNamespaceAttachment{Controllers: []string{testControllerName}},
+			inactive:    "",
+			visibility:  []string{testControllerName, testSecondControllerName},
+			spdk:        []string{`{"id":%d,"error":{"code":0,"message":""},"result":false}`},
+			controllers: []string{testControllerName},
+			shared:      false,
+			errCode:     codes.InvalidArgument,
+			errMsg:      fmt.Sprintf("Could not create NS: %v", testNamespaceName),
+		},
+		"failed detach rolls back the attach": {
+			attachment: &nvmeNamespaceAttachment{Controllers: []string{testControllerName}},
+			inactive:   "",
+			visibility: []string{testSecondControllerName},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			controllers: []string{testControllerName},
+			shared:      false,
+			errCode:     codes.InvalidArgument,
+			errMsg:      fmt.Sprintf("Could not delete NS: %v", testNamespaceName),
+		},
+		"controller of another subsystem": {
+			attachment:  nil,
+			inactive:    "",
+			visibility:  []string{otherController},
+			spdk:        []string{},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      true,
+			errCode:     codes.InvalidArgument,
+			errMsg:      fmt.Sprintf("Namespace %s and controller %s belong to different subsystems", testNamespaceName, otherController),
+		},
+		"unknown controller": {
+			attachment:  nil,
+			inactive:    "",
+			visibility:  []string{testControllerName + "-unknown"},
+			spdk:        []string{},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      true,
+			errCode:     codes.NotFound,
+			errMsg:      fmt.Sprintf("unable to find key %s", testControllerName+"-unknown"),
+		},
+		"shared mixed with controllers": {
+			attachment:  nil,
+			inactive:    "",
+			visibility:  []string{"*", testControllerName},
+			spdk:        []string{},
+			controllers: []string{testSecondControllerName, testControllerName},
+			shared:      true,
+			errCode:     codes.InvalidArgument,
+			errMsg:      fmt.Sprintf("Invalid %s value %q, expected controller names or a single \"*\"", NvmeNamespaceVisibilityHeader, "*"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+			seedTwoControllers(testEnv.opiSpdkServer, tt.attachment)
+			if tt.inactive != "" {
+				controller := new(pb.NvmeController)
+				_, _ = testEnv.opiSpdkServer.store.Get(tt.inactive, controller)
+				controller.Status.Active = false
+				_ = testEnv.opiSpdkServer.store.Set(tt.inactive, controller)
+			}
+
+			ctx := testEnv.ctx
+			for _, value := range tt.visibility {
+				ctx = metadata.AppendToOutgoingContext(ctx, NvmeNamespaceVisibilityHeader, value)
+			}
+			_, err := testEnv.client.UpdateNvmeNamespace(ctx, &pb.UpdateNvmeNamespaceRequest{
+				NvmeNamespace: &pb.NvmeNamespace{Name: testNamespaceName, Spec: testNamespace.Spec},
+			})
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+
+			controllers, shared := storedAttachment(t, testEnv.opiSpdkServer)
+			if !reflect.DeepEqual(controllers, tt.controllers) {
+				t.Error("controllers: expected", tt.controllers, "received", controllers)
+			}
+			if shared != tt.shared {
+				t.Error("shared: expected", tt.shared, "received", shared)
+			}
+		})
+	}
+}
+
+func TestFrontEnd_CreatePrivateNvmeNamespace(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	tests := map[string]struct {
+		async bool
+	}{
+		"synchronous":  {async: false},
+		"asynchronous": {async: true},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment([]string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			})
+			defer testEnv.Close()
+			seedTwoControllers(testEnv.opiSpdkServer, nil)
+			_ = testEnv.opiSpdkServer.store.Delete(testNamespaceName)
+			_ = testEnv.opiSpdkServer.removeFromIndex(nvmeNamespaceIndex, testNamespaceName)
+
+			ctx := metadata.AppendToOutgoingContext(testEnv.ctx, NvmeNamespaceVisibilityHeader, testSecondControllerName)
+			if tt.async {
+				ctx = metadata.AppendToOutgoingContext(ctx, AsyncHeader, "true")
+			}
+			var header metadata.MD
+			_, err := testEnv.client.CreateNvmeNamespace(ctx, &pb.CreateNvmeNamespaceRequest{
+				Parent:          testSubsystemName,
+				NvmeNamespace:   &pb.NvmeNamespace{Spec: testNamespace.Spec},
+				NvmeNamespaceId: testNamespaceID,
+			}, grpc.Header(&header))
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if tt.async {
+				op := waitOperation(t, testEnv.client, operationName(t, header))
+				if op.GetError() != nil {
+					t.Fatal("unexpected error", op.GetError())
+				}
+			}
+
+			controllers, shared := storedAttachment(t, testEnv.opiSpdkServer)
+			if !reflect.DeepEqual(controllers, []string{testSecondControllerName}) || shared {
+				t.Error("namespace must be private to", testSecondControllerName, "received", controllers, shared)
+			}
+		})
+	}
+}
+
+func TestFrontEnd_NvmeNamespaceVisibility(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	testEnv := createTestEnvironment([]string{
+		`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17,"Namespaces":[{"nsid":11,"bdev":"Malloc0"},{"nsid":22,"bdev":"Malloc1"}]}}`,
+		`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf2","cntlid":18,"Namespaces":[{"nsid":22,"bdev":"Malloc1"},{"nsid":33,"bdev":"Malloc2"}]}}`,
+	})
+	defer testEnv.Close()
+	seedTwoControllers(testEnv.opiSpdkServer, nil)
+
+	var header metadata.MD
+	response, err := testEnv.client.ListNvmeNamespaces(testEnv.ctx,
+		&pb.ListNvmeNamespacesRequest{Parent: testSubsystemName}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(response.NvmeNamespaces) != 3 {
+		t.Error("namespaces: expected 3, received", response.NvmeNamespaces)
+	}
+	expected := []string{
+		fmt.Sprintf("%d=%s", 11, testControllerName),
+		fmt.Sprintf("%d=%s,%s", 22, testControllerName, testSecondControllerName),
+		fmt.Sprintf("%d=%s", 33, testSecondControllerName),
+	}
+	if received := header.Get(NvmeNamespaceControllersHeader); !reflect.DeepEqual(received, expected) {
+		t.Error("header: expected", expected, "received", received)
+	}
+}
+
+func TestFrontEnd_CreateNvmeControllerSkipsPrivateNamespaces(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	testEnv := createTestEnvironment([]string{
+		testEmulationFunctions,
+		`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf3","cntlid":19}}`,
+	})
+	defer testEnv.Close()
+	seedTwoControllers(testEnv.opiSpdkServer, &nvmeNamespaceAttachment{Controllers: []string{testControllerName}})
+
+	_, err := testEnv.client.CreateNvmeController(testEnv.ctx, &pb.CreateNvmeControllerRequest{
+		Parent:           testSubsystemName,
+		NvmeController:   &pb.NvmeController{Spec: utils.ProtoClone(testController.Spec)},
+		NvmeControllerId: "controller-third",
+	})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	controllers, shared := storedAttachment(t, testEnv.opiSpdkServer)
+	if !reflect.DeepEqual(controllers, []string{testControllerName}) || shared {
+		t.Error("private namespace must stay on", testControllerName, "received", controllers, shared)
+	}
+}
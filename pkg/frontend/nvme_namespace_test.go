@@ -8,16 +8,21 @@ package frontend
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 )
 
@@ -48,6 +53,7 @@ func TestFrontEnd_CreateNvmeNamespace(t *testing.T) {
 		errMsg  string
 		exist   bool
 		subsys  string
+		second  bool
 	}{
 		"illegal resource_id": {
 			id: "CapitalLettersNotAllowed",
@@ -134,6 +140,67 @@ func TestFrontEnd_CreateNvmeNamespace(t *testing.T) {
 			exist:   false,
 			subsys:  testSubsystemName,
 		},
+		"attached to every controller of the subsystem": {
+			id: testNamespaceID,
+			in: &pb.NvmeNamespace{
+				Spec: namespaceSpec,
+			},
+			out: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{
+					HostNsid:      22,
+					VolumeNameRef: "Malloc1",
+					Uuid:          "1b4e28ba-2fa1-11d2-883f-b9a761bde3fb",
+					Nguid:         "1b4e28ba-2fa1-11d2-883f-b9a761bde3fb",
+					Eui64:         1967554867335598546,
+				},
+				Status: &pb.NvmeNamespaceStatus{
+					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+					OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
+				},
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+			exist:   false,
+			subsys:  testSubsystemName,
+			second:  true,
+		},
+		"failed attach to second controller detaches from the first": {
+			id: testNamespaceID,
+			in: &pb.NvmeNamespace{
+				Spec: namespaceSpec,
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create NS: %v", testNamespaceName),
+			exist:   false,
+			subsys:  testSubsystemName,
+			second:  true,
+		},
+		"unknown volume": {
+			id: testNamespaceID,
+			in: &pb.NvmeNamespace{
+				Spec: &pb.NvmeNamespaceSpec{
+					HostNsid:      22,
+					VolumeNameRef: "unknown-volume",
+				},
+			},
+			out:     nil,
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find volume %v", "unknown-volume"),
+			exist:   false,
+			subsys:  testSubsystemName,
+		},
 		"already exists": {
 			id: testNamespaceID,
 			in: &pb.NvmeNamespace{
@@ -206,6 +273,14 @@ func TestFrontEnd_CreateNvmeNamespace(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
+			if tt.second {
+				controller := utils.ProtoClone(&testControllerWithStatus)
+				controller.Name = utils.ResourceIDToControllerName(testSubsystemID, "controller-second")
+				controller.Spec.NvmeControllerId = proto.Int32(18)
+				_ = testEnv.opiSpdkServer.store.Set(controller.Name, controller)
+				_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, controller.Name)
+			}
 			if tt.exist {
 				_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 			}
@@ -231,6 +306,13 @@ func TestFrontEnd_CreateNvmeNamespace(t *testing.T) {
 			} else {
 				t.Error("expected grpc error status")
 			}
+
+			if err == nil && !tt.exist {
+				users, _ := backend.VolumeUsers(testEnv.opiSpdkServer.store, tt.in.Spec.VolumeNameRef)
+				if !reflect.DeepEqual(users, []string{testNamespaceName}) {
+					t.Error("volume users: expected", testNamespaceName, "received", users)
+				}
+			}
 		})
 	}
 }
@@ -327,6 +409,7 @@ func TestFrontEnd_DeleteNvmeNamespace(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
 			request := &pb.DeleteNvmeNamespaceRequest{Name: tt.in, AllowMissing: tt.missing}
@@ -359,6 +442,7 @@ func TestFrontEnd_UpdateNvmeNamespace(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		missing bool
 	}{
 		"invalid fieldmask": {
 			mask: &fieldmaskpb.FieldMask{Paths: []string{"*", "author"}},
@@ -371,16 +455,85 @@ func TestFrontEnd_UpdateNvmeNamespace(t *testing.T) {
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("invalid field path: %s", "'*' must not be used with other paths"),
 		},
-		"unimplemented method": {
+		"valid request without changes": {
 			mask: nil,
 			in: &pb.NvmeNamespace{
 				Name: testNamespaceName,
 				Spec: testNamespace.Spec,
 			},
-			out:     nil,
+			out:     &testNamespaceWithStatus,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "UpdateNvmeNamespace"),
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with volume refresh": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.volume_name_ref"}},
+			in: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: testNamespace.Spec,
+			},
+			out: &testNamespaceWithStatus,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with volume change": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.volume_name_ref"}},
+			in: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{
+					VolumeNameRef: "Malloc2",
+				},
+			},
+			out: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{
+					HostNsid:      testNamespace.Spec.HostNsid,
+					VolumeNameRef: "Malloc2",
+				},
+				Status: testNamespaceWithStatus.Status,
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"volume change with invalid SPDK detach response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.volume_name_ref"}},
+			in: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{
+					VolumeNameRef: "Malloc2",
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not delete NS: %v", testNamespaceName),
+		},
+		"volume change with invalid SPDK attach response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.volume_name_ref"}},
+			in: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{
+					VolumeNameRef: "Malloc2",
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create NS: %v", testNamespaceName),
 		},
 		"valid request with unknown key": {
 			mask: nil,
@@ -393,6 +546,22 @@ func TestFrontEnd_UpdateNvmeNamespace(t *testing.T) {
 			errCode: codes.NotFound,
 			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToNamespaceName(testSubsystemID, "unknown-namespace-id")),
 		},
+		"unknown key with missing allowed": {
+			mask: nil,
+			in: &pb.NvmeNamespace{
+				Name: utils.ResourceIDToNamespaceName(testSubsystemID, "new-namespace-id"),
+				Spec: testNamespace.Spec,
+			},
+			out: &pb.NvmeNamespace{
+				Name:   utils.ResourceIDToNamespaceName(testSubsystemID, "new-namespace-id"),
+				Spec:   testNamespace.Spec,
+				Status: testNamespaceWithStatus.Status,
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			missing: true,
+		},
 		"malformed name": {
 			mask: nil,
 			in: &pb.NvmeNamespace{
@@ -414,9 +583,10 @@ func TestFrontEnd_UpdateNvmeNamespace(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
-			request := &pb.UpdateNvmeNamespaceRequest{NvmeNamespace: tt.in, UpdateMask: tt.mask}
+			request := &pb.UpdateNvmeNamespaceRequest{NvmeNamespace: tt.in, UpdateMask: tt.mask, AllowMissing: tt.missing}
 			response, err := testEnv.client.UpdateNvmeNamespace(testEnv.ctx, request)
 
 			if !proto.Equal(response, tt.out) {
@@ -439,6 +609,7 @@ func TestFrontEnd_UpdateNvmeNamespace(t *testing.T) {
 
 func TestFrontEnd_ListNvmeNamespaces(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	existingToken := encodePageToken(testSubsystemName+"/nvmeNamespaces", 1, time.Now())
 	tests := map[string]struct {
 		in      string
 		out     []*pb.NvmeNamespace
@@ -564,7 +735,7 @@ func TestFrontEnd_ListNvmeNamespaces(t *testing.T) {
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
-			token:   "existing-pagination-token",
+			token:   existingToken,
 		},
 		"valid request with valid SPDK response": {
 			in: testSubsystemName,
@@ -619,8 +790,8 @@ func TestFrontEnd_ListNvmeNamespaces(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
-			testEnv.opiSpdkServer.Pagination["existing-pagination-token"] = 1
 
 			request := &pb.ListNvmeNamespacesRequest{Parent: tt.in, PageSize: tt.size, PageToken: tt.token}
 			response, err := testEnv.client.ListNvmeNamespaces(testEnv.ctx, request)
@@ -657,12 +828,19 @@ func TestFrontEnd_GetNvmeNamespace(t *testing.T) {
 		errCode codes.Code
 		errMsg  string
 	}{
-		"valid request with invalid SPDK response": {
-			in:      testNamespaceName,
-			out:     nil,
+		"valid request with namespace missing from SPDK response": {
+			in: testNamespaceName,
+			out: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: testNamespaceWithStatus.Spec,
+				Status: &pb.NvmeNamespaceStatus{
+					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+					OperState: pb.NvmeNamespaceStatus_OPER_STATE_OFFLINE,
+				},
+			},
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"","cntlid":17,"Namespaces":null}}`},
-			errCode: codes.InvalidArgument,
-			errMsg:  fmt.Sprintf("Could not find HostNsid: %v", "22"),
+			errCode: codes.OK,
+			errMsg:  "",
 		},
 		"valid request with invalid marshal SPDK response": {
 			in:      testNamespaceName,
@@ -693,16 +871,8 @@ func TestFrontEnd_GetNvmeNamespace(t *testing.T) {
 			errMsg:  fmt.Sprintf("controller_nvme_namespace_list: %v", "json response error: myopierr"),
 		},
 		"valid request with valid SPDK response": {
-			in: testNamespaceName,
-			out: &pb.NvmeNamespace{
-				Spec: &pb.NvmeNamespaceSpec{
-					HostNsid: 22,
-				},
-				Status: &pb.NvmeNamespaceStatus{
-					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
-					OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
-				},
-			},
+			in:      testNamespaceName,
+			out:     &testNamespaceWithStatus,
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"name": "NvmeEmu0pf1", "cntlid": 1, "Namespaces": [{"nsid": 11, "bdev": "Malloc0", "bdev_type": "spdk", "qn": "", "protocol": ""},{"nsid": 22, "bdev": "Malloc1", "bdev_type": "spdk", "qn": "", "protocol": ""},{"nsid": 13, "bdev": "Malloc2", "bdev_type": "spdk", "qn": "", "protocol": ""}]}}`},
 			errCode: codes.OK,
 			errMsg:  "",
@@ -738,6 +908,7 @@ func TestFrontEnd_GetNvmeNamespace(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
 
 			request := &pb.GetNvmeNamespaceRequest{Name: tt.in}
@@ -763,45 +934,53 @@ func TestFrontEnd_GetNvmeNamespace(t *testing.T) {
 
 func TestFrontEnd_StatsNvmeNamespace(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	// cntlid 17 is testControllerName, 18 is secondController, 19 is not stored
+	secondController := utils.ProtoClone(&testControllerWithStatus)
+	secondController.Name = utils.ResourceIDToControllerName(testSubsystemID, "controller-test-2")
+	secondController.Spec.NvmeControllerId = proto.Int32(18)
+	controllers := `{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn":"nqn.2022-09.io.spdk:opi3","cntlid":17,"name":"NvmeEmu0pf1","emulation_manager":"mlx5_0","type":"nvme","pci_index":1,"pci_bdf":"ca:00.2"},{"subnqn":"nqn.2022-09.io.spdk:opi3","cntlid":18,"name":"NvmeEmu0pf2","emulation_manager":"mlx5_0","type":"nvme","pci_index":2,"pci_bdf":"ca:00.3"},{"subnqn":"nqn.2022-09.io.spdk:opi3","cntlid":19,"name":"NvmeEmu0pf3","emulation_manager":"mlx5_0","type":"nvme","pci_index":3,"pci_bdf":"ca:00.4"}]}`
+	iostat := `{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc1","read_ios":1,"write_ios":2,"flush_ios":3}]},{"name":"NvmeEmu0pf2","bdevs":[{"bdev_name":"Malloc1","read_ios":10,"write_ios":20,"flush_ios":30}]},{"name":"NvmeEmu0pf3","bdevs":[{"bdev_name":"Malloc1","read_ios":100,"write_ios":200,"flush_ios":300}]}]}}`
 	tests := map[string]struct {
-		in      string
-		out     *pb.VolumeStats
-		spdk    []string
-		errCode codes.Code
-		errMsg  string
+		in       string
+		out      *pb.VolumeStats
+		spdk     []string
+		errCode  codes.Code
+		errMsg   string
+		counters []string
+		private  bool
 	}{
 		"valid request with invalid SPDK response": {
 			in:      testNamespaceName,
 			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
+			spdk:    []string{controllers, `{"id":%d,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
 			errCode: codes.InvalidArgument,
 			errMsg:  fmt.Sprintf("Could not find BdevName: %v", "Malloc1"),
 		},
 		"valid request with invalid marshal SPDK response": {
 			in:      testNamespaceName,
 			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
+			spdk:    []string{controllers, `{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "json: cannot unmarshal array into Go value of type models.NvdaControllerNvmeStatsResult"),
 		},
 		"valid request with empty SPDK response": {
 			in:      testNamespaceName,
 			out:     nil,
-			spdk:    []string{""},
+			spdk:    []string{controllers, ""},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "EOF"),
 		},
 		"valid request with ID mismatch SPDK response": {
 			in:      testNamespaceName,
 			out:     nil,
-			spdk:    []string{`{"id":0,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
+			spdk:    []string{controllers, `{"id":0,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "json response ID mismatch"),
 		},
 		"valid request with error code from SPDK response": {
 			in:      testNamespaceName,
 			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":1,"message":"myopierr"}}`},
+			spdk:    []string{controllers, `{"id":%d,"error":{"code":1,"message":"myopierr"}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "json response error: myopierr"),
 		},
@@ -811,9 +990,64 @@ func TestFrontEnd_StatsNvmeNamespace(t *testing.T) {
 				ReadOpsCount:  12345,
 				WriteOpsCount: 54321,
 			},
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc0","read_ios":55,"completed_read_ios":55,"write_ios":33,"completed_write_ios":33,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0},{"bdev_name":"Malloc1","read_ios":12345,"completed_read_ios":12345,"write_ios":54321,"completed_write_ios":54321,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]}]}}`},
-			errCode: codes.OK,
-			errMsg:  "",
+			spdk:     []string{controllers, `{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc0","read_ios":55,"completed_read_ios":55,"write_ios":33,"completed_write_ios":33,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0},{"bdev_name":"Malloc1","read_ios":12345,"completed_read_ios":12345,"write_ios":54321,"completed_write_ios":54321,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]}]}}`},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"0", "0", "0", "0", "0"},
+		},
+		"valid request with full SPDK response": {
+			in: testNamespaceName,
+			out: &pb.VolumeStats{
+				ReadBytesCount:    6320640,
+				ReadOpsCount:      12345,
+				WriteBytesCount:   27812352,
+				WriteOpsCount:     54321,
+				UnmapBytesCount:   4096,
+				UnmapOpsCount:     1,
+				ReadLatencyTicks:  100,
+				WriteLatencyTicks: 200,
+				UnmapLatencyTicks: 300,
+			},
+			spdk:     []string{controllers, `{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc1","read_ios":12345,"completed_read_ios":12345,"write_ios":54321,"completed_write_ios":54321,"flush_ios":7,"completed_flush_ios":7,"err_read_ios":1,"err_write_ios":2,"err_flush_ios":3,"bytes_read":6320640,"bytes_written":27812352,"bytes_unmapped":4096,"num_unmap_ops":1,"read_latency_ticks":100,"write_latency_ticks":200,"unmap_latency_ticks":300,"queue_depth":4}]}]}}`},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"7", "1", "2", "3", "4"},
+		},
+		"valid request with counters above int32": {
+			in: testNamespaceName,
+			out: &pb.VolumeStats{
+				ReadBytesCount:  math.MaxInt32,
+				ReadOpsCount:    math.MaxInt32,
+				WriteBytesCount: math.MaxInt32,
+				WriteOpsCount:   54321,
+			},
+			spdk:     []string{controllers, `{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc1","read_ios":2147483648,"completed_read_ios":2147483648,"write_ios":54321,"completed_write_ios":54321,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0,"bytes_read":8796093022208,"bytes_written":18446744073709551615}]}]}}`},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"0", "0", "0", "0", "0"},
+		},
+		"valid request summed over attached controllers": {
+			in: testNamespaceName,
+			out: &pb.VolumeStats{
+				ReadOpsCount:  11,
+				WriteOpsCount: 22,
+			},
+			spdk:     []string{controllers, iostat},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"33", "0", "0", "0", "0"},
+		},
+		"valid request with private namespace": {
+			in: testNamespaceName,
+			out: &pb.VolumeStats{
+				ReadOpsCount:  1,
+				WriteOpsCount: 2,
+			},
+			spdk:     []string{controllers, iostat},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"3", "0", "0", "0", "0"},
+			private:  true,
 		},
 		"valid request with unknown key": {
 			in:      "unknown-namespace-id",
@@ -839,14 +1073,26 @@ func TestFrontEnd_StatsNvmeNamespace(t *testing.T) {
 
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
+			_ = testEnv.opiSpdkServer.store.Set(secondController.Name, secondController)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, secondController.Name)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			if tt.private {
+				_ = testEnv.opiSpdkServer.setNvmeNamespaceAttachment(testNamespaceName, &nvmeNamespaceAttachment{
+					Controllers: []string{testControllerName},
+				})
+			}
 
+			var header metadata.MD
 			request := &pb.StatsNvmeNamespaceRequest{Name: tt.in}
-			response, err := testEnv.client.StatsNvmeNamespace(testEnv.ctx, request)
+			response, err := testEnv.client.StatsNvmeNamespace(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response.GetStats(), tt.out) {
 				t.Error("response: expected", tt.out, "received", response.GetStats())
 			}
+			if counters := volumeCountersHeader(header); !reflect.DeepEqual(counters, tt.counters) {
+				t.Error("counters: expected", tt.counters, "received", counters)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -19,15 +19,26 @@ import (
 	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 
-	"github.com/google/uuid"
 	"go.einride.tech/aip/fieldbehavior"
 	"go.einride.tech/aip/fieldmask"
 	"go.einride.tech/aip/resourceid"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
+// nvmeSubsystemCollection identifies the listing of subsystems in page tokens
+const nvmeSubsystemCollection = "nvmeSubsystems"
+
+// NvmeSubsystemStatsControllersHeader is the gRPC response header reporting
+// the controllers whose counters StatsNvmeSubsystem summed up, one value per
+// controller. Controllers SNAP reports but the bridge does not know are given
+// by their SNAP name.
+const NvmeSubsystemStatsControllersHeader = "nvme-subsystem-stats-controllers"
+
 func sortNvmeSubsystems(subsystems []*pb.NvmeSubsystem) {
 	sort.Slice(subsystems, func(i int, j int) bool {
 		return subsystems[i].Spec.Nqn < subsystems[j].Spec.Nqn
@@ -35,7 +46,7 @@ func sortNvmeSubsystems(subsystems []*pb.NvmeSubsystem) {
 }
 
 // CreateNvmeSubsystem creates an Nvme Subsystem
-func (s *Server) CreateNvmeSubsystem(ctx context.Context, in *pb.CreateNvmeSubsystemRequest) (*pb.NvmeSubsystem, error) {
+func (s *Server) CreateNvmeSubsystem(ctx context.Context, in *pb.CreateNvmeSubsystemRequest) (_ *pb.NvmeSubsystem, err error) {
 	// check input correctness
 	if err := s.validateCreateNvmeSubsystemRequest(in); err != nil {
 		return nil, err
@@ -47,6 +58,21 @@ func (s *Server) CreateNvmeSubsystem(ctx context.Context, in *pb.CreateNvmeSubsy
 		resourceID = in.NvmeSubsystemId
 	}
 	in.NvmeSubsystem.Name = utils.ResourceIDToSubsystemName(resourceID)
+	if asyncRequested(ctx) {
+		// the operation creates the object under the name returned now
+		request := utils.ProtoClone(in)
+		request.NvmeSubsystemId = resourceID
+		err := s.startOperation(ctx, request, true, func(ctx context.Context) (proto.Message, error) {
+			return s.CreateNvmeSubsystem(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return in.NvmeSubsystem, nil
+	}
+	// the NQN lock keeps subsystems with different names from taking the same NQN
+	unlock := s.locks.Lock(in.NvmeSubsystem.Name, nqnKey(in.NvmeSubsystem.Spec.Nqn))
+	defer unlock()
 	// idempotent API when called with same key, should return same object
 	subsys := new(pb.NvmeSubsystem)
 	found, err := s.store.Get(in.NvmeSubsystem.Name, subsys)
@@ -58,28 +84,24 @@ func (s *Server) CreateNvmeSubsystem(ctx context.Context, in *pb.CreateNvmeSubsy
 		return subsys, nil
 	}
 	// check if another object exists with same NQN, it is not allowed
-	for nqn := range s.NQNs {
-		if in.NvmeSubsystem.Spec.Nqn == nqn {
-			msg := fmt.Sprintf("Could not create NQN: %s since object with same NQN already exists", nqn)
-			return nil, status.Errorf(codes.AlreadyExists, msg)
-		}
+	owner, err := s.getNqnOwner(in.NvmeSubsystem.Spec.Nqn)
+	if err != nil {
+		return nil, err
 	}
-	// not found, so create a new one
-	params := models.NvdaSubsystemNvmeCreateParams{
-		Nqn:          in.NvmeSubsystem.Spec.Nqn,
-		SerialNumber: in.NvmeSubsystem.Spec.SerialNumber,
-		ModelNumber:  in.NvmeSubsystem.Spec.ModelNumber,
+	if owner != "" && owner != in.NvmeSubsystem.Name {
+		msg := fmt.Sprintf("Could not create NQN: %s since object with same NQN already exists", in.NvmeSubsystem.Spec.Nqn)
+		return nil, status.Errorf(codes.AlreadyExists, msg)
 	}
-	var result models.NvdaSubsystemNvmeCreateResult
-	err = s.rpc.Call(ctx, "subsystem_nvme_create", &params, &result)
+	// not found, so create a new one
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.createNvmeSubsystemEmulation(ctx, in.NvmeSubsystem.Spec)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if !result {
-		msg := fmt.Sprintf("Could not create NQN: %s", in.NvmeSubsystem.Spec.Nqn)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
-	}
+	undo.add("NQN "+in.NvmeSubsystem.Spec.Nqn, func(ctx context.Context) error {
+		return s.deleteNvmeSubsystemEmulation(ctx, in.NvmeSubsystem.Spec.Nqn)
+	})
 	var ver spdk.GetVersionResult
 	err = s.rpc.Call(ctx, "spdk_get_version", nil, &ver)
 	if err != nil {
@@ -89,11 +111,31 @@ func (s *Server) CreateNvmeSubsystem(ctx context.Context, in *pb.CreateNvmeSubsy
 	response := utils.ProtoClone(in.NvmeSubsystem)
 	response.Status = &pb.NvmeSubsystemStatus{FirmwareRevision: ver.Version}
 	// save object to the database
-	s.NQNs[in.NvmeSubsystem.Spec.Nqn] = false
+	err = s.setNqnOwner(in.NvmeSubsystem.Spec.Nqn, in.NvmeSubsystem.Name)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("owner of NQN "+in.NvmeSubsystem.Spec.Nqn, func(context.Context) error {
+		return s.store.Delete(nqnKey(in.NvmeSubsystem.Spec.Nqn))
+	})
 	err = s.store.Set(in.NvmeSubsystem.Name, response)
 	if err != nil {
 		return nil, err
 	}
+	undo.add("record of "+in.NvmeSubsystem.Name, func(context.Context) error {
+		return s.store.Delete(in.NvmeSubsystem.Name)
+	})
+	err = s.setNvmeSubsystemHosts(in.NvmeSubsystem.Name, defaultNvmeSubsystemHosts(response.Spec))
+	if err != nil {
+		return nil, err
+	}
+	undo.add("hosts of "+in.NvmeSubsystem.Name, func(context.Context) error {
+		return s.store.Delete(nvmeSubsystemHostsKey(in.NvmeSubsystem.Name))
+	})
+	err = s.addToIndex(nvmeSubsystemIndex, in.NvmeSubsystem.Name)
+	if err != nil {
+		return nil, err
+	}
 	return response, nil
 }
 
@@ -103,6 +145,18 @@ func (s *Server) DeleteNvmeSubsystem(ctx context.Context, in *pb.DeleteNvmeSubsy
 	if err := s.validateDeleteNvmeSubsystemRequest(in); err != nil {
 		return nil, err
 	}
+	if asyncRequested(ctx) {
+		request := utils.ProtoClone(in)
+		err := s.startOperation(ctx, request, false, func(ctx context.Context) (proto.Message, error) {
+			return s.DeleteNvmeSubsystem(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+	unlock := s.lockNvme(in.Name)
+	defer unlock()
 	// fetch object from the database
 	subsys := new(pb.NvmeSubsystem)
 	found, err := s.store.Get(in.Name, subsys)
@@ -116,34 +170,46 @@ func (s *Server) DeleteNvmeSubsystem(ctx context.Context, in *pb.DeleteNvmeSubsy
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
 		return nil, err
 	}
-	params := models.NvdaSubsystemNvmeDeleteParams{
-		Nqn: subsys.Spec.Nqn,
+	// children have to be deleted first, so that no records are left dangling
+	if err := s.validateNvmeSubsystemUnused(subsys, "delete"); err != nil {
+		return nil, err
 	}
-	var result models.NvdaSubsystemNvmeDeleteResult
-	err = s.rpc.Call(ctx, "subsystem_nvme_delete", &params, &result)
+	err = s.deleteNvmeSubsystemEmulation(ctx, subsys.Spec.Nqn)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if !result {
-		msg := fmt.Sprintf("Could not delete NQN: %s", subsys.Spec.Nqn)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
-	}
 	// remove from the Database
-	delete(s.NQNs, subsys.Spec.Nqn)
 	err = s.store.Delete(subsys.Name)
 	if err != nil {
 		return nil, err
 	}
+	err = s.store.Delete(nqnKey(subsys.Spec.Nqn))
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.Delete(nvmeSubsystemHostsKey(subsys.Name))
+	if err != nil {
+		return nil, err
+	}
+	err = s.removeFromIndex(nvmeSubsystemIndex, subsys.Name)
+	if err != nil {
+		return nil, err
+	}
 	return &emptypb.Empty{}, nil
 }
 
 // UpdateNvmeSubsystem updates an Nvme Subsystem
-func (s *Server) UpdateNvmeSubsystem(_ context.Context, in *pb.UpdateNvmeSubsystemRequest) (*pb.NvmeSubsystem, error) {
+func (s *Server) UpdateNvmeSubsystem(ctx context.Context, in *pb.UpdateNvmeSubsystemRequest) (_ *pb.NvmeSubsystem, err error) {
 	// check input correctness
 	if err := s.validateUpdateNvmeSubsystemRequest(in); err != nil {
 		return nil, err
 	}
+	hostsChange, err := requestedNvmeSubsystemHostsChange(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockNvme(in.NvmeSubsystem.Name)
+	defer unlock()
 	// fetch object from the database
 	subsys := new(pb.NvmeSubsystem)
 	found, err := s.store.Get(in.NvmeSubsystem.Name, subsys)
@@ -152,18 +218,72 @@ func (s *Server) UpdateNvmeSubsystem(_ context.Context, in *pb.UpdateNvmeSubsyst
 	}
 	if !found {
 		if in.AllowMissing {
-			log.Printf("TODO: in case of AllowMissing, create a new resource, don;t return error")
+			// see https://google.aip.dev/134#create-or-update
+			log.Printf("NvmeSubsystem %v not found, creating it since AllowMissing is set", in.NvmeSubsystem.Name)
+			unlock()
+			return s.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+				NvmeSubsystem:   in.NvmeSubsystem,
+				NvmeSubsystemId: path.Base(in.NvmeSubsystem.Name),
+			})
 		}
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.NvmeSubsystem.Name)
 		return nil, err
 	}
-	resourceID := path.Base(subsys.Name)
 	// update_mask = 2
 	if err := fieldmask.Validate(in.UpdateMask, in.NvmeSubsystem); err != nil {
 		return nil, err
 	}
-	log.Printf("TODO: use resourceID=%v", resourceID)
-	return nil, status.Errorf(codes.Unimplemented, "UpdateNvmeSubsystem method is not implemented")
+	response := utils.ProtoClone(subsys)
+	fieldmask.Update(in.UpdateMask, response, in.NvmeSubsystem)
+	// name and status are not client settable
+	response.Name = subsys.Name
+	response.Status = subsys.Status
+	if response.Spec.Nqn != subsys.Spec.Nqn {
+		msg := fmt.Sprintf("Could not update NQN: %s, NQN can not be changed", subsys.Spec.Nqn)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	if err := s.validateNvmeSubsystemSpec(response.Spec); err != nil {
+		return nil, err
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	if nvmeSubsystemNeedsRecreate(subsys.Spec, response.Spec) {
+		err = s.recreateNvmeSubsystem(ctx, subsys, response.Spec)
+		if err != nil {
+			return nil, err
+		}
+		undo.add("NQN "+subsys.Spec.Nqn, func(ctx context.Context) error {
+			return s.replaceNvmeSubsystemEmulation(ctx, response.Spec, subsys.Spec)
+		})
+	}
+	if response.Spec.Hostnqn != subsys.Spec.Hostnqn || hostsChange != nil {
+		var hosts *nvmeSubsystemHosts
+		hosts, err = s.getNvmeSubsystemHosts(subsys)
+		if err != nil {
+			return nil, err
+		}
+		// registered first, as the allow-list may be left half replaced
+		undo.add("hosts of "+subsys.Name, func(ctx context.Context) error {
+			return s.restoreNvmeSubsystemHosts(ctx, subsys, hosts)
+		})
+		if response.Spec.Hostnqn != subsys.Spec.Hostnqn {
+			err = s.replaceNvmeSubsystemHostnqn(ctx, subsys, subsys.Spec.Hostnqn, response.Spec.Hostnqn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hostsChange != nil {
+			err = s.changeNvmeSubsystemHosts(ctx, subsys, hostsChange)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = s.store.Set(response.Name, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // ListNvmeSubsystems lists Nvme Subsystems
@@ -173,7 +293,7 @@ func (s *Server) ListNvmeSubsystems(ctx context.Context, in *pb.ListNvmeSubsyste
 		return nil, err
 	}
 	// fetch object from the database
-	size, offset, perr := utils.ExtractPagination(in.PageSize, in.PageToken, s.Pagination)
+	size, offset, perr := extractPagination(in.PageSize, in.PageToken, nvmeSubsystemCollection)
 	if perr != nil {
 		return nil, perr
 	}
@@ -183,20 +303,14 @@ func (s *Server) ListNvmeSubsystems(ctx context.Context, in *pb.ListNvmeSubsyste
 		return nil, err
 	}
 	log.Printf("Received from SPDK: %v", result)
-	token, hasMoreElements := "", false
-	log.Printf("Limiting result len(%d) to [%d:%d]", len(result), offset, size)
-	result, hasMoreElements = utils.LimitPagination(result, offset, size)
-	if hasMoreElements {
-		token = uuid.New().String()
-		s.Pagination[token] = offset + size
-	}
 	Blobarray := make([]*pb.NvmeSubsystem, len(result))
 	for i := range result {
 		r := &result[i]
 		Blobarray[i] = &pb.NvmeSubsystem{Spec: &pb.NvmeSubsystemSpec{Nqn: r.Nqn, SerialNumber: r.SerialNumber, ModelNumber: r.ModelNumber}}
 	}
 	sortNvmeSubsystems(Blobarray)
-	return &pb.ListNvmeSubsystemsResponse{NvmeSubsystems: Blobarray}, nil
+	Blobarray, token := limitPagination(Blobarray, offset, size, nvmeSubsystemCollection)
+	return &pb.ListNvmeSubsystemsResponse{NvmeSubsystems: Blobarray, NextPageToken: token}, nil
 }
 
 // GetNvmeSubsystem gets Nvme Subsystems
@@ -224,19 +338,198 @@ func (s *Server) GetNvmeSubsystem(ctx context.Context, in *pb.GetNvmeSubsystemRe
 	for i := range result {
 		r := &result[i]
 		if r.Nqn == subsys.Spec.Nqn {
-			return &pb.NvmeSubsystem{Spec: &pb.NvmeSubsystemSpec{Nqn: r.Nqn, SerialNumber: r.SerialNumber, ModelNumber: r.ModelNumber}, Status: &pb.NvmeSubsystemStatus{FirmwareRevision: "TBD"}}, nil
+			var ver spdk.GetVersionResult
+			err = s.rpc.Call(ctx, "spdk_get_version", nil, &ver)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Received from SPDK: %v", ver)
+			s.reportNvmeSubsystemHosts(ctx, subsys)
+			// the stored spec is what the client asked for, the status is
+			// what SNAP reports now
+			subsys.Status = &pb.NvmeSubsystemStatus{FirmwareRevision: ver.Version}
+			return subsys, nil
 		}
 	}
-	msg := fmt.Sprintf("Could not find NQN: %s", subsys.Spec.Nqn)
-	return nil, status.Errorf(codes.InvalidArgument, msg)
+	// not created in SNAP, there is no firmware to report
+	s.reportNvmeSubsystemHosts(ctx, subsys)
+	subsys.Status = &pb.NvmeSubsystemStatus{}
+	return subsys, nil
 }
 
 // StatsNvmeSubsystem gets Nvme Subsystem stats
-func (s *Server) StatsNvmeSubsystem(_ context.Context, in *pb.StatsNvmeSubsystemRequest) (*pb.StatsNvmeSubsystemResponse, error) {
+func (s *Server) StatsNvmeSubsystem(ctx context.Context, in *pb.StatsNvmeSubsystemRequest) (*pb.StatsNvmeSubsystemResponse, error) {
 	// check input correctness
 	if err := s.validateStatsNvmeSubsystemRequest(in); err != nil {
 		return nil, err
 	}
 	// fetch object from the database
-	return nil, status.Errorf(codes.Unimplemented, "UpdateNvmeSubsystem method is not implemented")
+	subsys := new(pb.NvmeSubsystem)
+	found, err := s.store.Get(in.Name, subsys)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
+		return nil, err
+	}
+	var result []models.NvdaControllerListResult
+	err = s.rpc.Call(ctx, "controller_list", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	controllers, err := s.storedNvmeControllers(subsys)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[int]string)
+	for _, controller := range controllers {
+		if controller.Spec.GetPcieId() != nil {
+			stored[int(controller.Spec.GetNvmeControllerId())] = controller.Name
+		}
+	}
+	// SNAP names of the controllers and the names they are reported by
+	names := make(map[string]bool)
+	reported := make(map[string]string)
+	for i := range result {
+		r := &result[i]
+		if r.Subnqn == subsys.Spec.Nqn && r.Type == "nvme" {
+			names[r.Name] = true
+			reported[r.Name] = r.Name
+			if name, ok := stored[r.Cntlid]; ok {
+				reported[r.Name] = name
+			}
+		}
+	}
+	stats, contributors, err := s.nvmeControllersStats(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Aggregated stats of NQN %s from controllers %v", subsys.Spec.Nqn, contributors)
+	values := make([]string, 0, 2*len(contributors))
+	for _, contributor := range contributors {
+		values = append(values, NvmeSubsystemStatsControllersHeader, reported[contributor])
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(values...)); err != nil {
+		log.Printf("Could not report stats controllers: %v", err)
+	}
+	return &pb.StatsNvmeSubsystemResponse{Stats: stats}, nil
+}
+
+// nvmeSubsystemNeedsRecreate reports whether the difference between two specs
+// has to be applied on the SNAP subsystem, which only takes these attributes at
+// creation time. Host NQN is on the allow-list kept by the bridge and is
+// updated in place.
+func nvmeSubsystemNeedsRecreate(current, desired *pb.NvmeSubsystemSpec) bool {
+	return current.SerialNumber != desired.SerialNumber ||
+		current.ModelNumber != desired.ModelNumber ||
+		current.MaxNamespaces != desired.MaxNamespaces
+}
+
+// recreateNvmeSubsystem replaces the SNAP subsystem of subsys with the one
+// described by spec. It is only safe while the subsystem has no controllers,
+// neither SNAP nor NVMe-oF ones, and no namespaces. The NVMe-oF subsystem is
+// never changed, SPDK fixes its serial number, model number and namespace
+// limit at creation, so the update is refused while it exists.
+func (s *Server) recreateNvmeSubsystem(ctx context.Context, subsys *pb.NvmeSubsystem, spec *pb.NvmeSubsystemSpec) error {
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil {
+		return err
+	}
+	if exported {
+		msg := fmt.Sprintf("Could not update NQN: %s, the serial number, model number and max namespaces of its NVMe-oF subsystem can not be changed, delete its fabrics controllers first", subsys.Spec.Nqn)
+		return status.Errorf(codes.FailedPrecondition, msg)
+	}
+	if err := s.validateNvmeSubsystemUnused(subsys, "update"); err != nil {
+		return err
+	}
+	// SNAP may know controllers the bridge does not
+	var result []models.NvdaSubsystemNvmeListResult
+	err = s.rpc.Call(ctx, "subsystem_nvme_list", nil, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	for i := range result {
+		r := &result[i]
+		if r.Nqn == spec.Nqn && len(r.Controllers) != 0 {
+			msg := fmt.Sprintf("Could not update NQN: %s, it has %d controllers attached", spec.Nqn, len(r.Controllers))
+			return status.Errorf(codes.FailedPrecondition, msg)
+		}
+	}
+	return s.replaceNvmeSubsystemEmulation(ctx, subsys.Spec, spec)
+}
+
+// replaceNvmeSubsystemEmulation replaces the SNAP subsystem described by
+// current with the one described by desired. If the new subsystem can not be
+// created, the original one is restored.
+func (s *Server) replaceNvmeSubsystemEmulation(ctx context.Context, current, desired *pb.NvmeSubsystemSpec) (err error) {
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.deleteNvmeSubsystemEmulation(ctx, current.Nqn)
+	if err != nil {
+		return err
+	}
+	undo.add("deletion of NQN "+current.Nqn, func(ctx context.Context) error {
+		return s.createNvmeSubsystemEmulation(ctx, current)
+	})
+	return s.createNvmeSubsystemEmulation(ctx, desired)
+}
+
+// validateNvmeSubsystemUnused fails when controllers or namespaces are
+// stored under subsys, action names what is refused in the message
+func (s *Server) validateNvmeSubsystemUnused(subsys *pb.NvmeSubsystem, action string) error {
+	controllers, err := s.storedNvmeControllers(subsys)
+	if err != nil {
+		return err
+	}
+	namespaces, err := s.nvmeSubsystemNamespaces(subsys)
+	if err != nil {
+		return err
+	}
+	if len(controllers) != 0 || len(namespaces) != 0 {
+		msg := fmt.Sprintf("Could not %s NQN: %s, it has %d controllers and %d namespaces", action, subsys.Spec.Nqn, len(controllers), len(namespaces))
+		return status.Errorf(codes.FailedPrecondition, msg)
+	}
+	return nil
+}
+
+// createNvmeSubsystemEmulation creates SNAP subsystem described by spec
+func (s *Server) createNvmeSubsystemEmulation(ctx context.Context, spec *pb.NvmeSubsystemSpec) error {
+	params := models.NvdaSubsystemNvmeCreateParams{
+		Nqn:           spec.Nqn,
+		SerialNumber:  spec.SerialNumber,
+		ModelNumber:   spec.ModelNumber,
+		MaxNamespaces: int(spec.MaxNamespaces),
+	}
+	var result models.NvdaSubsystemNvmeCreateResult
+	err := s.rpc.Call(ctx, "subsystem_nvme_create", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not create NQN: %s", spec.Nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// deleteNvmeSubsystemEmulation deletes SNAP subsystem nqn
+func (s *Server) deleteNvmeSubsystemEmulation(ctx context.Context, nqn string) error {
+	params := models.NvdaSubsystemNvmeDeleteParams{
+		Nqn: nqn,
+	}
+	var result models.NvdaSubsystemNvmeDeleteResult
+	err := s.rpc.Call(ctx, "subsystem_nvme_delete", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete NQN: %s", nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
 }
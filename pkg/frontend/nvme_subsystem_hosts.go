@@ -0,0 +1,378 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/opiproject/gospdk/spdk"
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NvmeSubsystemHostsHeader is the gRPC response header reporting the hosts
+// allowed to connect to the subsystem returned by GetNvmeSubsystem, one value
+// per host NQN or a single "*" value if any host is allowed
+const NvmeSubsystemHostsHeader = "nvme-subsystem-hosts"
+
+// NvmeSubsystemAllowHostHeader is the gRPC request metadata key of
+// UpdateNvmeSubsystem adding its values, host NQNs, to the allow-list
+const NvmeSubsystemAllowHostHeader = "nvme-subsystem-allow-host"
+
+// NvmeSubsystemDisallowHostHeader is the gRPC request metadata key of
+// UpdateNvmeSubsystem removing its values, host NQNs, from the allow-list.
+// Hosts which are already connected stay connected.
+const NvmeSubsystemDisallowHostHeader = "nvme-subsystem-disallow-host"
+
+// NvmeSubsystemAllowAnyHostHeader is the gRPC request metadata key of
+// UpdateNvmeSubsystem which, set to "true" or "false", sets whether any host,
+// not only the ones on the allow-list, may connect to the subsystem
+const NvmeSubsystemAllowAnyHostHeader = "nvme-subsystem-allow-any-host"
+
+// nvmeSubsystemHosts is the host NQN allow-list of a subsystem. It is
+// enforced by the NVMe-oF subsystem of fabrics exports, SNAP emulations have
+// no notion of a host NQN so for PCIe it is kept for auditing only.
+type nvmeSubsystemHosts struct {
+	AllowAnyHost bool
+	Hosts        []string
+}
+
+// allows reports whether hostnqn may connect, either because any host may or
+// because it is on the allow-list
+func (h *nvmeSubsystemHosts) allows(hostnqn string) bool {
+	return h.AllowAnyHost || h.lists(hostnqn)
+}
+
+// lists reports whether hostnqn is on the allow-list
+func (h *nvmeSubsystemHosts) lists(hostnqn string) bool {
+	for _, host := range h.Hosts {
+		if host == hostnqn {
+			return true
+		}
+	}
+	return false
+}
+
+// nvmeSubsystemHostsChange is a change of the allow-list requested by the
+// client
+type nvmeSubsystemHostsChange struct {
+	Allow    []string
+	Disallow []string
+	// AllowAnyHost is nil if the client did not set it
+	AllowAnyHost *bool
+}
+
+// requestedNvmeSubsystemHostsChange returns the change of the allow-list the
+// client set in the request metadata, or nil if it did not set any
+func requestedNvmeSubsystemHostsChange(ctx context.Context) (*nvmeSubsystemHostsChange, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	change := &nvmeSubsystemHostsChange{
+		Allow:    md.Get(NvmeSubsystemAllowHostHeader),
+		Disallow: md.Get(NvmeSubsystemDisallowHostHeader),
+	}
+	for _, hostnqns := range [][]string{change.Allow, change.Disallow} {
+		for _, hostnqn := range hostnqns {
+			if err := validateHostNqn(hostnqn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch values := md.Get(NvmeSubsystemAllowAnyHostHeader); {
+	case len(values) == 0:
+	case len(values) == 1 && (values[0] == "true" || values[0] == "false"):
+		allow := values[0] == "true"
+		change.AllowAnyHost = &allow
+	default:
+		msg := fmt.Sprintf("Invalid %s value %v, expected \"true\" or \"false\"", NvmeSubsystemAllowAnyHostHeader, values)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	if len(change.Allow) == 0 && len(change.Disallow) == 0 && change.AllowAnyHost == nil {
+		return nil, nil
+	}
+	return change, nil
+}
+
+// changeNvmeSubsystemHosts applies change to the allow-list of locked subsys
+func (s *Server) changeNvmeSubsystemHosts(ctx context.Context, subsys *pb.NvmeSubsystem, change *nvmeSubsystemHostsChange) error {
+	for _, hostnqn := range change.Disallow {
+		err := s.disallowNvmeSubsystemHost(ctx, subsys, hostnqn)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hostnqn := range change.Allow {
+		err := s.allowNvmeSubsystemHost(ctx, subsys, hostnqn)
+		if err != nil {
+			return err
+		}
+	}
+	if change.AllowAnyHost != nil {
+		return s.setNvmeSubsystemAllowAnyHost(ctx, subsys, *change.AllowAnyHost)
+	}
+	return nil
+}
+
+// nvmeSubsystemHostsKey returns the store key holding the allow-list of
+// subsystem name
+func nvmeSubsystemHostsKey(name string) string {
+	return "//storage.opiproject.org/hosts/" + name
+}
+
+// getNvmeSubsystemHosts returns the allow-list of subsys. Subsystems without
+// a recorded allow-list only allow their spec host NQN, or any host if there
+// is none.
+func (s *Server) getNvmeSubsystemHosts(subsys *pb.NvmeSubsystem) (*nvmeSubsystemHosts, error) {
+	value := new(structpb.Struct)
+	found, err := s.store.Get(nvmeSubsystemHostsKey(subsys.Name), value)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return defaultNvmeSubsystemHosts(subsys.Spec), nil
+	}
+	hosts := &nvmeSubsystemHosts{
+		AllowAnyHost: value.Fields["allow_any_host"].GetBoolValue(),
+	}
+	for _, v := range value.Fields["hosts"].GetListValue().GetValues() {
+		hosts.Hosts = append(hosts.Hosts, v.GetStringValue())
+	}
+	return hosts, nil
+}
+
+// setNvmeSubsystemHosts records the allow-list of subsystem name
+func (s *Server) setNvmeSubsystemHosts(name string, hosts *nvmeSubsystemHosts) error {
+	values := make([]*structpb.Value, 0, len(hosts.Hosts))
+	sort.Strings(hosts.Hosts)
+	for _, host := range hosts.Hosts {
+		values = append(values, structpb.NewStringValue(host))
+	}
+	value := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"allow_any_host": structpb.NewBoolValue(hosts.AllowAnyHost),
+		"hosts":          structpb.NewListValue(&structpb.ListValue{Values: values}),
+	}}
+	return s.store.Set(nvmeSubsystemHostsKey(name), value)
+}
+
+// defaultNvmeSubsystemHosts returns the allow-list of a new subsystem
+func defaultNvmeSubsystemHosts(spec *pb.NvmeSubsystemSpec) *nvmeSubsystemHosts {
+	if spec.Hostnqn == "" {
+		return &nvmeSubsystemHosts{AllowAnyHost: true}
+	}
+	return &nvmeSubsystemHosts{Hosts: []string{spec.Hostnqn}}
+}
+
+// allowNvmeSubsystemHost adds hostnqn to the allow-list of locked subsys
+func (s *Server) allowNvmeSubsystemHost(ctx context.Context, subsys *pb.NvmeSubsystem, hostnqn string) error {
+	hosts, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		return err
+	}
+	if hosts.lists(hostnqn) {
+		return nil
+	}
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil {
+		return err
+	}
+	if exported {
+		err = s.addNvmfHost(ctx, subsys.Spec.Nqn, hostnqn)
+		if err != nil {
+			return err
+		}
+	}
+	hosts.Hosts = append(hosts.Hosts, hostnqn)
+	return s.setNvmeSubsystemHosts(subsys.Name, hosts)
+}
+
+// disallowNvmeSubsystemHost removes hostnqn from the allow-list of locked
+// subsys
+func (s *Server) disallowNvmeSubsystemHost(ctx context.Context, subsys *pb.NvmeSubsystem, hostnqn string) error {
+	hosts, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		return err
+	}
+	if !hosts.lists(hostnqn) {
+		return nil
+	}
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil {
+		return err
+	}
+	if exported {
+		err = s.removeNvmfHost(ctx, subsys.Spec.Nqn, hostnqn)
+		if err != nil {
+			return err
+		}
+	}
+	remaining := hosts.Hosts[:0]
+	for _, host := range hosts.Hosts {
+		if host != hostnqn {
+			remaining = append(remaining, host)
+		}
+	}
+	hosts.Hosts = remaining
+	return s.setNvmeSubsystemHosts(subsys.Name, hosts)
+}
+
+// setNvmeSubsystemAllowAnyHost sets whether any host, not only the ones on
+// the allow-list, may connect to locked subsys
+func (s *Server) setNvmeSubsystemAllowAnyHost(ctx context.Context, subsys *pb.NvmeSubsystem, allow bool) error {
+	hosts, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		return err
+	}
+	if hosts.AllowAnyHost == allow {
+		return nil
+	}
+	exported, err := s.exportsNvmeFabrics(subsys)
+	if err != nil {
+		return err
+	}
+	if exported {
+		err = s.allowAnyNvmfHost(ctx, subsys.Spec.Nqn, allow)
+		if err != nil {
+			return err
+		}
+	}
+	hosts.AllowAnyHost = allow
+	return s.setNvmeSubsystemHosts(subsys.Name, hosts)
+}
+
+// replaceNvmeSubsystemHostnqn moves the allow-list entry of the spec host
+// NQN of locked subsys from current to desired. Setting a host NQN on a
+// subsystem which had none also stops allowing any host, as it would have
+// been created that way.
+func (s *Server) replaceNvmeSubsystemHostnqn(ctx context.Context, subsys *pb.NvmeSubsystem, current string, desired string) error {
+	if desired != "" {
+		err := s.allowNvmeSubsystemHost(ctx, subsys, desired)
+		if err != nil {
+			return err
+		}
+	}
+	if current == "" && desired != "" {
+		return s.setNvmeSubsystemAllowAnyHost(ctx, subsys, false)
+	}
+	if current != "" {
+		return s.disallowNvmeSubsystemHost(ctx, subsys, current)
+	}
+	return nil
+}
+
+// restoreNvmeSubsystemHosts brings the allow-list of locked subsys back to
+// the hosts it had before a failed change
+func (s *Server) restoreNvmeSubsystemHosts(ctx context.Context, subsys *pb.NvmeSubsystem, hosts *nvmeSubsystemHosts) error {
+	err := s.setNvmeSubsystemAllowAnyHost(ctx, subsys, hosts.AllowAnyHost)
+	if err != nil {
+		return err
+	}
+	current, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		return err
+	}
+	for _, host := range current.Hosts {
+		if !hosts.lists(host) {
+			err = s.disallowNvmeSubsystemHost(ctx, subsys, host)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, host := range hosts.Hosts {
+		if !current.lists(host) {
+			err = s.allowNvmeSubsystemHost(ctx, subsys, host)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reportNvmeSubsystemHosts sends the allow-list of subsys in the
+// NvmeSubsystemHostsHeader response header
+func (s *Server) reportNvmeSubsystemHosts(ctx context.Context, subsys *pb.NvmeSubsystem) {
+	hosts, err := s.getNvmeSubsystemHosts(subsys)
+	if err != nil {
+		log.Printf("Could not report subsystem hosts: %v", err)
+		return
+	}
+	values := []string{NvmeSubsystemHostsHeader, "*"}
+	if !hosts.AllowAnyHost {
+		values = make([]string, 0, 2*len(hosts.Hosts))
+		for _, host := range hosts.Hosts {
+			values = append(values, NvmeSubsystemHostsHeader, host)
+		}
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(values...)); err != nil {
+		log.Printf("Could not report subsystem hosts: %v", err)
+	}
+}
+
+// addNvmfHost allows hostnqn to connect to NVMe-oF subsystem nqn
+func (s *Server) addNvmfHost(ctx context.Context, nqn string, hostnqn string) error {
+	params := spdk.NvmfSubsystemAddHostParams{
+		Nqn:  nqn,
+		Host: hostnqn,
+	}
+	var result spdk.NvmfSubsystemAddHostResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_add_host", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not add host %s to NQN: %s", hostnqn, nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// removeNvmfHost stops hostnqn from connecting to NVMe-oF subsystem nqn
+func (s *Server) removeNvmfHost(ctx context.Context, nqn string, hostnqn string) error {
+	params := spdk.NvmfSubsystemAddHostParams{
+		Nqn:  nqn,
+		Host: hostnqn,
+	}
+	var result spdk.NvmfSubsystemAddHostResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_remove_host", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not remove host %s from NQN: %s", hostnqn, nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// allowAnyNvmfHost sets whether any host may connect to NVMe-oF subsystem nqn
+func (s *Server) allowAnyNvmfHost(ctx context.Context, nqn string, allow bool) error {
+	params := models.NvmfSubsystemAllowAnyHostParams{
+		Nqn:          nqn,
+		AllowAnyHost: allow,
+	}
+	var result models.NvmfSubsystemAllowAnyHostResult
+	err := s.rpc.Call(ctx, "nvmf_subsystem_allow_any_host", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not change allow any host of NQN: %s", nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
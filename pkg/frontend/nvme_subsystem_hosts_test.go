@@ -0,0 +1,362 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+)
+
+const (
+	testHostNqn      = "nqn.2014-08.org.nvmexpress:uuid:feb98abe-d51f-40c8-b348-2753f3571d3c"
+	testOtherHostNqn = "nqn.2014-08.org.nvmexpress:uuid:1b4e28ba-2fa1-11d2-883f-b9a761bde3fb"
+)
+
+func TestFrontEnd_NvmeSubsystemHosts(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	tests := map[string]struct {
+		hosts    *nvmeSubsystemHosts
+		fabrics  bool
+		name     string
+		md       []string
+		spdk     []string
+		expected []string
+		anyHost  bool
+		errCode  codes.Code
+		errMsg   string
+	}{
+		"allow a host of a PCIe subsystem": {
+			hosts:    &nvmeSubsystemHosts{},
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowHostHeader, testHostNqn},
+			spdk:     []string{},
+			expected: []string{testHostNqn},
+			anyHost:  false,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"allow a host of a fabrics subsystem": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testOtherHostNqn}},
+			fabrics:  true,
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowHostHeader, testHostNqn},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			expected: []string{testOtherHostNqn, testHostNqn},
+			anyHost:  false,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"failed allow keeps the allow-list": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testOtherHostNqn}},
+			fabrics:  true,
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowHostHeader, testHostNqn},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":false}`},
+			expected: []string{testOtherHostNqn},
+			anyHost:  false,
+			errCode:  codes.InvalidArgument,
+			errMsg:   fmt.Sprintf("Could not add host %s to NQN: %s", testHostNqn, testSubsystem.Spec.Nqn),
+		},
+		"allow an allowed host": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testHostNqn}},
+			fabrics:  true,
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowHostHeader, testHostNqn},
+			spdk:     []string{},
+			expected: []string{testHostNqn},
+			anyHost:  false,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"disallow a host of a fabrics subsystem": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testHostNqn, testOtherHostNqn}},
+			fabrics:  true,
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemDisallowHostHeader, testHostNqn},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			expected: []string{testOtherHostNqn},
+			anyHost:  false,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"replace a host of a fabrics subsystem": {
+			hosts:   &nvmeSubsystemHosts{Hosts: []string{testHostNqn}},
+			fabrics: true,
+			name:    testSubsystemName,
+			md: []string{
+				NvmeSubsystemDisallowHostHeader, testHostNqn,
+				NvmeSubsystemAllowHostHeader, testOtherHostNqn,
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			expected: []string{testOtherHostNqn},
+			anyHost:  false,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"allow any host of a fabrics subsystem": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testHostNqn}},
+			fabrics:  true,
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowAnyHostHeader, "true"},
+			spdk:     []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`},
+			expected: []string{testHostNqn},
+			anyHost:  true,
+			errCode:  codes.OK,
+			errMsg:   "",
+		},
+		"failed allow any host restores the allow-list": {
+			hosts:   &nvmeSubsystemHosts{Hosts: []string{testHostNqn}},
+			fabrics: true,
+			name:    testSubsystemName,
+			md: []string{
+				NvmeSubsystemAllowHostHeader, testOtherHostNqn,
+				NvmeSubsystemAllowAnyHostHeader, "true",
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			expected: []string{testHostNqn},
+			anyHost:  false,
+			errCode:  codes.InvalidArgument,
+			errMsg:   fmt.Sprintf("Could not change allow any host of NQN: %s", testSubsystem.Spec.Nqn),
+		},
+		"invalid allow any host value": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testHostNqn}},
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowAnyHostHeader, "yes"},
+			spdk:     []string{},
+			expected: []string{testHostNqn},
+			anyHost:  false,
+			errCode:  codes.InvalidArgument,
+			errMsg:   fmt.Sprintf("Invalid %s value [yes], expected \"true\" or \"false\"", NvmeSubsystemAllowAnyHostHeader),
+		},
+		"invalid host NQN": {
+			hosts:    &nvmeSubsystemHosts{AllowAnyHost: true},
+			name:     testSubsystemName,
+			md:       []string{NvmeSubsystemAllowHostHeader, "nqn.host"},
+			spdk:     []string{},
+			expected: nil,
+			anyHost:  true,
+			errCode:  codes.InvalidArgument,
+			errMsg:   fmt.Sprintf("Host NQN value (%s) does not match pattern", "nqn.host"),
+		},
+		"unknown subsystem": {
+			hosts:    &nvmeSubsystemHosts{AllowAnyHost: true},
+			name:     testSubsystemName + "-unknown",
+			md:       []string{NvmeSubsystemAllowHostHeader, testHostNqn},
+			spdk:     []string{},
+			expected: nil,
+			anyHost:  true,
+			errCode:  codes.NotFound,
+			errMsg:   fmt.Sprintf("unable to find key %s", testSubsystemName+"-unknown"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			server := testEnv.opiSpdkServer
+			_ = server.store.Set(testSubsystemName, &testSubsystemWithStatus)
+			_ = server.setNvmeSubsystemHosts(testSubsystemName, tt.hosts)
+			if tt.fabrics {
+				_ = server.store.Set(testFabricsControllerName, &testFabricsController)
+				_ = server.addToIndex(nvmeControllerIndex, testFabricsControllerName)
+			}
+
+			ctx := metadata.AppendToOutgoingContext(testEnv.ctx, tt.md...)
+			_, err := testEnv.client.UpdateNvmeSubsystem(ctx, &pb.UpdateNvmeSubsystemRequest{
+				NvmeSubsystem: &pb.NvmeSubsystem{Name: tt.name, Spec: testSubsystem.Spec},
+			})
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+
+			hosts, err := server.getNvmeSubsystemHosts(&testSubsystemWithStatus)
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if !reflect.DeepEqual(hosts.Hosts, tt.expected) {
+				t.Error("hosts: expected", tt.expected, "received", hosts.Hosts)
+			}
+			if hosts.AllowAnyHost != tt.anyHost {
+				t.Error("allow any host: expected", tt.anyHost, "received", hosts.AllowAnyHost)
+			}
+		})
+	}
+}
+
+func TestFrontEnd_NvmeSubsystemHostnqn(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	tests := map[string]struct {
+		fabrics      bool
+		spdk         []string
+		allowsOthers bool
+		errCode      codes.Code
+		errMsg       string
+	}{
+		"set the host NQN of a PCIe subsystem": {
+			spdk:         []string{},
+			allowsOthers: false,
+			errCode:      codes.OK,
+			errMsg:       "",
+		},
+		"set the host NQN of a fabrics subsystem": {
+			fabrics: true,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			allowsOthers: false,
+			errCode:      codes.OK,
+			errMsg:       "",
+		},
+		"failed allow any host change restores the allow-list": {
+			fabrics: true,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			allowsOthers: true,
+			errCode:      codes.InvalidArgument,
+			errMsg:       fmt.Sprintf("Could not change allow any host of NQN: %s", testSubsystem.Spec.Nqn),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			server := testEnv.opiSpdkServer
+			_ = server.store.Set(testSubsystemName, &testSubsystemWithStatus)
+			_ = server.setNvmeSubsystemHosts(testSubsystemName, defaultNvmeSubsystemHosts(testSubsystem.Spec))
+			if tt.fabrics {
+				_ = server.store.Set(testFabricsControllerName, &testFabricsController)
+				_ = server.addToIndex(nvmeControllerIndex, testFabricsControllerName)
+			}
+
+			_, err := testEnv.client.UpdateNvmeSubsystem(testEnv.ctx, &pb.UpdateNvmeSubsystemRequest{
+				NvmeSubsystem: &pb.NvmeSubsystem{
+					Name: testSubsystemName,
+					Spec: &pb.NvmeSubsystemSpec{
+						Nqn:     testSubsystem.Spec.Nqn,
+						Hostnqn: testHostNqn,
+					},
+				},
+			})
+
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+
+			hosts, err := server.getNvmeSubsystemHosts(&testSubsystemWithStatus)
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if !hosts.allows(testHostNqn) {
+				t.Error("hosts: expected", testHostNqn, "to be allowed, received", hosts)
+			}
+			if hosts.allows(testOtherHostNqn) != tt.allowsOthers {
+				t.Error("hosts: expected other hosts allowed", tt.allowsOthers, "received", hosts)
+			}
+		})
+	}
+}
+
+func TestFrontEnd_RestrictedNvmfSubsystem(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	testEnv := createTestEnvironment([]string{
+		`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+		`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+		`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+	})
+	defer testEnv.Close()
+	_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
+	_ = testEnv.opiSpdkServer.setNvmeSubsystemHosts(testSubsystemName, &nvmeSubsystemHosts{Hosts: []string{testHostNqn}})
+
+	_, err := testEnv.client.CreateNvmeController(testEnv.ctx, &pb.CreateNvmeControllerRequest{
+		Parent:           testSubsystemName,
+		NvmeController:   &pb.NvmeController{Spec: testFabricsController.Spec},
+		NvmeControllerId: testFabricsControllerID,
+	})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	hosts, _ := testEnv.opiSpdkServer.getNvmeSubsystemHosts(&testSubsystemWithStatus)
+	if !reflect.DeepEqual(hosts.Hosts, []string{testHostNqn}) || hosts.AllowAnyHost {
+		t.Error("hosts: expected", testHostNqn, "received", hosts)
+	}
+}
+
+func TestFrontEnd_NvmeSubsystemHostsHeader(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	tests := map[string]struct {
+		hosts    *nvmeSubsystemHosts
+		expected []string
+	}{
+		"any host": {
+			hosts:    &nvmeSubsystemHosts{AllowAnyHost: true, Hosts: []string{testHostNqn}},
+			expected: []string{"*"},
+		},
+		"allow-list": {
+			hosts:    &nvmeSubsystemHosts{Hosts: []string{testHostNqn, testOtherHostNqn}},
+			expected: []string{testOtherHostNqn, testHostNqn},
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment([]string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn":"nqn.2022-09.io.spdk:opi3","serial_number":"","model_number":"","controllers":[]}]}`,
+				`{"jsonrpc":"2.0","id":%d,"result":{"version":"SPDK v20.10","fields":{"major":20,"minor":10,"patch":0,"suffix":""}}}`,
+			})
+			defer testEnv.Close()
+			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
+			_ = testEnv.opiSpdkServer.setNvmeSubsystemHosts(testSubsystemName, tt.hosts)
+
+			var header metadata.MD
+			_, err := testEnv.client.GetNvmeSubsystem(testEnv.ctx,
+				&pb.GetNvmeSubsystemRequest{Name: testSubsystemName}, grpc.Header(&header))
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if hosts := header.Get(NvmeSubsystemHostsHeader); !reflect.DeepEqual(hosts, tt.expected) {
+				t.Error("hosts: expected", tt.expected, "received", hosts)
+			}
+		})
+	}
+}
@@ -11,8 +11,11 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -39,6 +42,7 @@ func TestFrontEnd_CreateNvmeSubsystem(t *testing.T) {
 		errCode codes.Code
 		errMsg  string
 		exist   bool
+		owner   string
 	}{
 		"illegal resource_id": {
 			id: "CapitalLettersNotAllowed",
@@ -100,12 +104,45 @@ func TestFrontEnd_CreateNvmeSubsystem(t *testing.T) {
 			in: &pb.NvmeSubsystem{
 				Spec: spec,
 			},
-			out:     nil,
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":true}`, `{"id":%d,"error":{"code":1,"message":"myopierr"},"result":false}`},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":1,"message":"myopierr"},"result":false}`,
+				// the created subsystem is deleted again
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("spdk_get_version: %v", "json response error: myopierr"),
 			exist:   false,
 		},
+		"invalid host NQN": {
+			id: testSubsystemID,
+			in: &pb.NvmeSubsystem{
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:     "nqn.2022-09.io.spdk:opi3",
+					Hostnqn: "nqn.host",
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Host NQN value (%s) does not match pattern", "nqn.host"),
+			exist:   false,
+		},
+		"PSK": {
+			id: testSubsystemID,
+			in: &pb.NvmeSubsystem{
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn: "nqn.2022-09.io.spdk:opi3",
+					Psk: []byte("NVMeTLSkey-1:01:MDAxMTIyMzM0NDU1NjY3Nzg4OTlhYWJiY2NkZGVlZmZwJEiQ:"),
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Psk is not supported, the NVMe-oF listeners of %s can not use a secure channel", "nqn.2022-09.io.spdk:opi3"),
+			exist:   false,
+		},
 		"valid request with valid SPDK response": {
 			id: testSubsystemID,
 			in: &pb.NvmeSubsystem{
@@ -139,6 +176,18 @@ func TestFrontEnd_CreateNvmeSubsystem(t *testing.T) {
 			errMsg:  "",
 			exist:   true,
 		},
+		"NQN owned by another subsystem": {
+			id: testSubsystemID,
+			in: &pb.NvmeSubsystem{
+				Spec: spec,
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.AlreadyExists,
+			errMsg:  fmt.Sprintf("Could not create NQN: %s since object with same NQN already exists", spec.Nqn),
+			exist:   false,
+			owner:   utils.ResourceIDToSubsystemName("other-subsystem"),
+		},
 		"no required field": {
 			id:      testControllerID,
 			in:      nil,
@@ -209,6 +258,9 @@ func TestFrontEnd_CreateNvmeSubsystem(t *testing.T) {
 			if tt.exist {
 				_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			}
+			if tt.owner != "" {
+				_ = testEnv.opiSpdkServer.setNqnOwner(spec.Nqn, tt.owner)
+			}
 			if tt.out != nil {
 				tt.out = utils.ProtoClone(tt.out)
 				tt.out.Name = testSubsystemName
@@ -238,12 +290,13 @@ func TestFrontEnd_CreateNvmeSubsystem(t *testing.T) {
 func TestFrontEnd_DeleteNvmeSubsystem(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
 	tests := map[string]struct {
-		in      string
-		out     *emptypb.Empty
-		spdk    []string
-		errCode codes.Code
-		errMsg  string
-		missing bool
+		in       string
+		out      *emptypb.Empty
+		spdk     []string
+		errCode  codes.Code
+		errMsg   string
+		missing  bool
+		children []string
 	}{
 		"valid request with invalid SPDK response": {
 			in:      testSubsystemName,
@@ -285,6 +338,24 @@ func TestFrontEnd_DeleteNvmeSubsystem(t *testing.T) {
 			errMsg:  "",
 			missing: false,
 		},
+		"subsystem with a controller": {
+			in:       testSubsystemName,
+			out:      nil,
+			spdk:     []string{},
+			errCode:  codes.FailedPrecondition,
+			errMsg:   fmt.Sprintf("Could not delete NQN: %v, it has 1 controllers and 0 namespaces", "nqn.2022-09.io.spdk:opi3"),
+			missing:  false,
+			children: []string{testControllerName},
+		},
+		"subsystem with a controller and a namespace": {
+			in:       testSubsystemName,
+			out:      nil,
+			spdk:     []string{},
+			errCode:  codes.FailedPrecondition,
+			errMsg:   fmt.Sprintf("Could not delete NQN: %v, it has 1 controllers and 1 namespaces", "nqn.2022-09.io.spdk:opi3"),
+			missing:  false,
+			children: []string{testControllerName, testNamespaceName},
+		},
 		"valid request with unknown key": {
 			in:      "unknown-subsystem-id",
 			out:     nil,
@@ -329,6 +400,13 @@ func TestFrontEnd_DeleteNvmeSubsystem(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			for _, child := range tt.children {
+				index := nvmeControllerIndex
+				if child == testNamespaceName {
+					index = nvmeNamespaceIndex
+				}
+				_ = testEnv.opiSpdkServer.addToIndex(index, child)
+			}
 
 			request := &pb.DeleteNvmeSubsystemRequest{Name: tt.in, AllowMissing: tt.missing}
 			response, err := testEnv.client.DeleteNvmeSubsystem(testEnv.ctx, request)
@@ -354,12 +432,14 @@ func TestFrontEnd_DeleteNvmeSubsystem(t *testing.T) {
 func TestFrontEnd_UpdateNvmeSubsystem(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
 	tests := map[string]struct {
-		mask    *fieldmaskpb.FieldMask
-		in      *pb.NvmeSubsystem
-		out     *pb.NvmeSubsystem
-		spdk    []string
-		errCode codes.Code
-		errMsg  string
+		mask     *fieldmaskpb.FieldMask
+		in       *pb.NvmeSubsystem
+		out      *pb.NvmeSubsystem
+		spdk     []string
+		errCode  codes.Code
+		errMsg   string
+		missing  bool
+		children []string
 	}{
 		"invalid fieldmask": {
 			mask: &fieldmaskpb.FieldMask{Paths: []string{"*", "author"}},
@@ -372,16 +452,154 @@ func TestFrontEnd_UpdateNvmeSubsystem(t *testing.T) {
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("invalid field path: %s", "'*' must not be used with other paths"),
 		},
-		"unimplemented method": {
+		"valid request without changes": {
 			mask: nil,
 			in: &pb.NvmeSubsystem{
 				Name: testSubsystemName,
 				Spec: testSubsystem.Spec,
 			},
+			out:     &testSubsystemWithStatus,
+			spdk:    []string{},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with in place change": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.hostnqn"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:     testSubsystem.Spec.Nqn,
+					Hostnqn: "nqn.2014-08.org.nvmexpress:uuid:feb98abe-d51f-40c8-b348-2753f3571d3c",
+				},
+			},
+			out: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:     testSubsystem.Spec.Nqn,
+					Hostnqn: "nqn.2014-08.org.nvmexpress:uuid:feb98abe-d51f-40c8-b348-2753f3571d3c",
+				},
+				Status: testSubsystemWithStatus.Status,
+			},
+			spdk:    []string{},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with recreate": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.model_number", "spec.serial_number"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:          testSubsystem.Spec.Nqn,
+					SerialNumber: "OpiSerialNumber",
+					ModelNumber:  "OpiModelNumber",
+				},
+			},
+			out: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:          testSubsystem.Spec.Nqn,
+					SerialNumber: "OpiSerialNumber",
+					ModelNumber:  "OpiModelNumber",
+				},
+				Status: testSubsystemWithStatus.Status,
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn":"nqn.2022-09.io.spdk:opi3","serial_number":"","model_number":"","controllers":[]}]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"recreate with attached controllers": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.model_number"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:         testSubsystem.Spec.Nqn,
+					ModelNumber: "OpiModelNumber",
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn":"nqn.2022-09.io.spdk:opi3","serial_number":"","model_number":"","controllers":[{"name":"NvmeEmu0pf1","cntlid":17,"pci_bdf":"ca:00.3","pci_index":1}]}]}`,
+			},
+			errCode: codes.FailedPrecondition,
+			errMsg:  fmt.Sprintf("Could not update NQN: %v, it has %d controllers attached", testSubsystem.Spec.Nqn, 1),
+		},
+		"recreate with a fabrics controller": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.model_number"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:         testSubsystem.Spec.Nqn,
+					ModelNumber: "OpiModelNumber",
+				},
+			},
+			out:      nil,
+			spdk:     []string{},
+			errCode:  codes.FailedPrecondition,
+			errMsg:   fmt.Sprintf("Could not update NQN: %v, the serial number, model number and max namespaces of its NVMe-oF subsystem can not be changed, delete its fabrics controllers first", testSubsystem.Spec.Nqn),
+			children: []string{testFabricsControllerName},
+		},
+		"recreate with a namespace": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.max_namespaces"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:           testSubsystem.Spec.Nqn,
+					MaxNamespaces: 4,
+				},
+			},
+			out:      nil,
+			spdk:     []string{},
+			errCode:  codes.FailedPrecondition,
+			errMsg:   fmt.Sprintf("Could not update NQN: %v, it has 0 controllers and 1 namespaces", testSubsystem.Spec.Nqn),
+			children: []string{testNamespaceName},
+		},
+		"recreate with invalid SPDK response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.model_number"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:         testSubsystem.Spec.Nqn,
+					ModelNumber: "OpiModelNumber",
+				},
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not delete NQN: %v", testSubsystem.Spec.Nqn),
+		},
+		"nqn change": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.nqn"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn: "nqn.2022-09.io.spdk:opi4",
+				},
+			},
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not update NQN: %v, NQN can not be changed", testSubsystem.Spec.Nqn),
+		},
+		"too long model number": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"spec.model_number"}},
+			in: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:         testSubsystem.Spec.Nqn,
+					ModelNumber: strings.Repeat("a", 41),
+				},
+			},
 			out:     nil,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "UpdateNvmeSubsystem"),
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("ModelNumber value (%s) is too long, have to be between 1 and 40", strings.Repeat("a", 41)),
 		},
 		"valid request with unknown key": {
 			mask: nil,
@@ -396,6 +614,31 @@ func TestFrontEnd_UpdateNvmeSubsystem(t *testing.T) {
 			errCode: codes.NotFound,
 			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToSubsystemName("unknown-subsystem-id")),
 		},
+		"unknown key with missing allowed": {
+			mask: nil,
+			in: &pb.NvmeSubsystem{
+				Name: utils.ResourceIDToSubsystemName("new-subsystem-id"),
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn: "nqn.2022-09.io.spdk:opi4",
+				},
+			},
+			out: &pb.NvmeSubsystem{
+				Name: utils.ResourceIDToSubsystemName("new-subsystem-id"),
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn: "nqn.2022-09.io.spdk:opi4",
+				},
+				Status: &pb.NvmeSubsystemStatus{
+					FirmwareRevision: "SPDK v20.10",
+				},
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"jsonrpc":"2.0","id":%d,"result":{"version":"SPDK v20.10","fields":{"major":20,"minor":10,"patch":0,"suffix":""}}}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+			missing: true,
+		},
 		"malformed name": {
 			mask: nil,
 			in: &pb.NvmeSubsystem{
@@ -418,8 +661,16 @@ func TestFrontEnd_UpdateNvmeSubsystem(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			_ = testEnv.opiSpdkServer.store.Set(testFabricsControllerName, &testFabricsController)
+			for _, child := range tt.children {
+				index := nvmeControllerIndex
+				if child == testNamespaceName {
+					index = nvmeNamespaceIndex
+				}
+				_ = testEnv.opiSpdkServer.addToIndex(index, child)
+			}
 
-			request := &pb.UpdateNvmeSubsystemRequest{NvmeSubsystem: tt.in, UpdateMask: tt.mask}
+			request := &pb.UpdateNvmeSubsystemRequest{NvmeSubsystem: tt.in, UpdateMask: tt.mask, AllowMissing: tt.missing}
 			response, err := testEnv.client.UpdateNvmeSubsystem(testEnv.ctx, request)
 
 			if !proto.Equal(response, tt.out) {
@@ -442,6 +693,7 @@ func TestFrontEnd_UpdateNvmeSubsystem(t *testing.T) {
 
 func TestFrontEnd_ListNvmeSubsystem(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	existingToken := encodePageToken(nvmeSubsystemCollection, 1, time.Now())
 	tests := map[string]struct {
 		out     []*pb.NvmeSubsystem
 		spdk    []string
@@ -559,7 +811,7 @@ func TestFrontEnd_ListNvmeSubsystem(t *testing.T) {
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
-			token:   "existing-pagination-token",
+			token:   existingToken,
 		},
 		"valid request with valid SPDK response": {
 			out: []*pb.NvmeSubsystem{
@@ -603,7 +855,6 @@ func TestFrontEnd_ListNvmeSubsystem(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
-			testEnv.opiSpdkServer.Pagination["existing-pagination-token"] = 1
 
 			request := &pb.ListNvmeSubsystemsRequest{PageSize: tt.size, PageToken: tt.token}
 			response, err := testEnv.client.ListNvmeSubsystems(testEnv.ctx, request)
@@ -640,12 +891,16 @@ func TestFrontEnd_GetNvmeSubsystem(t *testing.T) {
 		errCode codes.Code
 		errMsg  string
 	}{
-		"valid request with invalid SPDK response": {
-			in:      testSubsystemName,
-			out:     nil,
+		"valid request with subsystem missing from SPDK response": {
+			in: testSubsystemName,
+			out: &pb.NvmeSubsystem{
+				Name:   testSubsystemName,
+				Spec:   testSubsystemWithStatus.Spec,
+				Status: &pb.NvmeSubsystemStatus{},
+			},
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
-			errCode: codes.InvalidArgument,
-			errMsg:  fmt.Sprintf("Could not find NQN: %v", "nqn.2022-09.io.spdk:opi3"),
+			errCode: codes.OK,
+			errMsg:  "",
 		},
 		"valid request with empty SPDK response": {
 			in:      testSubsystemName,
@@ -670,21 +925,34 @@ func TestFrontEnd_GetNvmeSubsystem(t *testing.T) {
 		},
 		"valid request with valid SPDK response": {
 			in: testSubsystemName,
+			// the stored object with the firmware revision reported now
 			out: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
 				Spec: &pb.NvmeSubsystemSpec{
-					Nqn:          "nqn.2022-09.io.spdk:opi3",
-					SerialNumber: "OpiSerialNumber3",
-					ModelNumber:  "OpiModelNumber3",
+					Nqn: "nqn.2022-09.io.spdk:opi3",
 				},
 				Status: &pb.NvmeSubsystemStatus{
-					FirmwareRevision: "TBD",
+					FirmwareRevision: "SPDK v20.10",
 				},
 			},
 			// {'jsonrpc': '2.0', 'id': 1, 'result': [{'nqn': 'nqn.2020-12.mlnx.snap', 'serial_number': 'Mellanox_Nvme_SNAP', 'model_number': 'Mellanox Nvme SNAP Controller', 'controllers': [{'name': 'NvmeEmu0pf1', 'cntlid': 0, 'pci_bdf': 'ca:00.3', 'pci_index': 1}]}]}
-			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn": "nqn.2022-09.io.spdk:opi1", "serial_number": "OpiSerialNumber1", "model_number": "OpiModelNumber1"},{"nqn": "nqn.2022-09.io.spdk:opi2", "serial_number": "OpiSerialNumber2", "model_number": "OpiModelNumber2"},{"nqn": "nqn.2022-09.io.spdk:opi3", "serial_number": "OpiSerialNumber3", "model_number": "OpiModelNumber3"}]}`},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn": "nqn.2022-09.io.spdk:opi1", "serial_number": "OpiSerialNumber1", "model_number": "OpiModelNumber1"},{"nqn": "nqn.2022-09.io.spdk:opi2", "serial_number": "OpiSerialNumber2", "model_number": "OpiModelNumber2"},{"nqn": "nqn.2022-09.io.spdk:opi3", "serial_number": "OpiSerialNumber3", "model_number": "OpiModelNumber3"}]}`,
+				`{"jsonrpc":"2.0","id":%d,"result":{"version":"SPDK v20.10","fields":{"major":20,"minor":10,"patch":0,"suffix":""}}}`,
+			},
 			errCode: codes.OK,
 			errMsg:  "",
 		},
+		"valid request with error code from SPDK version response": {
+			in:  testSubsystemName,
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn": "nqn.2022-09.io.spdk:opi3", "serial_number": "OpiSerialNumber3", "model_number": "OpiModelNumber3"}]}`,
+				`{"id":%d,"error":{"code":1,"message":"myopierr"},"result":{}}`,
+			},
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("spdk_get_version: %v", "json response error: myopierr"),
+		},
 		"valid request with unknown key": {
 			in:      utils.ResourceIDToSubsystemName("unknown-subsystem-id"),
 			out:     nil,
@@ -747,13 +1015,56 @@ func TestFrontEnd_StatsNvmeSubsystem(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		// controllers are the reported contributing controllers
+		controllers []string
 	}{
-		"unimplemented method": {
+		"valid request with valid SPDK response": {
+			in: testSubsystemName,
+			out: &pb.StatsNvmeSubsystemResponse{Stats: &pb.VolumeStats{
+				ReadOpsCount:  12400,
+				WriteOpsCount: 54354,
+			}},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 17, "name": "NvmeEmu0pf1", "type": "nvme", "pci_index": 1, "pci_bdf": "ca:00.3"},{"subnqn": "nqn.2022-09.io.spdk:opi3", "cntlid": 2, "name": "NvmeEmu0pf2", "type": "nvme", "pci_index": 2, "pci_bdf": "ca:00.4"},{"subnqn": "nqn.2022-09.io.spdk:opi4", "cntlid": 1, "name": "NvmeEmu0pf3", "type": "nvme", "pci_index": 3, "pci_bdf": "ca:00.5"}]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[{"name":"NvmeEmu0pf1","bdevs":[{"bdev_name":"Malloc0","read_ios":55,"completed_read_ios":55,"write_ios":33,"completed_write_ios":33,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]},{"name":"NvmeEmu0pf2","bdevs":[{"bdev_name":"Malloc1","read_ios":12345,"completed_read_ios":12345,"write_ios":54321,"completed_write_ios":54321,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]},{"name":"NvmeEmu0pf3","bdevs":[{"bdev_name":"Malloc2","read_ios":1,"completed_read_ios":1,"write_ios":1,"completed_write_ios":1,"flush_ios":0,"completed_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]}]}}`,
+			},
+			errCode:     codes.OK,
+			errMsg:      "",
+			controllers: []string{testControllerName, "NvmeEmu0pf2"},
+		},
+		"valid request without controllers": {
+			in:  testSubsystemName,
+			out: &pb.StatsNvmeSubsystemResponse{Stats: &pb.VolumeStats{}},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result": {"controllers":[]}}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with error code from SPDK list response": {
 			in:      testSubsystemName,
 			out:     nil,
+			spdk:    []string{`{"id":%d,"error":{"code":1,"message":"myopierr"}}`},
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("controller_list: %v", "json response error: myopierr"),
+		},
+		"valid request with error code from SPDK iostat response": {
+			in:  testSubsystemName,
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":1,"message":"myopierr"}}`,
+			},
+			errCode: codes.Unknown,
+			errMsg:  fmt.Sprintf("controller_nvme_get_iostat: %v", "json response error: myopierr"),
+		},
+		"valid request with unknown key": {
+			in:      utils.ResourceIDToSubsystemName("unknown-subsystem-id"),
+			out:     nil,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "UpdateNvmeSubsystem"),
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToSubsystemName("unknown-subsystem-id")),
 		},
 		"malformed name": {
 			in:      "-ABC-DEF",
@@ -773,13 +1084,18 @@ func TestFrontEnd_StatsNvmeSubsystem(t *testing.T) {
 			_ = testEnv.opiSpdkServer.store.Set(testSubsystemName, &testSubsystemWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testControllerName, &testControllerWithStatus)
 			_ = testEnv.opiSpdkServer.store.Set(testNamespaceName, &testNamespaceWithStatus)
+			_ = testEnv.opiSpdkServer.addToIndex(nvmeControllerIndex, testControllerName)
 
 			request := &pb.StatsNvmeSubsystemRequest{Name: tt.in}
-			response, err := testEnv.client.StatsNvmeSubsystem(testEnv.ctx, request)
+			var header metadata.MD
+			response, err := testEnv.client.StatsNvmeSubsystem(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response, tt.out) {
 				t.Error("response: expected", tt.out, "received", response)
 			}
+			if controllers := header.Get(NvmeSubsystemStatsControllersHeader); !reflect.DeepEqual(controllers, tt.controllers) {
+				t.Error("controllers: expected", tt.controllers, "received", controllers)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -18,6 +18,9 @@ import (
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
 )
 
+// nqnRegexp is the pattern of subsystem and host NQNs
+var nqnRegexp = regexp.MustCompile(`^nqn\.[0-9]{4}-[0-9]{2}(\.[a-zA-Z0-9]+)+(:[a-zA-Z0-9-.]+)+$`)
+
 func (s *Server) validateCreateNvmeSubsystemRequest(in *pb.CreateNvmeSubsystemRequest) error {
 	// check required fields
 	if err := fieldbehavior.ValidateRequiredFields(in); err != nil {
@@ -29,28 +32,7 @@ func (s *Server) validateCreateNvmeSubsystemRequest(in *pb.CreateNvmeSubsystemRe
 			return err
 		}
 	}
-	// check Nqn length
-	if len(in.NvmeSubsystem.Spec.Nqn) > 223 {
-		msg := fmt.Sprintf("Nqn value (%s) is too long, have to be between 1 and 223", in.NvmeSubsystem.Spec.Nqn)
-		return status.Errorf(codes.InvalidArgument, msg)
-	}
-	// check SerialNumber length
-	if len(in.NvmeSubsystem.Spec.SerialNumber) > 20 {
-		msg := fmt.Sprintf("SerialNumber value (%s) is too long, have to be between 1 and 20", in.NvmeSubsystem.Spec.SerialNumber)
-		return status.Errorf(codes.InvalidArgument, msg)
-	}
-	// check ModelNumber length
-	if len(in.NvmeSubsystem.Spec.ModelNumber) > 40 {
-		msg := fmt.Sprintf("ModelNumber value (%s) is too long, have to be between 1 and 40", in.NvmeSubsystem.Spec.ModelNumber)
-		return status.Errorf(codes.InvalidArgument, msg)
-	}
-	// check if the NQN matches the pattern
-	regex := regexp.MustCompile(`^nqn\.[0-9]{4}-[0-9]{2}(\.[a-zA-Z0-9]+)+(:[a-zA-Z0-9-.]+)+$`)
-	if !regex.MatchString(in.NvmeSubsystem.Spec.Nqn) {
-		msg := fmt.Sprintf("NQN value (%s) does not match pattern", in.NvmeSubsystem.Spec.Nqn)
-		return status.Errorf(codes.InvalidArgument, msg)
-	}
-	return nil
+	return s.validateNvmeSubsystemSpec(in.NvmeSubsystem.Spec)
 }
 
 func (s *Server) validateDeleteNvmeSubsystemRequest(in *pb.DeleteNvmeSubsystemRequest) error {
@@ -88,3 +70,50 @@ func (s *Server) validateStatsNvmeSubsystemRequest(in *pb.StatsNvmeSubsystemRequ
 	// Validate that a resource name conforms to the restrictions outlined in AIP-122.
 	return resourcename.Validate(in.Name)
 }
+
+func (s *Server) validateNvmeSubsystemSpec(spec *pb.NvmeSubsystemSpec) error {
+	// check Nqn length
+	if len(spec.Nqn) > 223 {
+		msg := fmt.Sprintf("Nqn value (%s) is too long, have to be between 1 and 223", spec.Nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	// check SerialNumber length
+	if len(spec.SerialNumber) > 20 {
+		msg := fmt.Sprintf("SerialNumber value (%s) is too long, have to be between 1 and 20", spec.SerialNumber)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	// check ModelNumber length
+	if len(spec.ModelNumber) > 40 {
+		msg := fmt.Sprintf("ModelNumber value (%s) is too long, have to be between 1 and 40", spec.ModelNumber)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	// check if the NQN matches the pattern
+	if !nqnRegexp.MatchString(spec.Nqn) {
+		msg := fmt.Sprintf("NQN value (%s) does not match pattern", spec.Nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	// the PSK of NVMe/TCP secure channels is not passed to SPDK, a listener
+	// created for the subsystem would accept plain connections
+	if len(spec.Psk) > 0 {
+		msg := fmt.Sprintf("Psk is not supported, the NVMe-oF listeners of %s can not use a secure channel", spec.Nqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	if spec.Hostnqn != "" {
+		return validateHostNqn(spec.Hostnqn)
+	}
+	return nil
+}
+
+func validateHostNqn(hostnqn string) error {
+	// check Host NQN length
+	if len(hostnqn) > 223 {
+		msg := fmt.Sprintf("Host NQN value (%s) is too long, have to be between 1 and 223", hostnqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	// check if the Host NQN matches the pattern
+	if !nqnRegexp.MatchString(hostnqn) {
+		msg := fmt.Sprintf("Host NQN value (%s) does not match pattern", hostnqn)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"github.com/opiproject/gospdk/spdk"
+	"go.einride.tech/aip/resourceid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// AsyncHeader is the gRPC request metadata key which, set to "true", makes
+// Create and Delete RPCs return as soon as the request is validated. The change
+// is then carried out by a long-running operation, whose name is reported in
+// OperationHeader and which is polled with the Operations service.
+//
+// The RPCs deliberately keep their response types instead of returning the
+// Operation, which the OPI API does not allow: a Create returns the object it
+// is going to create, which does not exist until the operation is done, and a
+// Delete returns Empty. Clients have to read OperationHeader.
+const AsyncHeader = "async"
+
+// OperationHeader is the gRPC response header holding the name of the
+// long-running operation started by an asynchronous request
+const OperationHeader = "operation"
+
+// operationCollection identifies the listing of operations in page tokens and
+// is the parent of operation names
+const operationCollection = "operations"
+
+// operationPollInterval is how often WaitOperation checks operations run by
+// another server
+const operationPollInterval = 100 * time.Millisecond
+
+// defaultOperationRetention is how long done operations are kept before they
+// are deleted
+const defaultOperationRetention = 24 * time.Hour
+
+// operationLease is how long after its last renewal the lease of a server
+// running operations is valid. The unfinished operations of a server whose
+// lease expired are aborted, since it stopped before finishing them.
+const operationLease = 30 * time.Second
+
+// operationOwnerKey returns the store key holding the id of the server which
+// runs operation name
+func operationOwnerKey(name string) string {
+	return "//storage.opiproject.org/owners/" + name
+}
+
+// serverLeaseKey returns the store key holding the expiry time of the lease of
+// server id
+func serverLeaseKey(id string) string {
+	return "//storage.opiproject.org/servers/" + id
+}
+
+// runningOperation is an operation executed by this server
+type runningOperation struct {
+	// cancel is nil for operations which can not be cancelled
+	cancel context.CancelFunc
+	// done is closed once the result of the operation is stored
+	done chan struct{}
+}
+
+// cancellableKey marks the context of operations whose SNAP calls stop once
+// the operation is cancelled
+type cancellableKey struct{}
+
+// operationRPC refuses the SNAP calls of cancelled operations, as gospdk does
+// not interrupt calls whose context is done
+type operationRPC struct {
+	spdk.JSONRPC
+}
+
+func (r operationRPC) Call(ctx context.Context, method string, args, result any) error {
+	if ctx.Value(cancellableKey{}) != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return r.JSONRPC.Call(ctx, method, args, result)
+}
+
+// asyncRequested reports whether the client set AsyncHeader on the request
+func asyncRequested(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get(AsyncHeader) {
+		if value == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// startOperation stores a new operation for request, reports its name in
+// OperationHeader and runs fn in the background to complete it. Cancelling
+// the operation stops fn before its next SNAP call, so only operations whose
+// completed steps are rolled back on failure may be cancellable.
+func (s *Server) startOperation(ctx context.Context, request proto.Message, cancellable bool, fn func(ctx context.Context) (proto.Message, error)) (err error) {
+	requestAny, err := anypb.New(request)
+	if err != nil {
+		return err
+	}
+	op := &longrunningpb.Operation{
+		Name:     path.Join(operationCollection, resourceid.NewSystemGenerated()),
+		Metadata: requestAny,
+	}
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	// the lease is valid before the operation is seen, so that it is not
+	// taken for the operation of a stopped server
+	err = s.renewLease()
+	if err != nil {
+		return err
+	}
+	err = s.store.Set(operationOwnerKey(op.Name), wrapperspb.String(s.serverID))
+	if err != nil {
+		return err
+	}
+	undo.add("owner of "+op.Name, func(context.Context) error {
+		return s.store.Delete(operationOwnerKey(op.Name))
+	})
+	err = s.store.Set(op.Name, op)
+	if err != nil {
+		return err
+	}
+	undo.add("record of "+op.Name, func(context.Context) error {
+		return s.store.Delete(op.Name)
+	})
+	err = s.addToIndex(operationIndex, op.Name)
+	if err != nil {
+		return err
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(OperationHeader, op.Name)); err != nil {
+		log.Printf("Could not report operation: %v", err)
+	}
+
+	// the operation outlives the request and must not see its AsyncHeader
+	opCtx, cancel := context.WithCancel(context.Background())
+	running := &runningOperation{done: make(chan struct{})}
+	if cancellable {
+		opCtx = context.WithValue(opCtx, cancellableKey{}, true)
+		running.cancel = cancel
+	}
+	s.operationsMu.Lock()
+	s.operations[op.Name] = running
+	if !s.leaseRenewing {
+		s.leaseRenewing = true
+		go s.renewLeaseWhileRunning()
+	}
+	s.operationsMu.Unlock()
+	go func() {
+		defer cancel()
+		result, err := fn(opCtx)
+		if err != nil && cancellable && opCtx.Err() != nil {
+			msg := fmt.Sprintf("Operation %s was cancelled: %v", op.Name, err)
+			err = status.Errorf(codes.Canceled, msg)
+		}
+		s.finishOperation(op.Name, result, err)
+	}()
+	return nil
+}
+
+// finishOperation stores the result of operation name unless the operation
+// was deleted in the meantime
+func (s *Server) finishOperation(name string, result proto.Message, opErr error) {
+	defer func() {
+		s.operationsMu.Lock()
+		close(s.operations[name].done)
+		delete(s.operations, name)
+		s.expireOperation(name, s.operationRetention)
+		s.operationsMu.Unlock()
+	}()
+	unlock := s.locks.Lock(name)
+	defer unlock()
+	op := new(longrunningpb.Operation)
+	found, err := s.store.Get(name, op)
+	if err != nil {
+		log.Printf("Could not store the result of %s: %v", name, err)
+		return
+	}
+	if !found {
+		log.Printf("Dropping the result of deleted %s: %v", name, opErr)
+		return
+	}
+	if op.Done {
+		// aborted by another server, which took this one for stopped
+		log.Printf("Dropping the result of aborted %s: %v", name, opErr)
+		return
+	}
+	op.Done = true
+	if opErr != nil {
+		op.Result = &longrunningpb.Operation_Error{Error: status.Convert(opErr).Proto()}
+	} else {
+		response, err := anypb.New(result)
+		if err != nil {
+			op.Result = &longrunningpb.Operation_Error{Error: status.Convert(err).Proto()}
+		} else {
+			op.Result = &longrunningpb.Operation_Response{Response: response}
+		}
+	}
+	if err := s.store.Set(name, op); err != nil {
+		log.Printf("Could not store the result of %s: %v", name, err)
+	}
+}
+
+// renewLease extends the lease of this server by operationLease
+func (s *Server) renewLease() error {
+	expiry := timestamppb.New(time.Now().Add(operationLease))
+	return s.store.Set(serverLeaseKey(s.serverID), expiry)
+}
+
+// renewLeaseWhileRunning renews the lease of this server until it runs no
+// more operations
+func (s *Server) renewLeaseWhileRunning() {
+	ticker := time.NewTicker(operationLease / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.operationsMu.Lock()
+		if len(s.operations) == 0 {
+			s.leaseRenewing = false
+			s.operationsMu.Unlock()
+			return
+		}
+		s.operationsMu.Unlock()
+		if err := s.renewLease(); err != nil {
+			log.Printf("Could not renew the lease of %s: %v", s.serverID, err)
+		}
+	}
+}
+
+// operationOrphaned reports whether unfinished operation name was left by a
+// stopped server: its owner is not recorded or the lease of its owner expired.
+// The id of a server is generated when it starts, so the operations it owns
+// are never orphaned.
+func (s *Server) operationOrphaned(name string) (bool, error) {
+	owner := new(wrapperspb.StringValue)
+	found, err := s.store.Get(operationOwnerKey(name), owner)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return true, nil
+	}
+	if owner.Value == s.serverID {
+		return false, nil
+	}
+	expiry := new(timestamppb.Timestamp)
+	found, err = s.store.Get(serverLeaseKey(owner.Value), expiry)
+	if err != nil {
+		return false, err
+	}
+	return !found || time.Now().After(expiry.AsTime()), nil
+}
+
+// abortOrphanedOperation completes operation name with an Aborted error if it
+// was left unfinished by a stopped server and reports whether it did
+func (s *Server) abortOrphanedOperation(name string) (bool, error) {
+	unlock := s.locks.Lock(name)
+	defer unlock()
+	op := new(longrunningpb.Operation)
+	found, err := s.store.Get(name, op)
+	if err != nil || !found || op.Done {
+		return false, err
+	}
+	orphaned, err := s.operationOrphaned(name)
+	if err != nil || !orphaned {
+		return false, err
+	}
+	op.Done = true
+	op.Result = &longrunningpb.Operation_Error{
+		Error: status.Newf(codes.Aborted, "Operation %s was interrupted, the server running it stopped", name).Proto(),
+	}
+	err = s.store.Set(name, op)
+	if err != nil {
+		return false, err
+	}
+	s.operationsMu.Lock()
+	retention := s.operationRetention
+	s.operationsMu.Unlock()
+	s.expireOperation(name, retention)
+	return true, nil
+}
+
+// expireOperation deletes done operation name once retention is over
+func (s *Server) expireOperation(name string, retention time.Duration) {
+	time.AfterFunc(retention, func() {
+		unlock := s.locks.Lock(name)
+		defer unlock()
+		op := new(longrunningpb.Operation)
+		found, err := s.store.Get(name, op)
+		if err != nil {
+			log.Printf("Could not expire %s: %v", name, err)
+			return
+		}
+		if !found || !op.Done {
+			return
+		}
+		if err := s.deleteOperation(name); err != nil {
+			log.Printf("Could not expire %s: %v", name, err)
+		}
+	})
+}
+
+// deleteOperation deletes operation name from the database
+func (s *Server) deleteOperation(name string) error {
+	err := s.store.Delete(name)
+	if err != nil {
+		return err
+	}
+	err = s.store.Delete(operationOwnerKey(name))
+	if err != nil {
+		return err
+	}
+	return s.removeFromIndex(operationIndex, name)
+}
+
+// getOperation fetches operation name from the database
+func (s *Server) getOperation(name string) (*longrunningpb.Operation, error) {
+	op := new(longrunningpb.Operation)
+	found, err := s.store.Get(name, op)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", name)
+		return nil, err
+	}
+	return op, nil
+}
+
+// currentOperation fetches operation name from the database, aborting it
+// first if it was left unfinished by a stopped server
+func (s *Server) currentOperation(name string) (*longrunningpb.Operation, error) {
+	op, err := s.getOperation(name)
+	if err != nil || op.Done {
+		return op, err
+	}
+	aborted, err := s.abortOrphanedOperation(name)
+	if err != nil || !aborted {
+		return op, err
+	}
+	return s.getOperation(name)
+}
+
+// ListOperations lists the operations of asynchronous requests
+func (s *Server) ListOperations(_ context.Context, in *longrunningpb.ListOperationsRequest) (*longrunningpb.ListOperationsResponse, error) {
+	if in.Filter != "" {
+		msg := fmt.Sprintf("Filter %q is not supported", in.Filter)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	size, offset, perr := extractPagination(in.PageSize, in.PageToken, operationCollection)
+	if perr != nil {
+		return nil, perr
+	}
+	names, err := s.listIndex(operationIndex)
+	if err != nil {
+		return nil, err
+	}
+	names, token := limitPagination(names, offset, size, operationCollection)
+	Blobarray := make([]*longrunningpb.Operation, 0, len(names))
+	for _, name := range names {
+		op, err := s.currentOperation(name)
+		if err != nil {
+			return nil, err
+		}
+		Blobarray = append(Blobarray, op)
+	}
+	return &longrunningpb.ListOperationsResponse{Operations: Blobarray, NextPageToken: token}, nil
+}
+
+// GetOperation gets the latest state of an operation
+func (s *Server) GetOperation(_ context.Context, in *longrunningpb.GetOperationRequest) (*longrunningpb.Operation, error) {
+	return s.currentOperation(in.Name)
+}
+
+// DeleteOperation forgets an operation, it does not cancel it
+func (s *Server) DeleteOperation(_ context.Context, in *longrunningpb.DeleteOperationRequest) (*emptypb.Empty, error) {
+	unlock := s.locks.Lock(in.Name)
+	defer unlock()
+	if _, err := s.getOperation(in.Name); err != nil {
+		return nil, err
+	}
+	err := s.deleteOperation(in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// CancelOperation cancels an operation creating an object. The operation
+// stops before its next SNAP call, a call already in flight is not
+// interrupted, and rolls back what it has done. It then completes with a
+// Canceled error, unless it succeeded in the meantime. Deletions can not be
+// cancelled.
+func (s *Server) CancelOperation(_ context.Context, in *longrunningpb.CancelOperationRequest) (*emptypb.Empty, error) {
+	unlock := s.locks.Lock(in.Name)
+	defer unlock()
+	op, err := s.getOperation(in.Name)
+	if err != nil {
+		return nil, err
+	}
+	if op.Done {
+		return &emptypb.Empty{}, nil
+	}
+	s.operationsMu.Lock()
+	running, ok := s.operations[in.Name]
+	s.operationsMu.Unlock()
+	if !ok {
+		msg := fmt.Sprintf("Could not cancel %s, it is run by another server", in.Name)
+		return nil, status.Errorf(codes.FailedPrecondition, msg)
+	}
+	if running.cancel == nil {
+		msg := fmt.Sprintf("Could not cancel %s, deletions can not be cancelled", in.Name)
+		return nil, status.Errorf(codes.FailedPrecondition, msg)
+	}
+	running.cancel()
+	return &emptypb.Empty{}, nil
+}
+
+// WaitOperation waits until an operation is done or the timeout expires and
+// returns its latest state
+func (s *Server) WaitOperation(ctx context.Context, in *longrunningpb.WaitOperationRequest) (*longrunningpb.Operation, error) {
+	var timeout <-chan time.Time
+	if in.Timeout != nil {
+		if err := in.Timeout.CheckValid(); err != nil {
+			msg := fmt.Sprintf("Invalid timeout: %v", err)
+			return nil, status.Errorf(codes.InvalidArgument, msg)
+		}
+		timer := time.NewTimer(in.Timeout.AsDuration())
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		op, err := s.currentOperation(in.Name)
+		if err != nil || op.Done {
+			return op, err
+		}
+		// operations run by another server are polled
+		var done chan struct{}
+		s.operationsMu.Lock()
+		if running, ok := s.operations[in.Name]; ok {
+			done = running.done
+		}
+		s.operationsMu.Unlock()
+		select {
+		case <-done:
+		case <-time.After(operationPollInterval):
+		case <-timeout:
+			return op, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abortInterruptedOperations completes the operations which stopped servers,
+// such as a previous run of the bridge, left unfinished with an Aborted error.
+// The operations of servers whose lease is still valid are left to them, they
+// are aborted once looked at after the lease expired. The operations done
+// before the restart expire after a full retention period, their completion
+// time is not stored.
+func (s *Server) abortInterruptedOperations(report *ReconcileReport) error {
+	names, err := s.listIndex(operationIndex)
+	if err != nil {
+		return err
+	}
+	s.operationsMu.Lock()
+	retention := s.operationRetention
+	s.operationsMu.Unlock()
+	for _, name := range names {
+		op, err := s.getOperation(name)
+		if err != nil {
+			return err
+		}
+		if op.Done {
+			s.expireOperation(name, retention)
+			continue
+		}
+		aborted, err := s.abortOrphanedOperation(name)
+		if err != nil {
+			return err
+		}
+		if aborted {
+			report.Aborted = append(report.Aborted, name)
+		}
+	}
+	return nil
+}
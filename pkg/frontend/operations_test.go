@@ -0,0 +1,574 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+)
+
+// asyncContext returns a context requesting asynchronous Create and Delete RPCs
+func asyncContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), AsyncHeader, "true")
+}
+
+// operationName returns the operation reported in header
+func operationName(t *testing.T, header metadata.MD) string {
+	t.Helper()
+	names := header.Get(OperationHeader)
+	if len(names) != 1 {
+		t.Fatal("operation header: expected 1 value, received", names)
+	}
+	return names[0]
+}
+
+// waitOperation waits until operation name is done
+func waitOperation(t *testing.T, client *frontendClient, name string) *longrunningpb.Operation {
+	t.Helper()
+	op, err := client.WaitOperation(context.Background(), &longrunningpb.WaitOperationRequest{
+		Name:    name,
+		Timeout: durationpb.New(5 * time.Second),
+	})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !op.Done {
+		t.Fatal("operation", name, "is not done")
+	}
+	return op
+}
+
+// enteredCall waits until snap holds a mutating call at its gate
+func enteredCall(t *testing.T, snap *fakeSnap) string {
+	t.Helper()
+	select {
+	case method := <-snap.entered:
+		return method
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SNAP call reached the gate")
+		return ""
+	}
+}
+
+func TestFrontEnd_AsyncOperations(t *testing.T) {
+	controllerSpec := &pb.NvmeControllerSpec{
+		Endpoint: &pb.NvmeControllerSpec_PcieId{
+			PcieId: &pb.PciEndpoint{
+				PhysicalFunction: wrapperspb.Int32(0),
+				VirtualFunction:  wrapperspb.Int32(0),
+				PortId:           wrapperspb.Int32(0),
+			},
+		},
+		Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+	}
+
+	tests := map[string]struct {
+		call func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error)
+		// returned is the object returned by the RPC, before the operation is done
+		returned proto.Message
+		errCode  codes.Code
+		response proto.Message
+	}{
+		"create subsystem": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+					NvmeSubsystemId: "subsystem-async",
+					NvmeSubsystem: &pb.NvmeSubsystem{
+						Spec: &pb.NvmeSubsystemSpec{Nqn: "nqn.2022-09.io.spdk:async"},
+					},
+				}, opts...)
+			},
+			returned: &pb.NvmeSubsystem{
+				Name: "nvmeSubsystems/subsystem-async",
+				Spec: &pb.NvmeSubsystemSpec{Nqn: "nqn.2022-09.io.spdk:async"},
+			},
+			errCode: codes.OK,
+			response: &pb.NvmeSubsystem{
+				Name:   "nvmeSubsystems/subsystem-async",
+				Spec:   &pb.NvmeSubsystemSpec{Nqn: "nqn.2022-09.io.spdk:async"},
+				Status: &pb.NvmeSubsystemStatus{FirmwareRevision: "TBD"},
+			},
+		},
+		"delete subsystem": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.DeleteNvmeSubsystem(ctx, &pb.DeleteNvmeSubsystemRequest{Name: testSubsystemName}, opts...)
+			},
+			returned: &emptypb.Empty{},
+			errCode:  codes.OK,
+			response: &emptypb.Empty{},
+		},
+		"create controller": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           testSubsystemName,
+					NvmeControllerId: testControllerID,
+					NvmeController:   &pb.NvmeController{Spec: controllerSpec},
+				}, opts...)
+			},
+			returned: &pb.NvmeController{Name: testControllerName, Spec: controllerSpec},
+			errCode:  codes.OK,
+			response: &pb.NvmeController{
+				Name: testControllerName,
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint:         controllerSpec.Endpoint,
+					Trtype:           controllerSpec.Trtype,
+					NvmeControllerId: proto.Int32(1),
+				},
+				Status: &pb.NvmeControllerStatus{Active: true},
+			},
+		},
+		"create controller in missing subsystem": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+					Parent:           "nvmeSubsystems/unknown",
+					NvmeControllerId: testControllerID,
+					NvmeController:   &pb.NvmeController{Spec: controllerSpec},
+				}, opts...)
+			},
+			returned: &pb.NvmeController{
+				Name: "nvmeSubsystems/unknown/nvmeControllers/" + testControllerID,
+				Spec: controllerSpec,
+			},
+			errCode: codes.NotFound,
+		},
+		"delete missing controller": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.DeleteNvmeController(ctx, &pb.DeleteNvmeControllerRequest{Name: testControllerName}, opts...)
+			},
+			returned: &emptypb.Empty{},
+			errCode:  codes.Unknown,
+		},
+		"create namespace": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.CreateNvmeNamespace(ctx, &pb.CreateNvmeNamespaceRequest{
+					Parent:          testSubsystemName,
+					NvmeNamespaceId: testNamespaceID,
+					NvmeNamespace: &pb.NvmeNamespace{
+						Spec: &pb.NvmeNamespaceSpec{HostNsid: 1, VolumeNameRef: "Malloc1"},
+					},
+				}, opts...)
+			},
+			returned: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{HostNsid: 1, VolumeNameRef: "Malloc1"},
+			},
+			errCode: codes.OK,
+			response: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{HostNsid: 1, VolumeNameRef: "Malloc1"},
+				Status: &pb.NvmeNamespaceStatus{
+					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+					OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
+				},
+			},
+		},
+		"delete missing namespace": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.DeleteNvmeNamespace(ctx, &pb.DeleteNvmeNamespaceRequest{Name: testNamespaceName}, opts...)
+			},
+			returned: &emptypb.Empty{},
+			errCode:  codes.NotFound,
+		},
+		"create virtio-blk": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.CreateVirtioBlk(ctx, &pb.CreateVirtioBlkRequest{
+					VirtioBlkId: "virtio-blk-async",
+					VirtioBlk: &pb.VirtioBlk{
+						PcieId:        controllerSpec.GetPcieId(),
+						VolumeNameRef: "Malloc1",
+					},
+				}, opts...)
+			},
+			returned: &pb.VirtioBlk{
+				Name:          "volumes/virtio-blk-async",
+				PcieId:        controllerSpec.GetPcieId(),
+				VolumeNameRef: "Malloc1",
+			},
+			errCode: codes.OK,
+			response: &pb.VirtioBlk{
+				Name:          "volumes/virtio-blk-async",
+				PcieId:        controllerSpec.GetPcieId(),
+				VolumeNameRef: "Malloc1",
+			},
+		},
+		"delete missing virtio-blk": {
+			call: func(ctx context.Context, client *frontendClient, opts ...grpc.CallOption) (proto.Message, error) {
+				return client.DeleteVirtioBlk(ctx, &pb.DeleteVirtioBlkRequest{Name: "volumes/unknown"}, opts...)
+			},
+			returned: &emptypb.Empty{},
+			errCode:  codes.Unknown,
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, server, client := createConcurrentTestEnvironment(t)
+			if err := backend.RegisterVolume(server.store, "Malloc1", "Malloc1"); err != nil {
+				t.Fatal(err)
+			}
+			_, err := client.CreateNvmeSubsystem(context.Background(), &pb.CreateNvmeSubsystemRequest{
+				NvmeSubsystemId: testSubsystemID,
+				NvmeSubsystem:   &pb.NvmeSubsystem{Spec: testSubsystem.Spec},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var header metadata.MD
+			returned, err := tt.call(asyncContext(), client, grpc.Header(&header))
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if !proto.Equal(returned, tt.returned) {
+				t.Error("returned: expected", tt.returned, "received", returned)
+			}
+			op := waitOperation(t, client, operationName(t, header))
+
+			if code := codes.Code(op.GetError().GetCode()); code != tt.errCode {
+				t.Error("error code: expected", tt.errCode, "received", code, op.GetError().GetMessage())
+			}
+			if tt.response != nil {
+				response, err := op.GetResponse().UnmarshalNew()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(response, tt.response) {
+					t.Error("response: expected", tt.response, "received", response)
+				}
+			}
+			if op.Metadata == nil {
+				t.Error("metadata: expected the request, received none")
+			}
+		})
+	}
+}
+
+func TestFrontEnd_CancelOperation(t *testing.T) {
+	snap, _, client := createConcurrentTestEnvironment(t)
+	snap.gate = make(chan struct{}, 10)
+	snap.entered = make(chan string, 10)
+	ctx := context.Background()
+	request := &pb.CreateNvmeSubsystemRequest{
+		NvmeSubsystemId: testSubsystemID,
+		NvmeSubsystem:   &pb.NvmeSubsystem{Spec: testSubsystem.Spec},
+	}
+
+	// a create is stopped after its SNAP call in flight and rolled back
+	var header metadata.MD
+	_, err := client.CreateNvmeSubsystem(asyncContext(), request, grpc.Header(&header))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	name := operationName(t, header)
+	if method := enteredCall(t, snap); method != "subsystem_nvme_create" {
+		t.Fatal("SNAP call: expected subsystem_nvme_create, received", method)
+	}
+	_, err = client.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: name})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	// the create and its rollback
+	snap.gate <- struct{}{}
+	snap.gate <- struct{}{}
+	op := waitOperation(t, client, name)
+	if code := codes.Code(op.GetError().GetCode()); code != codes.Canceled {
+		t.Error("error code: expected", codes.Canceled, "received", code)
+	}
+	if len(snap.subsystems) != 0 {
+		t.Error("SNAP subsystems: expected none, received", snap.subsystems)
+	}
+	_, err = client.GetNvmeSubsystem(ctx, &pb.GetNvmeSubsystemRequest{Name: testSubsystemName})
+	if status.Code(err) != codes.NotFound {
+		t.Error("get cancelled subsystem: expected", codes.NotFound, "received", err)
+	}
+	// cancelling a done operation changes nothing
+	_, err = client.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: name})
+	if err != nil {
+		t.Error("unexpected error", err)
+	}
+	if again := waitOperation(t, client, name); !proto.Equal(again, op) {
+		t.Error("operation: expected", op, "received", again)
+	}
+
+	// deletions can not be cancelled
+	snap.gate <- struct{}{}
+	_, err = client.CreateNvmeSubsystem(ctx, request)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	enteredCall(t, snap)
+	_, err = client.DeleteNvmeSubsystem(asyncContext(),
+		&pb.DeleteNvmeSubsystemRequest{Name: testSubsystemName}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	name = operationName(t, header)
+	enteredCall(t, snap)
+	_, err = client.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: name})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Error("cancel deletion: expected", codes.FailedPrecondition, "received", err)
+	}
+	snap.gate <- struct{}{}
+	if op := waitOperation(t, client, name); op.GetError() != nil {
+		t.Error("deletion: expected success, received", op.GetError())
+	}
+	if len(snap.subsystems) != 0 {
+		t.Error("SNAP subsystems: expected none, received", snap.subsystems)
+	}
+
+	_, err = client.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: "operations/unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Error("cancel unknown operation: expected", codes.NotFound, "received", err)
+	}
+}
+
+func TestFrontEnd_CancelledOperationCleanup(t *testing.T) {
+	snap, server, client := createConcurrentTestEnvironment(t)
+	seedTwoControllers(server, nil)
+	_ = server.store.Delete(testNamespaceName)
+	_ = server.removeFromIndex(nvmeNamespaceIndex, testNamespaceName)
+	if err := backend.RegisterVolume(server.store, "Malloc1", "Malloc1"); err != nil {
+		t.Fatal(err)
+	}
+	snap.gate = make(chan struct{}, 10)
+	snap.entered = make(chan string, 10)
+
+	var header metadata.MD
+	_, err := client.CreateNvmeNamespace(asyncContext(), &pb.CreateNvmeNamespaceRequest{
+		Parent:          testSubsystemName,
+		NvmeNamespace:   &pb.NvmeNamespace{Spec: testNamespace.Spec},
+		NvmeNamespaceId: testNamespaceID,
+	}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	name := operationName(t, header)
+	if method := enteredCall(t, snap); method != "controller_nvme_namespace_attach" {
+		t.Fatal("SNAP call: expected controller_nvme_namespace_attach, received", method)
+	}
+	_, err = client.CancelOperation(context.Background(), &longrunningpb.CancelOperationRequest{Name: name})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	// the attach to the first controller and its cleanup, the attach to the
+	// second controller is refused
+	snap.gate <- struct{}{}
+	snap.gate <- struct{}{}
+	op := waitOperation(t, client, name)
+	if code := codes.Code(op.GetError().GetCode()); code != codes.Canceled {
+		t.Error("error code: expected", codes.Canceled, "received", code)
+	}
+	if len(snap.namespaces) != 0 {
+		t.Error("SNAP namespaces: expected none, received", snap.namespaces)
+	}
+}
+
+func TestFrontEnd_ListAndDeleteOperations(t *testing.T) {
+	_, _, client := createConcurrentTestEnvironment(t)
+	ctx := context.Background()
+
+	var names []string
+	for i := 0; i < 3; i++ {
+		var header metadata.MD
+		_, err := client.CreateNvmeSubsystem(asyncContext(), &pb.CreateNvmeSubsystemRequest{
+			NvmeSubsystemId: fmt.Sprintf("subsystem-%d", i),
+			NvmeSubsystem: &pb.NvmeSubsystem{
+				Spec: &pb.NvmeSubsystemSpec{Nqn: fmt.Sprintf("nqn.2022-09.io.spdk:opi%d", i)},
+			},
+		}, grpc.Header(&header))
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		names = append(names, operationName(t, header))
+	}
+	for _, name := range names {
+		waitOperation(t, client, name)
+	}
+
+	listed := func(pageSize int32, pageToken string) ([]string, string) {
+		t.Helper()
+		response, err := client.ListOperations(ctx, &longrunningpb.ListOperationsRequest{
+			PageSize:  pageSize,
+			PageToken: pageToken,
+		})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		var result []string
+		for _, op := range response.Operations {
+			if !op.Done {
+				t.Error("listed operation", op.Name, "is not done")
+			}
+			result = append(result, op.Name)
+		}
+		return result, response.NextPageToken
+	}
+	page, token := listed(2, "")
+	if len(page) != 2 || token == "" {
+		t.Error("first page: expected 2 operations and a token, received", page, token)
+	}
+	next, token := listed(2, token)
+	if len(next) != 1 || token != "" {
+		t.Error("second page: expected 1 operation and no token, received", next, token)
+	}
+	sort.Strings(names)
+	if all := append(page, next...); !reflect.DeepEqual(all, names) {
+		t.Error("listed operations: expected", names, "received", all)
+	}
+
+	_, err := client.ListOperations(ctx, &longrunningpb.ListOperationsRequest{Filter: "done=true"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Error("filter: expected", codes.InvalidArgument, "received", err)
+	}
+
+	_, err = client.DeleteOperation(ctx, &longrunningpb.DeleteOperationRequest{Name: names[0]})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = client.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: names[0]})
+	if status.Code(err) != codes.NotFound {
+		t.Error("get deleted operation: expected", codes.NotFound, "received", err)
+	}
+	if all, _ := listed(10, ""); !reflect.DeepEqual(all, names[1:]) {
+		t.Error("listed operations: expected", names[1:], "received", all)
+	}
+	_, err = client.DeleteOperation(ctx, &longrunningpb.DeleteOperationRequest{Name: names[0]})
+	if status.Code(err) != codes.NotFound {
+		t.Error("delete deleted operation: expected", codes.NotFound, "received", err)
+	}
+}
+
+func TestFrontEnd_OperationExpiry(t *testing.T) {
+	_, server, client := createConcurrentTestEnvironment(t)
+	server.operationsMu.Lock()
+	server.operationRetention = 10 * time.Millisecond
+	server.operationsMu.Unlock()
+
+	var header metadata.MD
+	_, err := client.CreateNvmeSubsystem(asyncContext(), &pb.CreateNvmeSubsystemRequest{
+		NvmeSubsystemId: testSubsystemID,
+		NvmeSubsystem:   &pb.NvmeSubsystem{Spec: testSubsystem.Spec},
+	}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	name := operationName(t, header)
+	waitOperation(t, client, name)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = client.GetOperation(context.Background(), &longrunningpb.GetOperationRequest{Name: name})
+		if status.Code(err) == codes.NotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("operation", name, "did not expire, received", err)
+		}
+		time.Sleep(operationPollInterval)
+	}
+	response, err := client.ListOperations(context.Background(), &longrunningpb.ListOperationsRequest{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(response.Operations) != 0 {
+		t.Error("operations: expected none, received", response.Operations)
+	}
+}
+
+func TestFrontEnd_AbortInterruptedOperations(t *testing.T) {
+	_, server, _ := createConcurrentTestEnvironment(t)
+	interrupted := &longrunningpb.Operation{Name: "operations/interrupted"}
+	done := &longrunningpb.Operation{
+		Name:   "operations/done",
+		Done:   true,
+		Result: &longrunningpb.Operation_Error{Error: status.New(codes.NotFound, "not found").Proto()},
+	}
+	// run by servers which are still running or which stopped
+	live := &longrunningpb.Operation{Name: "operations/live"}
+	stopped := &longrunningpb.Operation{Name: "operations/stopped"}
+	for _, op := range []*longrunningpb.Operation{interrupted, done, live, stopped} {
+		if err := server.store.Set(op.Name, op); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.addToIndex(operationIndex, op.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases := map[string]time.Time{
+		live.Name:    time.Now().Add(time.Hour),
+		stopped.Name: time.Now().Add(-time.Second),
+	}
+	for name, expiry := range leases {
+		owner := "server-" + path.Base(name)
+		if err := server.store.Set(operationOwnerKey(name), wrapperspb.String(owner)); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.store.Set(serverLeaseKey(owner), timestamppb.New(expiry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := &ReconcileReport{}
+	if err := server.abortInterruptedOperations(report); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if !reflect.DeepEqual(report.Aborted, []string{interrupted.Name, stopped.Name}) {
+		t.Error("aborted: expected", []string{interrupted.Name, stopped.Name}, "received", report.Aborted)
+	}
+	op, err := server.getOperation(live.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Done {
+		t.Error("operation of a running server: expected not done, received", op)
+	}
+	// once the lease of its server expires, the operation is aborted when
+	// it is looked at
+	if err := server.store.Set(serverLeaseKey("server-live"), timestamppb.New(time.Now().Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	op, err = server.GetOperation(context.Background(), &longrunningpb.GetOperationRequest{Name: live.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Done || codes.Code(op.GetError().GetCode()) != codes.Aborted {
+		t.Error("operation of a stopped server: expected aborted, received", op)
+	}
+	op, err = server.getOperation(interrupted.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Done || codes.Code(op.GetError().GetCode()) != codes.Aborted {
+		t.Error("interrupted operation: expected aborted, received", op)
+	}
+	op, err = server.getOperation(done.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(op, done) {
+		t.Error("done operation: expected", done, "received", op)
+	}
+}
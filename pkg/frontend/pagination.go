@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PageTokenTTL is how long a page token returned by a List RPC can be used to
+// fetch the following page
+const PageTokenTTL = time.Hour
+
+// Page tokens carry everything needed to resume a listing, so they need no
+// server side state: they can be used concurrently and after a restart of the
+// bridge.
+
+// pageToken is the decoded content of an opaque page token
+type pageToken struct {
+	// Collection is the listed collection, the parent for nested resources
+	Collection string `json:"c"`
+	Offset     int    `json:"o"`
+	// Expires is the unix time after which the token is rejected
+	Expires int64 `json:"e"`
+}
+
+// encodePageToken returns the page token resuming the listing of collection
+// at offset
+func encodePageToken(collection string, offset int, now time.Time) string {
+	data, err := json.Marshal(&pageToken{
+		Collection: collection,
+		Offset:     offset,
+		Expires:    now.Add(PageTokenTTL).Unix(),
+	})
+	if err != nil {
+		log.Panicf("Could not encode page token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken returns the offset stored in token issued for collection
+func decodePageToken(token string, collection string, now time.Time) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	decoded := new(pageToken)
+	if err == nil {
+		err = json.Unmarshal(data, decoded)
+	}
+	if err != nil || decoded.Offset < 0 {
+		return -1, status.Errorf(codes.NotFound, "unable to find pagination token %s", token)
+	}
+	if decoded.Collection != collection {
+		msg := fmt.Sprintf("pagination token %s was not issued for %s", token, collection)
+		return -1, status.Errorf(codes.InvalidArgument, msg)
+	}
+	if now.Unix() > decoded.Expires {
+		msg := fmt.Sprintf("pagination token %s has expired", token)
+		return -1, status.Errorf(codes.InvalidArgument, msg)
+	}
+	return decoded.Offset, nil
+}
+
+// extractPagination returns the page size and the offset requested by a List
+// RPC of collection
+func extractPagination(pageSize int32, pageToken string, collection string) (size int, offset int, err error) {
+	size, _, err = utils.ExtractPagination(pageSize, "", nil)
+	if err != nil {
+		return -1, -1, err
+	}
+	if pageToken == "" {
+		return size, 0, nil
+	}
+	offset, err = decodePageToken(pageToken, collection, time.Now())
+	if err != nil {
+		return -1, -1, err
+	}
+	log.Printf("Found offset %d from pagination token: %s", offset, pageToken)
+	return size, offset, nil
+}
+
+// limitPagination returns the page of result at offset and the token of the
+// following page, which is empty for the last page. result has to be filtered
+// and sorted for offsets to be stable between requests.
+func limitPagination[T any](result []T, offset int, size int, collection string) ([]T, string) {
+	log.Printf("Limiting result len(%d) to [%d:%d]", len(result), offset, size)
+	// objects might have been deleted since the token was issued
+	if offset > len(result) {
+		offset = len(result)
+	}
+	page, hasMoreElements := utils.LimitPagination(result, offset, size)
+	if !hasMoreElements {
+		return page, ""
+	}
+	return page, encodePageToken(collection, offset+size, time.Now())
+}
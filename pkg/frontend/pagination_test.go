@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFrontEnd_PageToken(t *testing.T) {
+	now := time.Now()
+	valid := encodePageToken(nvmeSubsystemCollection, 7, now)
+	tests := map[string]struct {
+		token   string
+		now     time.Time
+		offset  int
+		errCode codes.Code
+		errMsg  string
+	}{
+		"valid token": {
+			token:   valid,
+			now:     now,
+			offset:  7,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"token used after a restart": {
+			token:   valid,
+			now:     now.Add(PageTokenTTL - time.Minute),
+			offset:  7,
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"expired token": {
+			token:   valid,
+			now:     now.Add(PageTokenTTL + time.Minute),
+			offset:  -1,
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("pagination token %s has expired", valid),
+		},
+		"token of another collection": {
+			token:   encodePageToken(virtioBlkCollection, 7, now),
+			now:     now,
+			offset:  -1,
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("pagination token %s was not issued for %s", encodePageToken(virtioBlkCollection, 7, now), nvmeSubsystemCollection),
+		},
+		"malformed token": {
+			token:   "unknown-pagination-token",
+			now:     now,
+			offset:  -1,
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find pagination token %s", "unknown-pagination-token"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			offset, err := decodePageToken(tt.token, nvmeSubsystemCollection, tt.now)
+
+			if offset != tt.offset {
+				t.Error("offset: expected", tt.offset, "received", offset)
+			}
+			if er, ok := status.FromError(err); ok {
+				if er.Code() != tt.errCode {
+					t.Error("error code: expected", tt.errCode, "received", er.Code())
+				}
+				if er.Message() != tt.errMsg {
+					t.Error("error message: expected", tt.errMsg, "received", er.Message())
+				}
+			} else {
+				t.Error("expected grpc error status")
+			}
+		})
+	}
+}
+
+func TestFrontEnd_LimitPagination(t *testing.T) {
+	tests := map[string]struct {
+		offset int
+		size   int
+		page   []int
+		next   bool
+	}{
+		"first page": {
+			offset: 0,
+			size:   2,
+			page:   []int{1, 2},
+			next:   true,
+		},
+		"last page": {
+			offset: 2,
+			size:   2,
+			page:   []int{3},
+			next:   false,
+		},
+		"offset past the end after deletions": {
+			offset: 5,
+			size:   2,
+			page:   []int{},
+			next:   false,
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			page, token := limitPagination([]int{1, 2, 3}, tt.offset, tt.size, nvmeSubsystemCollection)
+
+			if !reflect.DeepEqual(page, tt.page) {
+				t.Error("page: expected", tt.page, "received", page)
+			}
+			if (token != "") != tt.next {
+				t.Error("next page token: expected", tt.next, "received", token)
+			}
+			if tt.next {
+				offset, err := decodePageToken(token, nvmeSubsystemCollection, time.Now())
+				if err != nil || offset != tt.offset+tt.size {
+					t.Error("next offset: expected", tt.offset+tt.size, "received", offset, err)
+				}
+			}
+		})
+	}
+}
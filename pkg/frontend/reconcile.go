@@ -0,0 +1,530 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+
+	"go.einride.tech/aip/resourceid"
+	"google.golang.org/protobuf/proto"
+)
+
+// ReconcilePolicy defines how differences between the store and SNAP are resolved
+type ReconcilePolicy struct {
+	// Recreate emulations of stored objects which are missing on the device,
+	// otherwise such objects are kept in the store and marked stale
+	Recreate bool
+	// Adopt objects which exist on the device but are missing in the store,
+	// otherwise such objects are only reported
+	Adopt bool
+}
+
+// ReconcileReport describes what a reconciliation pass found and did
+type ReconcileReport struct {
+	// Recreated holds names of stored objects whose emulation was recreated
+	Recreated []string
+	// Stale holds names of stored objects which are missing on the device
+	Stale []string
+	// Adopted holds names given to device objects added to the store
+	Adopted []string
+	// Unknown holds device objects which are missing in the store
+	Unknown []string
+	// Aborted holds names of operations left unfinished by a restart
+	Aborted []string
+}
+
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("recreated: %v, stale: %v, adopted: %v, unknown: %v, aborted: %v",
+		r.Recreated, r.Stale, r.Adopted, r.Unknown, r.Aborted)
+}
+
+type nvmeControllerKey struct {
+	nqn    string
+	cntlid int
+}
+
+// Reconcile compares objects in the store with the emulations present in SNAP
+// and resolves the differences according to policy. It is meant to be run on
+// startup, before the server starts serving requests, so it takes no resource
+// locks.
+func (s *Server) Reconcile(ctx context.Context, policy ReconcilePolicy) (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	subsystems, err := s.reconcileNvmeSubsystems(ctx, policy, report)
+	if err != nil {
+		return nil, err
+	}
+	var result []models.NvdaControllerListResult
+	err = s.rpc.Call(ctx, "controller_list", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	err = s.reconcileNvmeControllers(ctx, policy, subsystems, result, report)
+	if err != nil {
+		return nil, err
+	}
+	err = s.reconcileNvmeNamespaces(ctx, policy, subsystems, report)
+	if err != nil {
+		return nil, err
+	}
+	err = s.reconcileVirtioBlks(ctx, policy, result, report)
+	if err != nil {
+		return nil, err
+	}
+	err = s.abortInterruptedOperations(report)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Reconciled store with SNAP: %v", report)
+	return report, nil
+}
+
+// adoptObject saves object found on the device to the store
+func (s *Server) adoptObject(index string, name string, object proto.Message, report *ReconcileReport) error {
+	err := s.store.Set(name, object)
+	if err != nil {
+		return err
+	}
+	err = s.addToIndex(index, name)
+	if err != nil {
+		return err
+	}
+	report.Adopted = append(report.Adopted, name)
+	return nil
+}
+
+// adoptVolume returns the volume backed by bdev, bdev itself if it backs no
+// registered volume, and records that adopted object user uses it
+func (s *Server) adoptVolume(bdev string, user string) (string, error) {
+	if bdev == "" {
+		return "", nil
+	}
+	volume, err := backend.BdevVolume(s.store, bdev)
+	if err != nil {
+		return "", err
+	}
+	return volume, backend.AddVolumeUser(s.locks, s.store, volume, user)
+}
+
+// getIndexedObject fetches object recorded in index, dropping the index entry
+// if the object itself is gone from the store
+func (s *Server) getIndexedObject(index string, name string, object proto.Message) (bool, error) {
+	found, err := s.store.Get(name, object)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		log.Printf("Dropping %s from the index, it is missing in the store", name)
+		return false, s.removeFromIndex(index, name)
+	}
+	return true, nil
+}
+
+// reconcileNvmeSubsystems returns subsystems present on the device after
+// reconciliation, keyed by name
+func (s *Server) reconcileNvmeSubsystems(ctx context.Context, policy ReconcilePolicy, report *ReconcileReport) (map[string]*pb.NvmeSubsystem, error) {
+	names, err := s.listIndex(nvmeSubsystemIndex)
+	if err != nil {
+		return nil, err
+	}
+	var result []models.NvdaSubsystemNvmeListResult
+	err = s.rpc.Call(ctx, "subsystem_nvme_list", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	onDevice := make(map[string]bool)
+	for i := range result {
+		onDevice[result[i].Nqn] = true
+	}
+	present := make(map[string]*pb.NvmeSubsystem)
+	known := make(map[string]bool)
+	for _, name := range names {
+		subsys := new(pb.NvmeSubsystem)
+		found, err := s.getIndexedObject(nvmeSubsystemIndex, name, subsys)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		known[subsys.Spec.Nqn] = true
+		// stores written before NQN ownership was persisted lack the key
+		owner, err := s.getNqnOwner(subsys.Spec.Nqn)
+		if err != nil {
+			return nil, err
+		}
+		if owner == "" {
+			err = s.setNqnOwner(subsys.Spec.Nqn, name)
+			if err != nil {
+				return nil, err
+			}
+		} else if owner != name {
+			log.Printf("NQN %s of %s is already owned by %s", subsys.Spec.Nqn, name, owner)
+		}
+		if onDevice[subsys.Spec.Nqn] {
+			present[name] = subsys
+			continue
+		}
+		if policy.Recreate {
+			err = s.createNvmeSubsystemEmulation(ctx, subsys.Spec)
+			if err == nil {
+				present[name] = subsys
+				report.Recreated = append(report.Recreated, name)
+				continue
+			}
+			log.Printf("Could not recreate %s: %v", name, err)
+		}
+		report.Stale = append(report.Stale, name)
+	}
+	for i := range result {
+		r := &result[i]
+		if known[r.Nqn] {
+			continue
+		}
+		if !policy.Adopt {
+			report.Unknown = append(report.Unknown, r.Nqn)
+			continue
+		}
+		subsys := &pb.NvmeSubsystem{
+			Name: utils.ResourceIDToSubsystemName(resourceid.NewSystemGenerated()),
+			Spec: &pb.NvmeSubsystemSpec{
+				Nqn:          r.Nqn,
+				SerialNumber: r.SerialNumber,
+				ModelNumber:  r.ModelNumber,
+			},
+		}
+		err = s.setNqnOwner(r.Nqn, subsys.Name)
+		if err != nil {
+			return nil, err
+		}
+		err = s.adoptObject(nvmeSubsystemIndex, subsys.Name, subsys, report)
+		if err != nil {
+			return nil, err
+		}
+		present[subsys.Name] = subsys
+	}
+	return present, nil
+}
+
+func (s *Server) reconcileNvmeControllers(ctx context.Context, policy ReconcilePolicy, subsystems map[string]*pb.NvmeSubsystem, result []models.NvdaControllerListResult, report *ReconcileReport) error {
+	names, err := s.listIndex(nvmeControllerIndex)
+	if err != nil {
+		return err
+	}
+	onDevice := make(map[nvmeControllerKey]bool)
+	for i := range result {
+		r := &result[i]
+		if r.Type == "nvme" {
+			onDevice[nvmeControllerKey{r.Subnqn, r.Cntlid}] = true
+		}
+	}
+	known := make(map[nvmeControllerKey]bool)
+	for _, name := range names {
+		controller := new(pb.NvmeController)
+		found, err := s.getIndexedObject(nvmeControllerIndex, name, controller)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		// listeners of fabrics controllers live in the SPDK NVMe-oF target
+		// rather than in SNAP
+		if controller.Spec.GetFabricsId() != nil {
+			continue
+		}
+		subsysName := utils.ResourceIDToSubsystemName(
+			utils.GetSubsystemIDFromNvmeName(name),
+		)
+		subsys, ok := subsystems[subsysName]
+		if ok {
+			key := nvmeControllerKey{subsys.Spec.Nqn, int(controller.Spec.GetNvmeControllerId())}
+			if onDevice[key] {
+				known[key] = true
+				continue
+			}
+			if policy.Recreate {
+				spec, err := s.restoreNvmeController(ctx, subsys, name, controller)
+				if err == nil {
+					controller.Spec = spec
+					controller.Status = &pb.NvmeControllerStatus{Active: true}
+					err = s.store.Set(name, controller)
+					if err != nil {
+						return err
+					}
+					known[nvmeControllerKey{subsys.Spec.Nqn, int(*spec.NvmeControllerId)}] = true
+					report.Recreated = append(report.Recreated, name)
+					continue
+				}
+				log.Printf("Could not recreate %s: %v", name, err)
+			}
+		}
+		controller.Status = &pb.NvmeControllerStatus{Active: false}
+		err = s.store.Set(name, controller)
+		if err != nil {
+			return err
+		}
+		report.Stale = append(report.Stale, name)
+	}
+	byNqn := make(map[string]*pb.NvmeSubsystem)
+	for _, subsys := range subsystems {
+		byNqn[subsys.Spec.Nqn] = subsys
+	}
+	for i := range result {
+		r := &result[i]
+		key := nvmeControllerKey{r.Subnqn, r.Cntlid}
+		if r.Type != "nvme" || known[key] {
+			continue
+		}
+		subsys, ok := byNqn[r.Subnqn]
+		if !policy.Adopt || !ok {
+			report.Unknown = append(report.Unknown, fmt.Sprintf("%s:%d", r.Subnqn, r.Cntlid))
+			continue
+		}
+		controller := &pb.NvmeController{
+			Name: utils.ResourceIDToControllerName(
+				utils.GetSubsystemIDFromNvmeName(subsys.Name), resourceid.NewSystemGenerated(),
+			),
+			Spec: &pb.NvmeControllerSpec{
+				Endpoint: &pb.NvmeControllerSpec_PcieId{
+					PcieId: s.pciEndpoint(r),
+				},
+				Trtype:           pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+				NvmeControllerId: proto.Int32(int32(r.Cntlid)),
+			},
+			Status: &pb.NvmeControllerStatus{Active: true},
+		}
+		err = s.adoptObject(nvmeControllerIndex, controller.Name, controller, report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreNvmeController recreates the SNAP emulation of stored controller
+// name of subsys and attaches the shared namespaces of subsys to it, as
+// CreateNvmeController does
+func (s *Server) restoreNvmeController(ctx context.Context, subsys *pb.NvmeSubsystem, name string, controller *pb.NvmeController) (*pb.NvmeControllerSpec, error) {
+	spec, err := s.createNvmeControllerEmulation(ctx, subsys, controller)
+	if err != nil {
+		return nil, err
+	}
+	err = s.attachNvmeSubsystemNamespaces(ctx, subsys, name, int(*spec.NvmeControllerId))
+	if err != nil {
+		if derr := s.deleteNvmeControllerEmulation(detachedContext{ctx}, subsys.Spec.Nqn, int(*spec.NvmeControllerId)); derr != nil {
+			log.Printf("Could not delete CTRL %s: %v", name, derr)
+		}
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (s *Server) reconcileNvmeNamespaces(ctx context.Context, policy ReconcilePolicy, subsystems map[string]*pb.NvmeSubsystem, report *ReconcileReport) error {
+	names, err := s.listIndex(nvmeNamespaceIndex)
+	if err != nil {
+		return err
+	}
+	subsysNames := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		subsysNames = append(subsysNames, name)
+	}
+	sort.Strings(subsysNames)
+	// namespaces on the device, keyed by subsystem name and nsid
+	onDevice := make(map[string]map[int]string)
+	for _, subsysName := range subsysNames {
+		result, _, err := s.listNvmeNamespaces(ctx, subsystems[subsysName])
+		if err != nil {
+			// leave namespaces of this subsystem alone rather than guess
+			log.Printf("Could not list namespaces of %s: %v", subsysName, err)
+			continue
+		}
+		onDevice[subsysName] = make(map[int]string)
+		for i := range result.Namespaces {
+			onDevice[subsysName][result.Namespaces[i].Nsid] = result.Namespaces[i].Bdev
+		}
+	}
+	for _, name := range names {
+		namespace := new(pb.NvmeNamespace)
+		found, err := s.getIndexedObject(nvmeNamespaceIndex, name, namespace)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		subsysName := utils.ResourceIDToSubsystemName(
+			utils.GetSubsystemIDFromNvmeName(name),
+		)
+		subsys, ok := subsystems[subsysName]
+		if ok {
+			nsids, listed := onDevice[subsysName]
+			if !listed {
+				continue
+			}
+			if _, ok := nsids[int(namespace.Spec.HostNsid)]; ok {
+				delete(nsids, int(namespace.Spec.HostNsid))
+				continue
+			}
+			if policy.Recreate {
+				var controllers []*pb.NvmeController
+				controllers, err = s.nvmeNamespaceControllers(subsys, name)
+				if err != nil {
+					return err
+				}
+				err = s.attachNvmeNamespace(ctx, subsys, namespace, controllers)
+				if err == nil {
+					namespace.Status = &pb.NvmeNamespaceStatus{
+						State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+						OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
+					}
+					err = s.store.Set(name, namespace)
+					if err != nil {
+						return err
+					}
+					report.Recreated = append(report.Recreated, name)
+					continue
+				}
+				log.Printf("Could not recreate %s: %v", name, err)
+			}
+		}
+		if namespace.Status == nil {
+			namespace.Status = &pb.NvmeNamespaceStatus{}
+		}
+		namespace.Status.OperState = pb.NvmeNamespaceStatus_OPER_STATE_OFFLINE
+		err = s.store.Set(name, namespace)
+		if err != nil {
+			return err
+		}
+		report.Stale = append(report.Stale, name)
+	}
+	for _, subsysName := range subsysNames {
+		nsids := make([]int, 0, len(onDevice[subsysName]))
+		for nsid := range onDevice[subsysName] {
+			nsids = append(nsids, nsid)
+		}
+		sort.Ints(nsids)
+		for _, nsid := range nsids {
+			if !policy.Adopt {
+				report.Unknown = append(report.Unknown, fmt.Sprintf("%s:%d", subsystems[subsysName].Spec.Nqn, nsid))
+				continue
+			}
+			name := utils.ResourceIDToNamespaceName(
+				utils.GetSubsystemIDFromNvmeName(subsysName), resourceid.NewSystemGenerated(),
+			)
+			volume, err := s.adoptVolume(onDevice[subsysName][nsid], name)
+			if err != nil {
+				return err
+			}
+			namespace := &pb.NvmeNamespace{
+				Name: name,
+				Spec: &pb.NvmeNamespaceSpec{
+					HostNsid:      int32(nsid),
+					VolumeNameRef: volume,
+				},
+				Status: &pb.NvmeNamespaceStatus{
+					State:     pb.NvmeNamespaceStatus_STATE_ENABLED,
+					OperState: pb.NvmeNamespaceStatus_OPER_STATE_ONLINE,
+				},
+			}
+			err = s.adoptObject(nvmeNamespaceIndex, namespace.Name, namespace, report)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) reconcileVirtioBlks(ctx context.Context, policy ReconcilePolicy, result []models.NvdaControllerListResult, report *ReconcileReport) error {
+	names, err := s.listIndex(virtioBlkIndex)
+	if err != nil {
+		return err
+	}
+	onDevice := make(map[string]*models.NvdaControllerListResult)
+	for i := range result {
+		r := &result[i]
+		if r.Type == "virtio_blk" {
+			onDevice[r.Name] = r
+		}
+	}
+	for _, name := range names {
+		virtioBlk := new(pb.VirtioBlk)
+		found, err := s.getIndexedObject(virtioBlkIndex, name, virtioBlk)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		resourceID := path.Base(name)
+		if _, ok := onDevice[resourceID]; ok {
+			delete(onDevice, resourceID)
+			continue
+		}
+		if policy.Recreate {
+			err = s.createVirtioBlkEmulation(ctx, resourceID, virtioBlk)
+			if err == nil {
+				report.Recreated = append(report.Recreated, name)
+				continue
+			}
+			log.Printf("Could not recreate %s: %v", name, err)
+		}
+		report.Stale = append(report.Stale, name)
+	}
+	if len(onDevice) == 0 {
+		return nil
+	}
+	unknown := make([]string, 0, len(onDevice))
+	for name := range onDevice {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	if !policy.Adopt {
+		report.Unknown = append(report.Unknown, unknown...)
+		return nil
+	}
+	// controller_list does not tell the backing bdev, iostat does
+	var stats models.NvdaControllerNvmeStatsResult
+	err = s.rpc.Call(ctx, "controller_virtio_blk_get_iostat", nil, &stats)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", stats)
+	bdevs := make(map[string]string)
+	for _, c := range stats.Controllers {
+		if len(c.Bdevs) > 0 {
+			bdevs[c.Name] = c.Bdevs[0].BdevName
+		}
+	}
+	for _, name := range unknown {
+		r := onDevice[name]
+		volume, err := s.adoptVolume(bdevs[r.Name], utils.ResourceIDToVolumeName(r.Name))
+		if err != nil {
+			return err
+		}
+		virtioBlk := &pb.VirtioBlk{
+			Name:          utils.ResourceIDToVolumeName(r.Name),
+			PcieId:        s.pciEndpoint(r),
+			VolumeNameRef: volume,
+		}
+		err = s.adoptObject(virtioBlkIndex, virtioBlk.Name, virtioBlk, report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
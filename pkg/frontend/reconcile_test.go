@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+)
+
+func TestFrontEnd_Reconcile(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	subsystemList := `{"id":%d,"error":{"code":0,"message":""},"result":[{"nqn":"nqn.2022-09.io.spdk:opi3","serial_number":"","model_number":"","controllers":[]}]}`
+	controllerList := `{"id":%d,"error":{"code":0,"message":""},"result":[{"subnqn":"nqn.2022-09.io.spdk:opi3","cntlid":17,"name":"NvmeEmu0pf1","type":"nvme","pci_index":1},{"subnqn":"","cntlid":0,"name":"virtio-blk-42","type":"virtio_blk","pci_index":42}]}`
+	namespaceList := `{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17,"Namespaces":[{"nsid":22,"bdev":"Malloc1","bdev_type":"spdk","qn":"","protocol":""}]}}`
+	tests := map[string]struct {
+		policy     ReconcilePolicy
+		stored     bool
+		attachment *nvmeNamespaceAttachment
+		spdk       []string
+		out        *ReconcileReport
+		adopted    int
+		active     bool
+		online     bool
+		errMsg     string
+		indexLen   int
+		register   map[string]string
+		volumes    []string
+	}{
+		"store and device in sync": {
+			policy: ReconcilePolicy{},
+			stored: true,
+			spdk:   []string{subsystemList, controllerList, namespaceList},
+			out:    &ReconcileReport{},
+			active: true,
+			online: true,
+		},
+		"objects missing on the device are marked stale": {
+			policy: ReconcilePolicy{},
+			stored: true,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+			},
+			out: &ReconcileReport{
+				Stale: []string{testSubsystemName, testControllerName, testNamespaceName, testVirtioCtrlName},
+			},
+			active: false,
+			online: false,
+		},
+		"objects missing on the device are recreated": {
+			policy: ReconcilePolicy{Recreate: true},
+			stored: true,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				namespaceList,
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf42"}`,
+			},
+			out: &ReconcileReport{
+				Recreated: []string{testSubsystemName, testControllerName, testVirtioCtrlName},
+			},
+			active: true,
+			online: true,
+		},
+		"shared namespaces are attached to recreated controllers": {
+			policy:     ReconcilePolicy{Recreate: true},
+			stored:     true,
+			attachment: &nvmeNamespaceAttachment{Shared: true, Controllers: []string{testControllerName}},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				namespaceList,
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf42"}`,
+			},
+			out: &ReconcileReport{
+				Recreated: []string{testSubsystemName, testControllerName, testVirtioCtrlName},
+			},
+			active: true,
+			online: true,
+		},
+		"private namespaces are recreated on their controllers": {
+			policy:     ReconcilePolicy{Recreate: true},
+			stored:     true,
+			attachment: &nvmeNamespaceAttachment{Shared: false, Controllers: []string{testControllerName}},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				testEmulationFunctions,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"name":"NvmeEmu0pf1","cntlid":17,"Namespaces":[]}}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf42"}`,
+			},
+			out: &ReconcileReport{
+				Recreated: []string{testSubsystemName, testControllerName, testNamespaceName, testVirtioCtrlName},
+			},
+			active: true,
+			online: true,
+		},
+		"failed recreation marks objects stale": {
+			policy: ReconcilePolicy{Recreate: true},
+			stored: true,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":[]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":""}`,
+			},
+			out: &ReconcileReport{
+				Stale: []string{testSubsystemName, testControllerName, testNamespaceName, testVirtioCtrlName},
+			},
+			active: false,
+			online: false,
+		},
+		"objects missing in the store are reported": {
+			policy: ReconcilePolicy{},
+			stored: false,
+			spdk:   []string{subsystemList, controllerList},
+			out: &ReconcileReport{
+				Unknown: []string{"nqn.2022-09.io.spdk:opi3", "nqn.2022-09.io.spdk:opi3:17", "virtio-blk-42"},
+			},
+		},
+		"objects missing in the store are adopted": {
+			policy: ReconcilePolicy{Adopt: true},
+			stored: false,
+			spdk: []string{subsystemList, controllerList, namespaceList,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"virtio-blk-42","bdevs":[{"bdev_name":"Malloc42"}]}]}}`,
+			},
+			out:      &ReconcileReport{},
+			adopted:  4,
+			indexLen: 1,
+			volumes:  []string{"Malloc1", "Malloc42"},
+		},
+		"adopted objects refer to the volumes of their bdevs": {
+			policy: ReconcilePolicy{Adopt: true},
+			stored: false,
+			spdk: []string{subsystemList, controllerList, namespaceList,
+				`{"id":%d,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"virtio-blk-42","bdevs":[{"bdev_name":"Nvme0n1"}]}]}}`,
+			},
+			out:      &ReconcileReport{},
+			adopted:  4,
+			indexLen: 1,
+			register: map[string]string{"volume-1": "Malloc1"},
+			volumes:  []string{"volume-1", "Nvme0n1"},
+		},
+		"spdk subsystem list error": {
+			policy: ReconcilePolicy{},
+			stored: true,
+			spdk:   []string{`{"id":%d,"error":{"code":1,"message":"myopierr"},"result":[]}`},
+			out:    nil,
+			errMsg: fmt.Sprintf("subsystem_nvme_list: %v", "json response error: myopierr"),
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testEnv := createTestEnvironment(tt.spdk)
+			defer testEnv.Close()
+
+			server := testEnv.opiSpdkServer
+			if tt.stored {
+				seed := map[string]string{
+					testSubsystemName:  nvmeSubsystemIndex,
+					testControllerName: nvmeControllerIndex,
+					testNamespaceName:  nvmeNamespaceIndex,
+					testVirtioCtrlName: virtioBlkIndex,
+				}
+				_ = server.store.Set(testSubsystemName, &testSubsystemWithStatus)
+				_ = server.store.Set(testControllerName, &testControllerWithStatus)
+				_ = server.store.Set(testNamespaceName, &testNamespaceWithStatus)
+				_ = server.store.Set(testVirtioCtrlName, &testVirtioCtrlWithName)
+				for name, index := range seed {
+					_ = server.addToIndex(index, name)
+				}
+			}
+			if tt.attachment != nil {
+				_ = server.setNvmeNamespaceAttachment(testNamespaceName, tt.attachment)
+			}
+
+			for volume, bdev := range tt.register {
+				_ = backend.RegisterVolume(server.store, volume, bdev)
+			}
+
+			report, err := server.Reconcile(testEnv.ctx, tt.policy)
+
+			if tt.errMsg != "" {
+				if err == nil || err.Error() != tt.errMsg {
+					t.Error("error: expected", tt.errMsg, "received", err)
+				}
+			} else if err != nil {
+				t.Error("unexpected error", err)
+			}
+			if report != nil {
+				if len(report.Adopted) != tt.adopted {
+					t.Error("adopted: expected", tt.adopted, "received", report.Adopted)
+				}
+				report.Adopted = nil
+			}
+			if !reflect.DeepEqual(report, tt.out) {
+				t.Error("report: expected", tt.out, "received", report)
+			}
+
+			if tt.stored && tt.errMsg == "" {
+				controller := new(pb.NvmeController)
+				_, _ = server.store.Get(testControllerName, controller)
+				if controller.Status.Active != tt.active {
+					t.Error("controller active: expected", tt.active, "received", controller.Status.Active)
+				}
+				namespace := new(pb.NvmeNamespace)
+				_, _ = server.store.Get(testNamespaceName, namespace)
+				online := namespace.Status.OperState == pb.NvmeNamespaceStatus_OPER_STATE_ONLINE
+				if online != tt.online {
+					t.Error("namespace online: expected", tt.online, "received", namespace.Status.OperState)
+				}
+				if tt.attachment != nil {
+					attachment, _, _ := server.getNvmeNamespaceAttachment(testNamespaceName)
+					if !reflect.DeepEqual(attachment, tt.attachment) {
+						t.Error("attachment: expected", tt.attachment, "received", attachment)
+					}
+				}
+			}
+			if tt.volumes != nil {
+				// adopted objects are recorded as users of their volumes
+				volumes := []string{}
+				users := make(map[string][]string)
+				namespaces, _ := server.listIndex(nvmeNamespaceIndex)
+				for _, name := range namespaces {
+					namespace := new(pb.NvmeNamespace)
+					_, _ = server.store.Get(name, namespace)
+					volumes = append(volumes, namespace.Spec.VolumeNameRef)
+					users[namespace.Spec.VolumeNameRef] = []string{name}
+				}
+				virtioBlks, _ := server.listIndex(virtioBlkIndex)
+				for _, name := range virtioBlks {
+					virtioBlk := new(pb.VirtioBlk)
+					_, _ = server.store.Get(name, virtioBlk)
+					volumes = append(volumes, virtioBlk.VolumeNameRef)
+					users[virtioBlk.VolumeNameRef] = []string{name}
+				}
+				if !reflect.DeepEqual(volumes, tt.volumes) {
+					t.Error("volumes: expected", tt.volumes, "received", volumes)
+				}
+				for volume, expected := range users {
+					if received, _ := backend.VolumeUsers(server.store, volume); !reflect.DeepEqual(received, expected) {
+						t.Error("users of", volume, "expected", expected, "received", received)
+					}
+				}
+			}
+			if tt.indexLen != 0 {
+				for _, index := range []string{nvmeSubsystemIndex, nvmeControllerIndex, nvmeNamespaceIndex, virtioBlkIndex} {
+					names, _ := server.listIndex(index)
+					if len(names) != tt.indexLen {
+						t.Error("index", index, "expected", tt.indexLen, "entries, received", names)
+					}
+				}
+			}
+		})
+	}
+}
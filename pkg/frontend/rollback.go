@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// rollback collects the compensating actions of the steps an operation has
+// completed, so that a failure of a later step, like persisting the result to
+// the store, does not leave SNAP with emulations the bridge does not know
+// about or the store with records of emulations which do not exist.
+//
+// Operations declare a named error result and defer runOnError:
+//
+//	var undo rollback
+//	defer undo.runOnError(ctx, &err)
+type rollback struct {
+	actions []compensation
+}
+
+// compensation undoes one completed step of an operation
+type compensation struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// add registers undo, reverting the step described by description, to be run
+// if the operation fails
+func (r *rollback) add(description string, undo func(ctx context.Context) error) {
+	r.actions = append(r.actions, compensation{description: description, undo: undo})
+}
+
+// runOnError runs the registered actions in reverse order of registration if
+// *err is set. A failed action is logged and does not stop the others, the
+// operation still returns its original error. The actions get the values of
+// ctx but not its cancellation, which is likely what made the operation fail.
+func (r *rollback) runOnError(ctx context.Context, err *error) {
+	if *err == nil {
+		return
+	}
+	ctx = detachedContext{ctx}
+	for i := len(r.actions) - 1; i >= 0; i-- {
+		action := r.actions[i]
+		log.Printf("Rolling back %s: %v", action.description, *err)
+		if rerr := action.undo(ctx); rerr != nil {
+			log.Printf("Could not roll back %s: %v", action.description, rerr)
+		}
+	}
+}
+
+// detachedContext keeps the values of a context but is never cancelled. The
+// cleanups of failed steps which do not go through a rollback use it too, as
+// the SNAP calls of cancelled operations are refused.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,468 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package frontend implememnts the FrontEnd APIs (host facing) of the storage Server
+package frontend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/philippgille/gokv"
+	"github.com/philippgille/gokv/gomap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
+	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
+)
+
+// failingStore fails writes of the keys starting with failKey, like a store
+// which became unavailable in the middle of an operation
+type failingStore struct {
+	gokv.Store
+	failKey string
+}
+
+var errStoreUnavailable = errors.New("store is unavailable")
+
+func (s *failingStore) Set(k string, v interface{}) error {
+	if s.failKey != "" && strings.HasPrefix(k, s.failKey) {
+		return errStoreUnavailable
+	}
+	return s.Store.Set(k, v)
+}
+
+func TestFrontEnd_CreateRollback(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	subsystemName := utils.ResourceIDToSubsystemName("subsystem-rollback")
+	controllerName := utils.ResourceIDToControllerName(testSubsystemID, "controller-rollback")
+	namespaceName := utils.ResourceIDToNamespaceName(testSubsystemID, "namespace-rollback")
+	virtioBlkName := utils.ResourceIDToVolumeName("virtio-blk-rollback")
+
+	createSubsystem := func(ctx context.Context, s *Server) error {
+		_, err := s.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+			NvmeSubsystemId: "subsystem-rollback",
+			NvmeSubsystem: &pb.NvmeSubsystem{
+				Spec: &pb.NvmeSubsystemSpec{Nqn: "nqn.2022-09.io.spdk:rollback"},
+			},
+		})
+		return err
+	}
+	createController := func(ctx context.Context, s *Server) error {
+		_, err := s.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+			Parent:           testSubsystemName,
+			NvmeControllerId: "controller-rollback",
+			NvmeController: &pb.NvmeController{
+				Spec: &pb.NvmeControllerSpec{
+					Endpoint: &pb.NvmeControllerSpec_PcieId{
+						PcieId: &pb.PciEndpoint{
+							PhysicalFunction: wrapperspb.Int32(1),
+							VirtualFunction:  wrapperspb.Int32(0),
+							PortId:           wrapperspb.Int32(0),
+						},
+					},
+					Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+				},
+			},
+		})
+		return err
+	}
+	createNamespace := func(ctx context.Context, s *Server) error {
+		_, err := s.CreateNvmeNamespace(ctx, &pb.CreateNvmeNamespaceRequest{
+			Parent:          testSubsystemName,
+			NvmeNamespaceId: "namespace-rollback",
+			NvmeNamespace: &pb.NvmeNamespace{
+				Spec: &pb.NvmeNamespaceSpec{HostNsid: 7, VolumeNameRef: "Malloc1"},
+			},
+		})
+		return err
+	}
+	createVirtioBlk := func(ctx context.Context, s *Server) error {
+		_, err := s.CreateVirtioBlk(ctx, &pb.CreateVirtioBlkRequest{
+			VirtioBlkId: "virtio-blk-rollback",
+			VirtioBlk: &pb.VirtioBlk{
+				PcieId: &pb.PciEndpoint{
+					PhysicalFunction: wrapperspb.Int32(2),
+					VirtualFunction:  wrapperspb.Int32(0),
+					PortId:           wrapperspb.Int32(0),
+				},
+				VolumeNameRef: "Malloc1",
+			},
+		})
+		return err
+	}
+
+	tests := map[string]struct {
+		failKey string
+		create  func(ctx context.Context, s *Server) error
+		// name and index of the object which must not be left in the store
+		name  string
+		index string
+	}{
+		"subsystem record": {
+			failKey: subsystemName,
+			create:  createSubsystem,
+			name:    subsystemName,
+			index:   nvmeSubsystemIndex,
+		},
+		"subsystem hosts": {
+			failKey: nvmeSubsystemHostsKey(subsystemName),
+			create:  createSubsystem,
+			name:    subsystemName,
+			index:   nvmeSubsystemIndex,
+		},
+		"subsystem index": {
+			failKey: nvmeSubsystemIndex,
+			create:  createSubsystem,
+			name:    subsystemName,
+			index:   nvmeSubsystemIndex,
+		},
+		"controller record": {
+			failKey: controllerName,
+			create:  createController,
+			name:    controllerName,
+			index:   nvmeControllerIndex,
+		},
+		"controller index": {
+			failKey: nvmeControllerIndex,
+			create:  createController,
+			name:    controllerName,
+			index:   nvmeControllerIndex,
+		},
+		"namespace record": {
+			failKey: namespaceName,
+			create:  createNamespace,
+			name:    namespaceName,
+			index:   nvmeNamespaceIndex,
+		},
+		"namespace attachment": {
+			failKey: nvmeNamespaceAttachmentKey(namespaceName),
+			create:  createNamespace,
+			name:    namespaceName,
+			index:   nvmeNamespaceIndex,
+		},
+		"namespace volume user": {
+			failKey: "//storage.opiproject.org/volumes/Malloc1/users",
+			create:  createNamespace,
+			name:    namespaceName,
+			index:   nvmeNamespaceIndex,
+		},
+		"virtio-blk record": {
+			failKey: virtioBlkName,
+			create:  createVirtioBlk,
+			name:    virtioBlkName,
+			index:   virtioBlkIndex,
+		},
+		"virtio-blk index": {
+			failKey: virtioBlkIndex,
+			create:  createVirtioBlk,
+			name:    virtioBlkName,
+			index:   virtioBlkIndex,
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx := context.Background()
+			snap := newFakeSnap()
+			options := gomap.DefaultOptions
+			options.Codec = utils.ProtoCodec{}
+			store := &failingStore{Store: gomap.NewStore(options)}
+			server := NewServer(snap, store)
+			if err := backend.RegisterVolume(store, "Malloc1", "Malloc1"); err != nil {
+				t.Fatal(err)
+			}
+			// a subsystem with a controller, so that namespaces get attached
+			_, err := server.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+				NvmeSubsystemId: testSubsystemID,
+				NvmeSubsystem:   &pb.NvmeSubsystem{Spec: testSubsystem.Spec},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = server.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+				Parent:           testSubsystemName,
+				NvmeControllerId: testControllerID,
+				NvmeController: &pb.NvmeController{
+					Spec: &pb.NvmeControllerSpec{
+						Endpoint: &pb.NvmeControllerSpec_PcieId{
+							PcieId: &pb.PciEndpoint{
+								PhysicalFunction: wrapperspb.Int32(0),
+								VirtualFunction:  wrapperspb.Int32(0),
+								PortId:           wrapperspb.Int32(0),
+							},
+						},
+						Trtype: pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store.failKey = tt.failKey
+			err = tt.create(ctx, server)
+			store.failKey = ""
+
+			if !errors.Is(err, errStoreUnavailable) {
+				t.Error("error: expected", errStoreUnavailable, "received", err)
+			}
+			// SNAP is back to the objects created before
+			if len(snap.subsystems) != 1 {
+				t.Error("SNAP subsystems: expected 1, received", snap.subsystems)
+			}
+			if controllers := snap.subsystems[testSubsystem.Spec.Nqn]; len(controllers) != 1 {
+				t.Error("SNAP controllers: expected 1, received", controllers)
+			}
+			if len(snap.namespaces) != 0 {
+				t.Error("SNAP namespaces: expected none, received", snap.namespaces)
+			}
+			if len(snap.virtioBlks) != 0 {
+				t.Error("SNAP virtio-blk devices: expected none, received", snap.virtioBlks)
+			}
+			// and the store does not know the object
+			if found, _ := store.Get(tt.name, new(pb.NvmeSubsystem)); found {
+				t.Error("stored object: expected none, received", tt.name)
+			}
+			names, err := server.listIndex(tt.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				if name == tt.name {
+					t.Error("index entry: expected none, received", name)
+				}
+			}
+			if owner, _ := server.getNqnOwner("nqn.2022-09.io.spdk:rollback"); owner != "" {
+				t.Error("NQN owner: expected none, received", owner)
+			}
+			if found, _ := store.Get(nvmeNamespaceAttachmentKey(namespaceName), new(pb.NvmeSubsystem)); found {
+				t.Error("namespace attachment: expected none")
+			}
+		})
+	}
+}
+
+func TestFrontEnd_UpdateRollback(t *testing.T) {
+	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	hostnqn := "nqn.2014-08.org.nvmexpress:uuid:feb98abe-d51f-40c8-b348-2753f3571d3c"
+	virtioBlkName := utils.ResourceIDToVolumeName("virtio-blk-rollback")
+	virtioBlk := &pb.VirtioBlk{
+		Name: virtioBlkName,
+		PcieId: &pb.PciEndpoint{
+			PhysicalFunction: wrapperspb.Int32(2),
+			VirtualFunction:  wrapperspb.Int32(0),
+			PortId:           wrapperspb.Int32(0),
+		},
+		VolumeNameRef: "Malloc1",
+	}
+
+	updateSubsystem := func(ctx context.Context, s *Server) error {
+		_, err := s.UpdateNvmeSubsystem(ctx, &pb.UpdateNvmeSubsystemRequest{
+			NvmeSubsystem: &pb.NvmeSubsystem{
+				Name: testSubsystemName,
+				Spec: &pb.NvmeSubsystemSpec{
+					Nqn:         testSubsystem.Spec.Nqn,
+					ModelNumber: "OpiModelNumber2",
+					Hostnqn:     hostnqn,
+				},
+			},
+		})
+		return err
+	}
+	checkSubsystem := func(t *testing.T, snap *fakeSnap, s *Server) {
+		if model := snap.models[testSubsystem.Spec.Nqn]; model != "OpiModelNumber1" {
+			t.Error("SNAP model number: expected OpiModelNumber1, received", model)
+		}
+		subsys := new(pb.NvmeSubsystem)
+		found, err := s.store.Get(testSubsystemName, subsys)
+		if err != nil || !found {
+			t.Fatal("stored subsystem: found", found, "error", err)
+		}
+		if subsys.Spec.ModelNumber != "OpiModelNumber1" || subsys.Spec.Hostnqn != "" {
+			t.Error("stored subsystem: expected the original, received", subsys)
+		}
+		hosts, err := s.getNvmeSubsystemHosts(subsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hosts.AllowAnyHost || len(hosts.Hosts) != 0 {
+			t.Error("hosts: expected any host, received", hosts)
+		}
+	}
+	updateVirtioBlk := func(ctx context.Context, s *Server) error {
+		_, err := s.UpdateVirtioBlk(ctx, &pb.UpdateVirtioBlkRequest{
+			VirtioBlk: &pb.VirtioBlk{
+				Name:          virtioBlkName,
+				PcieId:        virtioBlk.PcieId,
+				VolumeNameRef: "Malloc2",
+			},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"volume_name_ref"}},
+		})
+		return err
+	}
+	checkVirtioBlk := func(t *testing.T, snap *fakeSnap, s *Server) {
+		if bdev := snap.virtioBlks["virtio-blk-rollback"]; bdev != "Malloc1" {
+			t.Error("SNAP virtio-blk bdev: expected Malloc1, received", bdev)
+		}
+		stored := new(pb.VirtioBlk)
+		if _, err := s.store.Get(virtioBlkName, stored); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(stored, virtioBlk) {
+			t.Error("stored virtio-blk: expected", virtioBlk, "received", stored)
+		}
+		for volume, expected := range map[string]int{"Malloc1": 1, "Malloc2": 0} {
+			users, err := backend.VolumeUsers(s.store, volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != expected {
+				t.Error("users of", volume, "expected", expected, "received", users)
+			}
+		}
+	}
+
+	fabricsNamespace := &pb.NvmeNamespace{
+		Name: testNamespaceName,
+		Spec: &pb.NvmeNamespaceSpec{HostNsid: 22, VolumeNameRef: "Malloc1"},
+	}
+	// the namespace is only exported over NVMe-oF, there is no SNAP
+	// controller to attach it to
+	exportFabricsNamespace := func(ctx context.Context, s *Server) error {
+		_ = s.store.Set(testFabricsControllerName, &testFabricsController)
+		_ = s.addToIndex(nvmeControllerIndex, testFabricsControllerName)
+		_ = s.store.Set(testNamespaceName, fabricsNamespace)
+		_ = s.addToIndex(nvmeNamespaceIndex, testNamespaceName)
+		return s.addNvmfNamespace(ctx, testSubsystem.Spec.Nqn, fabricsNamespace)
+	}
+	updateFabricsNamespace := func(ctx context.Context, s *Server) error {
+		_, err := s.UpdateNvmeNamespace(ctx, &pb.UpdateNvmeNamespaceRequest{
+			NvmeNamespace: &pb.NvmeNamespace{
+				Name: testNamespaceName,
+				Spec: &pb.NvmeNamespaceSpec{HostNsid: 22, VolumeNameRef: "Malloc2"},
+			},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"spec.volume_name_ref"}},
+		})
+		return err
+	}
+	checkFabricsNamespace := func(t *testing.T, snap *fakeSnap, s *Server) {
+		if bdev := snap.nvmfNamespaces[testSubsystem.Spec.Nqn+"/22"]; bdev != "Malloc1" {
+			t.Error("NVMe-oF namespace bdev: expected Malloc1, received", bdev)
+		}
+		stored := new(pb.NvmeNamespace)
+		if _, err := s.store.Get(testNamespaceName, stored); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(stored, fabricsNamespace) {
+			t.Error("stored namespace: expected", fabricsNamespace, "received", stored)
+		}
+	}
+
+	tests := map[string]struct {
+		// failKey is the store key and fail the SNAP method which fail
+		failKey string
+		fail    string
+		// prepare, when set, adds the objects update changes
+		prepare func(ctx context.Context, s *Server) error
+		update  func(ctx context.Context, s *Server) error
+		check   func(t *testing.T, snap *fakeSnap, s *Server)
+	}{
+		"subsystem create": {
+			fail:   "subsystem_nvme_create",
+			update: updateSubsystem,
+			check:  checkSubsystem,
+		},
+		"subsystem hosts": {
+			failKey: nvmeSubsystemHostsKey(testSubsystemName),
+			update:  updateSubsystem,
+			check:   checkSubsystem,
+		},
+		"subsystem record": {
+			failKey: testSubsystemName,
+			update:  updateSubsystem,
+			check:   checkSubsystem,
+		},
+		"virtio-blk create": {
+			fail:   "controller_virtio_blk_create",
+			update: updateVirtioBlk,
+			check:  checkVirtioBlk,
+		},
+		"virtio-blk record": {
+			failKey: virtioBlkName,
+			update:  updateVirtioBlk,
+			check:   checkVirtioBlk,
+		},
+		"virtio-blk volume user": {
+			failKey: "//storage.opiproject.org/volumes/Malloc2/users",
+			update:  updateVirtioBlk,
+			check:   checkVirtioBlk,
+		},
+		"NVMe-oF namespace add": {
+			fail:    "nvmf_subsystem_add_ns",
+			prepare: exportFabricsNamespace,
+			update:  updateFabricsNamespace,
+			check:   checkFabricsNamespace,
+		},
+	}
+
+	for testName, tt := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx := context.Background()
+			snap := newFakeSnap()
+			options := gomap.DefaultOptions
+			options.Codec = utils.ProtoCodec{}
+			store := &failingStore{Store: gomap.NewStore(options)}
+			server := NewServer(snap, store)
+			for _, volume := range []string{"Malloc1", "Malloc2"} {
+				if err := backend.RegisterVolume(store, volume, volume); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := server.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+				NvmeSubsystemId: testSubsystemID,
+				NvmeSubsystem: &pb.NvmeSubsystem{
+					Spec: &pb.NvmeSubsystemSpec{
+						Nqn:         testSubsystem.Spec.Nqn,
+						ModelNumber: "OpiModelNumber1",
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = server.CreateVirtioBlk(ctx, &pb.CreateVirtioBlkRequest{
+				VirtioBlkId: "virtio-blk-rollback",
+				VirtioBlk:   utils.ProtoClone(virtioBlk),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.prepare != nil {
+				if err := tt.prepare(ctx, server); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			store.failKey = tt.failKey
+			snap.fail = tt.fail
+			err = tt.update(ctx, server)
+			store.failKey = ""
+
+			if tt.failKey != "" && !errors.Is(err, errStoreUnavailable) {
+				t.Error("error: expected", errStoreUnavailable, "received", err)
+			}
+			if tt.fail != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.fail)) {
+				t.Error("error: expected a failure of", tt.fail, "received", err)
+			}
+			tt.check(t, snap, server)
+		})
+	}
+}
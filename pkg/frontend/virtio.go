@@ -13,19 +13,30 @@ import (
 	"sort"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	"github.com/opiproject/opi-nvidia-bridge/pkg/models"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 
-	"github.com/google/uuid"
 	"go.einride.tech/aip/fieldbehavior"
 	"go.einride.tech/aip/fieldmask"
 	"go.einride.tech/aip/resourceid"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+// virtioBlkCollection identifies the listing of virtio-blk devices in page
+// tokens
+const virtioBlkCollection = "virtioBlks"
+
+// ActiveVirtioBlksHeader is the gRPC response header listing the names of the
+// returned virtio-blk devices which SNAP currently emulates, as VirtioBlk has
+// no status
+const ActiveVirtioBlksHeader = "active-virtio-blks"
+
 func sortVirtioBlks(virtioBlks []*pb.VirtioBlk) {
 	sort.Slice(virtioBlks, func(i int, j int) bool {
 		return virtioBlks[i].Name < virtioBlks[j].Name
@@ -33,7 +44,7 @@ func sortVirtioBlks(virtioBlks []*pb.VirtioBlk) {
 }
 
 // CreateVirtioBlk creates a Virtio block device
-func (s *Server) CreateVirtioBlk(ctx context.Context, in *pb.CreateVirtioBlkRequest) (*pb.VirtioBlk, error) {
+func (s *Server) CreateVirtioBlk(ctx context.Context, in *pb.CreateVirtioBlkRequest) (_ *pb.VirtioBlk, err error) {
 	// check input correctness
 	if err := s.validateCreateVirtioBlkRequest(in); err != nil {
 		return nil, err
@@ -45,35 +56,61 @@ func (s *Server) CreateVirtioBlk(ctx context.Context, in *pb.CreateVirtioBlkRequ
 		resourceID = in.VirtioBlkId
 	}
 	in.VirtioBlk.Name = utils.ResourceIDToVolumeName(resourceID)
+	if asyncRequested(ctx) {
+		// the operation creates the object under the name returned now
+		request := utils.ProtoClone(in)
+		request.VirtioBlkId = resourceID
+		err := s.startOperation(ctx, request, true, func(ctx context.Context) (proto.Message, error) {
+			return s.CreateVirtioBlk(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return in.VirtioBlk, nil
+	}
+	unlock := s.locks.Lock(in.VirtioBlk.Name)
+	defer unlock()
 	// idempotent API when called with same key, should return same object
-	controller, ok := s.VirtioCtrls[in.VirtioBlk.Name]
-	if ok {
-		log.Printf("Already existing NvmeController with id %v", in.VirtioBlk.Name)
+	controller := new(pb.VirtioBlk)
+	found, err := s.store.Get(in.VirtioBlk.Name, controller)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		log.Printf("Already existing VirtioBlk with id %v", in.VirtioBlk.Name)
 		return controller, nil
 	}
 	// not found, so create a new one
-	params := models.NvdaControllerVirtioBlkCreateParams{
-		Serial: resourceID,
-		Bdev:   in.VirtioBlk.VolumeNameRef,
-		PfID:   int(in.VirtioBlk.PcieId.PhysicalFunction.Value),
-		// VfID:             int(in.VirtioBlk.PcieId.VirtualFunction),
-		NumQueues:        int(in.VirtioBlk.MaxIoQps),
-		BdevType:         "spdk",
-		EmulationManager: "mlx5_0",
+	unlockVolume := backend.LockVolume(s.locks, in.VirtioBlk.VolumeNameRef)
+	defer unlockVolume()
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	err = s.createVirtioBlkEmulation(ctx, resourceID, in.VirtioBlk)
+	if err != nil {
+		return nil, err
 	}
-	var result models.NvdaControllerVirtioBlkCreateResult
-	err := s.rpc.Call(ctx, "controller_virtio_blk_create", &params, &result)
+	undo.add("virtio-blk "+resourceID, func(ctx context.Context) error {
+		return s.deleteVirtioBlkEmulation(ctx, in.VirtioBlk.Name, resourceID)
+	})
+	response := utils.ProtoClone(in.VirtioBlk)
+	err = s.store.Set(in.VirtioBlk.Name, response)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Received from SPDK: %v", result)
-	if result == "" {
-		msg := fmt.Sprintf("Could not create virtio-blk: %s", resourceID)
-		return nil, status.Errorf(codes.InvalidArgument, msg)
+	undo.add("record of "+in.VirtioBlk.Name, func(context.Context) error {
+		return s.store.Delete(in.VirtioBlk.Name)
+	})
+	err = s.addToIndex(virtioBlkIndex, in.VirtioBlk.Name)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("index entry of "+in.VirtioBlk.Name, func(context.Context) error {
+		return s.removeFromIndex(virtioBlkIndex, in.VirtioBlk.Name)
+	})
+	err = backend.AddVolumeUser(s.locks, s.store, response.VolumeNameRef, response.Name)
+	if err != nil {
+		return nil, err
 	}
-	response := utils.ProtoClone(in.VirtioBlk)
-	// response.Status = &pb.NvmeControllerStatus{Active: true}
-	s.VirtioCtrls[in.VirtioBlk.Name] = response
 	return response, nil
 }
 
@@ -83,9 +120,25 @@ func (s *Server) DeleteVirtioBlk(ctx context.Context, in *pb.DeleteVirtioBlkRequ
 	if err := s.validateDeleteVirtioBlkRequest(in); err != nil {
 		return nil, err
 	}
+	if asyncRequested(ctx) {
+		request := utils.ProtoClone(in)
+		err := s.startOperation(ctx, request, false, func(ctx context.Context) (proto.Message, error) {
+			return s.DeleteVirtioBlk(ctx, request)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+	unlock := s.locks.Lock(in.Name)
+	defer unlock()
 	// fetch object from the database
-	controller, ok := s.VirtioCtrls[in.Name]
-	if !ok {
+	controller := new(pb.VirtioBlk)
+	found, err := s.store.Get(in.Name, controller)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
 		if in.AllowMissing {
 			return &emptypb.Empty{}, nil
 		}
@@ -96,7 +149,7 @@ func (s *Server) DeleteVirtioBlk(ctx context.Context, in *pb.DeleteVirtioBlkRequ
 		Force: true,
 	}
 	var result models.NvdaControllerVirtioBlkDeleteResult
-	err := s.rpc.Call(ctx, "controller_virtio_blk_delete", &params, &result)
+	err = s.rpc.Call(ctx, "controller_virtio_blk_delete", &params, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -104,21 +157,53 @@ func (s *Server) DeleteVirtioBlk(ctx context.Context, in *pb.DeleteVirtioBlkRequ
 	if !result {
 		log.Printf("Could not delete: %v", in)
 	}
-	delete(s.VirtioCtrls, controller.Name)
+	// remove from the Database
+	err = s.store.Delete(controller.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.removeFromIndex(virtioBlkIndex, controller.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = backend.RemoveVolumeUser(s.locks, s.store, controller.VolumeNameRef, controller.Name)
+	if err != nil {
+		return nil, err
+	}
 	return &emptypb.Empty{}, nil
 }
 
 // UpdateVirtioBlk updates a Virtio block device
-func (s *Server) UpdateVirtioBlk(_ context.Context, in *pb.UpdateVirtioBlkRequest) (*pb.VirtioBlk, error) {
+//
+// SNAP can not change a live virtio-blk emulation, so any change to the
+// backing volume, the number of queues or the PCI function hot-unplugs the
+// device from the host and plugs a new one in its place. The host sees the
+// disk disappear and come back, so such updates should be issued only while
+// the guest does not use the disk. If the new device can not be set up, the
+// original one is plugged back. QoS limits are not supported by SNAP
+// emulation and are rejected.
+func (s *Server) UpdateVirtioBlk(ctx context.Context, in *pb.UpdateVirtioBlkRequest) (_ *pb.VirtioBlk, err error) {
 	// check input correctness
 	if err := s.validateUpdateVirtioBlkRequest(in); err != nil {
 		return nil, err
 	}
+	unlock := s.locks.Lock(in.VirtioBlk.Name)
+	defer unlock()
 	// fetch object from the database
-	volume, ok := s.VirtioCtrls[in.VirtioBlk.Name]
-	if !ok {
+	volume := new(pb.VirtioBlk)
+	found, err := s.store.Get(in.VirtioBlk.Name, volume)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
 		if in.AllowMissing {
-			log.Printf("TODO: in case of AllowMissing, create a new resource, don;t return error")
+			// see https://google.aip.dev/134#create-or-update
+			log.Printf("VirtioBlk %v not found, creating it since AllowMissing is set", in.VirtioBlk.Name)
+			unlock()
+			return s.CreateVirtioBlk(ctx, &pb.CreateVirtioBlkRequest{
+				VirtioBlk:   in.VirtioBlk,
+				VirtioBlkId: path.Base(in.VirtioBlk.Name),
+			})
 		}
 		err := status.Errorf(codes.NotFound, "unable to find key %s", in.VirtioBlk.Name)
 		return nil, err
@@ -128,8 +213,51 @@ func (s *Server) UpdateVirtioBlk(_ context.Context, in *pb.UpdateVirtioBlkReques
 	if err := fieldmask.Validate(in.UpdateMask, in.VirtioBlk); err != nil {
 		return nil, err
 	}
-	log.Printf("TODO: use resourceID=%v", resourceID)
-	return nil, status.Errorf(codes.Unimplemented, "UpdateVirtioBlk method is not implemented")
+	response := utils.ProtoClone(volume)
+	fieldmask.Update(in.UpdateMask, response, in.VirtioBlk)
+	response.Name = volume.Name
+	if !proto.Equal(volume.MinLimit, response.MinLimit) ||
+		!proto.Equal(volume.MaxLimit, response.MaxLimit) {
+		msg := fmt.Sprintf("Could not update virtio-blk: %s, QoS limits are not supported by SNAP emulation", resourceID)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	unlockVolume := backend.LockVolume(s.locks, response.VolumeNameRef)
+	defer unlockVolume()
+	var undo rollback
+	defer undo.runOnError(ctx, &err)
+	if !proto.Equal(volume, response) {
+		err = s.deleteVirtioBlkEmulation(ctx, volume.Name, resourceID)
+		if err != nil {
+			return nil, err
+		}
+		// the host gets the original device back if the update fails
+		undo.add("deletion of virtio-blk "+resourceID, func(ctx context.Context) error {
+			return s.createVirtioBlkEmulation(ctx, resourceID, volume)
+		})
+		err = s.createVirtioBlkEmulation(ctx, resourceID, response)
+		if err != nil {
+			return nil, err
+		}
+		undo.add("virtio-blk "+resourceID, func(ctx context.Context) error {
+			return s.deleteVirtioBlkEmulation(ctx, volume.Name, resourceID)
+		})
+	}
+	err = s.store.Set(response.Name, response)
+	if err != nil {
+		return nil, err
+	}
+	undo.add("record of "+response.Name, func(context.Context) error {
+		return s.store.Set(volume.Name, volume)
+	})
+	// registered first, as the move may be left half done
+	undo.add("user of volume "+response.VolumeNameRef, func(context.Context) error {
+		return s.moveVolumeUser(volume.Name, response.VolumeNameRef, volume.VolumeNameRef)
+	})
+	err = s.moveVolumeUser(response.Name, volume.VolumeNameRef, response.VolumeNameRef)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // ListVirtioBlks lists Virtio block devices
@@ -138,40 +266,60 @@ func (s *Server) ListVirtioBlks(ctx context.Context, in *pb.ListVirtioBlksReques
 		return nil, err
 	}
 
-	size, offset, perr := utils.ExtractPagination(in.PageSize, in.PageToken, s.Pagination)
+	size, offset, perr := extractPagination(in.PageSize, in.PageToken, virtioBlkCollection)
 	if perr != nil {
 		return nil, perr
 	}
+	virtioBlks, err := s.storedVirtioBlks()
+	if err != nil {
+		return nil, err
+	}
 	var result []models.NvdaControllerListResult
-	err := s.rpc.Call(ctx, "controller_list", nil, &result)
+	err = s.rpc.Call(ctx, "controller_list", nil, &result)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Received from SPDK: %v", result)
-	token, hasMoreElements := "", false
-	log.Printf("Limiting result len(%d) to [%d:%d]", len(result), offset, size)
-	result, hasMoreElements = utils.LimitPagination(result, offset, size)
-	if hasMoreElements {
-		token = uuid.New().String()
-		s.Pagination[token] = offset + size
-	}
-	Blobarray := []*pb.VirtioBlk{}
+	// virtio-blk devices are only active while the device reports them
+	emulated := make(map[string]bool)
 	for i := range result {
 		r := &result[i]
 		if r.Type == "virtio_blk" {
-			ctrl := &pb.VirtioBlk{
-				Name: utils.ResourceIDToVolumeName(r.Name),
-				PcieId: &pb.PciEndpoint{
-					PhysicalFunction: wrapperspb.Int32(int32(r.PciIndex)),
-					VirtualFunction:  wrapperspb.Int32(0),
-					PortId:           wrapperspb.Int32(0),
-				},
-				VolumeNameRef: "TBD"}
-			Blobarray = append(Blobarray, ctrl)
+			emulated[r.Name] = true
+		}
+	}
+	sortVirtioBlks(virtioBlks)
+	virtioBlks, token := limitPagination(virtioBlks, offset, size, virtioBlkCollection)
+	active := metadata.MD{}
+	for _, virtioBlk := range virtioBlks {
+		if emulated[path.Base(virtioBlk.Name)] {
+			active.Append(ActiveVirtioBlksHeader, virtioBlk.Name)
+		}
+	}
+	if err := grpc.SetHeader(ctx, active); err != nil {
+		log.Printf("Could not report active virtio-blk devices: %v", err)
+	}
+	return &pb.ListVirtioBlksResponse{VirtioBlks: virtioBlks, NextPageToken: token}, nil
+}
+
+// storedVirtioBlks returns the virtio-blk devices recorded in the database
+func (s *Server) storedVirtioBlks() ([]*pb.VirtioBlk, error) {
+	names, err := s.listIndex(virtioBlkIndex)
+	if err != nil {
+		return nil, err
+	}
+	virtioBlks := []*pb.VirtioBlk{}
+	for _, name := range names {
+		virtioBlk := new(pb.VirtioBlk)
+		found, err := s.store.Get(name, virtioBlk)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			virtioBlks = append(virtioBlks, virtioBlk)
 		}
 	}
-	sortVirtioBlks(Blobarray)
-	return &pb.ListVirtioBlksResponse{VirtioBlks: Blobarray}, nil
+	return virtioBlks, nil
 }
 
 // GetVirtioBlk gets a Virtio block device
@@ -181,13 +329,17 @@ func (s *Server) GetVirtioBlk(ctx context.Context, in *pb.GetVirtioBlkRequest) (
 		return nil, err
 	}
 	// fetch object from the database
-	_, ok := s.VirtioCtrls[in.Name]
-	if !ok {
+	volume := new(pb.VirtioBlk)
+	found, err := s.store.Get(in.Name, volume)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
 		msg := fmt.Sprintf("Could not find Controller: %s", in.Name)
 		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
 	var result []models.NvdaControllerListResult
-	err := s.rpc.Call(ctx, "controller_list", nil, &result)
+	err = s.rpc.Call(ctx, "controller_list", nil, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -196,18 +348,21 @@ func (s *Server) GetVirtioBlk(ctx context.Context, in *pb.GetVirtioBlkRequest) (
 	for i := range result {
 		r := &result[i]
 		if r.Name == resourceID && r.Type == "virtio_blk" {
-			return &pb.VirtioBlk{
-				Name: utils.ResourceIDToVolumeName(r.Name),
-				PcieId: &pb.PciEndpoint{
-					PhysicalFunction: wrapperspb.Int32(int32(r.PciIndex)),
-					VirtualFunction:  wrapperspb.Int32(0),
-					PortId:           wrapperspb.Int32(0),
-				},
-				VolumeNameRef: "TBD"}, nil
+			// the endpoint is the function SNAP emulates the device on,
+			// VirtioBlk has no status, so the PCI address and the activity
+			// are sent in headers
+			volume.PcieId = s.pciEndpoint(r)
+			reportPciBdf(ctx, r.PciBdf)
+			active := metadata.Pairs(ActiveVirtioBlksHeader, volume.Name)
+			if err := grpc.SetHeader(ctx, active); err != nil {
+				log.Printf("Could not report active virtio-blk devices: %v", err)
+			}
+			return volume, nil
 		}
 	}
-	msg := fmt.Sprintf("Could not find Controller: %s", in.Name)
-	return nil, status.Errorf(codes.InvalidArgument, msg)
+	// not emulated by SNAP, the device is reported as it was requested and
+	// is missing from ActiveVirtioBlksHeader
+	return volume, nil
 }
 
 // StatsVirtioBlk gets a Virtio block device stats
@@ -217,22 +372,95 @@ func (s *Server) StatsVirtioBlk(ctx context.Context, in *pb.StatsVirtioBlkReques
 		return nil, err
 	}
 	// fetch object from the database
+	volume := new(pb.VirtioBlk)
+	found, err := s.store.Get(in.Name, volume)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		err := status.Errorf(codes.NotFound, "unable to find key %s", in.Name)
+		return nil, err
+	}
+	bdev, err := backend.ResolveVolume(ctx, s.rpc, s.store, volume.VolumeNameRef)
+	if err != nil {
+		return nil, err
+	}
 	var result models.NvdaControllerNvmeStatsResult
-	err := s.rpc.Call(ctx, "controller_virtio_blk_get_iostat", nil, &result)
+	err = s.rpc.Call(ctx, "controller_virtio_blk_get_iostat", nil, &result)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Received from SPDK: %v", result)
 	for _, c := range result.Controllers {
-		for _, r := range c.Bdevs {
-			if r.BdevName == in.Name {
-				return &pb.StatsVirtioBlkResponse{Stats: &pb.VolumeStats{
-					ReadOpsCount:  int32(r.ReadIos),
-					WriteOpsCount: int32(r.WriteIos),
-				}}, nil
+		for i := range c.Bdevs {
+			r := &c.Bdevs[i]
+			if r.BdevName == bdev {
+				stats := &pb.VolumeStats{}
+				addVolumeStats(stats, r)
+				counters := &volumeCounters{}
+				counters.add(r)
+				counters.report(ctx)
+				return &pb.StatsVirtioBlkResponse{Stats: stats}, nil
 			}
 		}
 	}
-	msg := fmt.Sprintf("Could not find Controller: %s", in.Name)
+	msg := fmt.Sprintf("Could not find BdevName: %s", bdev)
 	return nil, status.Errorf(codes.InvalidArgument, msg)
 }
+
+// createVirtioBlkEmulation creates SNAP emulation for virtio-blk device with
+// the given serial
+func (s *Server) createVirtioBlkEmulation(ctx context.Context, serial string, virtioBlk *pb.VirtioBlk) error {
+	bdev, err := backend.ResolveVolume(ctx, s.rpc, s.store, virtioBlk.VolumeNameRef)
+	if err != nil {
+		return err
+	}
+	manager, err := s.emulationManager(ctx, virtioBlk.PcieId)
+	if err != nil {
+		return err
+	}
+	err = s.validateVirtualFunction(ctx, manager, "virtio_blk", virtioBlk.PcieId)
+	if err != nil {
+		return err
+	}
+	params := models.NvdaControllerVirtioBlkCreateParams{
+		Serial:           serial,
+		Bdev:             bdev,
+		PfID:             int(virtioBlk.PcieId.PhysicalFunction.Value),
+		VfID:             snapVfID(virtioBlk.PcieId),
+		NumQueues:        int(virtioBlk.MaxIoQps),
+		BdevType:         "spdk",
+		EmulationManager: manager,
+	}
+	var result models.NvdaControllerVirtioBlkCreateResult
+	err = s.rpc.Call(ctx, "controller_virtio_blk_create", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if result == "" {
+		msg := fmt.Sprintf("Could not create virtio-blk: %s", serial)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// deleteVirtioBlkEmulation deletes SNAP emulation name of virtio-blk device
+// with the given serial
+func (s *Server) deleteVirtioBlkEmulation(ctx context.Context, name string, serial string) error {
+	params := models.NvdaControllerVirtioBlkDeleteParams{
+		Name:  name,
+		Force: true,
+	}
+	var result models.NvdaControllerVirtioBlkDeleteResult
+	err := s.rpc.Call(ctx, "controller_virtio_blk_delete", &params, &result)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received from SPDK: %v", result)
+	if !result {
+		msg := fmt.Sprintf("Could not delete virtio-blk: %s", serial)
+		return status.Errorf(codes.InvalidArgument, msg)
+	}
+	return nil
+}
@@ -10,8 +10,11 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -19,6 +22,7 @@ import (
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"github.com/opiproject/opi-nvidia-bridge/pkg/backend"
 	"github.com/opiproject/opi-spdk-bridge/pkg/utils"
 )
 
@@ -53,6 +57,58 @@ func TestFrontEnd_CreateVirtioBlk(t *testing.T) {
 			errCode: codes.InvalidArgument,
 			errMsg:  fmt.Sprintf("Could not create virtio-blk: %s", testVirtioCtrlID),
 		},
+		"virtual function out of range": {
+			in: &pb.VirtioBlk{
+				PcieId: &pb.PciEndpoint{
+					PhysicalFunction: wrapperspb.Int32(42),
+					VirtualFunction:  wrapperspb.Int32(5),
+					PortId:           wrapperspb.Int32(0),
+				},
+				VolumeNameRef: "Malloc42",
+				MaxIoQps:      1,
+			},
+			out:     nil,
+			spdk:    []string{testEmulationFunctions},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Virtual function %d is out of range, physical function %d has %d virtual functions", 5, 42, 4),
+		},
+		"bdev of an NVMe remote controller": {
+			in: &pb.VirtioBlk{
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: "Nvme0n1",
+				MaxIoQps:      1,
+			},
+			out: &pb.VirtioBlk{
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: "Nvme0n1",
+				MaxIoQps:      1,
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":[{"name":"Nvme0n1","block_size":512,"num_blocks":131072,"uuid":"9cf6a3a4-5a3b-4f2a-9c5c-5d4f1d6f1e59"}]}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"unknown volume": {
+			in: &pb.VirtioBlk{
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: "unknown-volume",
+				MaxIoQps:      1,
+			},
+			out:     nil,
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find volume %v", "unknown-volume"),
+		},
+		"already exists": {
+			in:      &testVirtioCtrl,
+			out:     &testVirtioCtrl,
+			spdk:    []string{},
+			errCode: codes.OK,
+			errMsg:  "",
+			exist:   true,
+		},
 		"no required field": {
 			in:      nil,
 			out:     nil,
@@ -67,6 +123,9 @@ func TestFrontEnd_CreateVirtioBlk(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
+			if tt.exist {
+				_ = testEnv.opiSpdkServer.store.Set(testVirtioCtrlName, &testVirtioCtrlWithName)
+			}
 			if tt.out != nil {
 				tt.out = utils.ProtoClone(tt.out)
 				tt.out.Name = testVirtioCtrlName
@@ -78,6 +137,12 @@ func TestFrontEnd_CreateVirtioBlk(t *testing.T) {
 			if !proto.Equal(response, tt.out) {
 				t.Error("response: expected", tt.out, "received", response)
 			}
+			if tt.errCode == codes.OK && !tt.exist {
+				users, _ := backend.VolumeUsers(testEnv.opiSpdkServer.store, tt.in.VolumeNameRef)
+				if !reflect.DeepEqual(users, []string{testVirtioCtrlName}) {
+					t.Error("volume users: expected", []string{testVirtioCtrlName}, "received", users)
+				}
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -102,6 +167,7 @@ func TestFrontEnd_UpdateVirtioBlk(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		missing bool
 	}{
 		"invalid fieldmask": {
 			mask: &fieldmaskpb.FieldMask{Paths: []string{"*", "author"}},
@@ -144,17 +210,89 @@ func TestFrontEnd_UpdateVirtioBlk(t *testing.T) {
 			errCode: codes.Unknown,
 			errMsg:  "missing required field: virtio_blk.volume_name_ref",
 		},
-		"unimplemented method": {
+		"valid request without changes": {
 			mask: nil,
 			in: &pb.VirtioBlk{
 				Name:          testVirtioCtrlName,
 				PcieId:        testVirtioCtrl.PcieId,
 				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
 			},
+			out: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+				MaxIoQps:      testVirtioCtrl.MaxIoQps,
+			},
+			spdk:    []string{},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"valid request with recreate": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"volume_name_ref", "max_io_qps"}},
+			in: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: "Malloc43",
+				MaxIoQps:      4,
+			},
+			out: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: "Malloc43",
+				MaxIoQps:      4,
+			},
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`,
+			},
+			errCode: codes.OK,
+			errMsg:  "",
+		},
+		"recreate with invalid SPDK delete response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"max_io_qps"}},
+			in: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+				MaxIoQps:      4,
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":false}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not delete virtio-blk: %s", testVirtioCtrlID),
+		},
+		"recreate with invalid SPDK create response": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"max_io_qps"}},
+			in: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+				MaxIoQps:      4,
+			},
+			out: nil,
+			spdk: []string{
+				`{"id":%d,"error":{"code":0,"message":""},"result":true}`,
+				`{"id":%d,"error":{"code":0,"message":""},"result":""}`,
+				// the original device is restored
+				`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`,
+			},
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not create virtio-blk: %s", testVirtioCtrlID),
+		},
+		"qos limits change": {
+			mask: &fieldmaskpb.FieldMask{Paths: []string{"max_limit"}},
+			in: &pb.VirtioBlk{
+				Name:          testVirtioCtrlName,
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+				MaxLimit:      &pb.QosLimit{RdIopsKiops: 1},
+			},
 			out:     nil,
 			spdk:    []string{},
-			errCode: codes.Unimplemented,
-			errMsg:  fmt.Sprintf("%v method is not implemented", "UpdateVirtioBlk"),
+			errCode: codes.InvalidArgument,
+			errMsg:  fmt.Sprintf("Could not update virtio-blk: %s, QoS limits are not supported by SNAP emulation", testVirtioCtrlID),
 		},
 		"valid request with unknown key": {
 			mask: nil,
@@ -173,6 +311,23 @@ func TestFrontEnd_UpdateVirtioBlk(t *testing.T) {
 			errCode: codes.NotFound,
 			errMsg:  fmt.Sprintf("unable to find key %v", utils.ResourceIDToVolumeName("unknown-id")),
 		},
+		"unknown key with missing allowed": {
+			mask: nil,
+			in: &pb.VirtioBlk{
+				Name:          utils.ResourceIDToVolumeName("new-id"),
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+			},
+			out: &pb.VirtioBlk{
+				Name:          utils.ResourceIDToVolumeName("new-id"),
+				PcieId:        testVirtioCtrl.PcieId,
+				VolumeNameRef: testVirtioCtrl.VolumeNameRef,
+			},
+			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":"VblkEmu0pf0"}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			missing: true,
+		},
 		"malformed name": {
 			mask: nil,
 			in: &pb.VirtioBlk{
@@ -193,10 +348,9 @@ func TestFrontEnd_UpdateVirtioBlk(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
-			testEnv.opiSpdkServer.VirtioCtrls[testVirtioCtrlName] = utils.ProtoClone(&testVirtioCtrl)
-			testEnv.opiSpdkServer.VirtioCtrls[testVirtioCtrlName].Name = testVirtioCtrlName
+			_ = testEnv.opiSpdkServer.store.Set(testVirtioCtrlName, &testVirtioCtrlWithName)
 
-			request := &pb.UpdateVirtioBlkRequest{VirtioBlk: tt.in, UpdateMask: tt.mask}
+			request := &pb.UpdateVirtioBlkRequest{VirtioBlk: tt.in, UpdateMask: tt.mask, AllowMissing: tt.missing}
 			response, err := testEnv.client.UpdateVirtioBlk(testEnv.ctx, request)
 
 			if !proto.Equal(response, tt.out) {
@@ -219,6 +373,15 @@ func TestFrontEnd_UpdateVirtioBlk(t *testing.T) {
 
 func TestFrontEnd_ListVirtioBlks(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
+	existingToken := encodePageToken(virtioBlkCollection, 1, time.Now())
+	// stored virtio-blk devices, `{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}` does not emulate the last one
+	virtioBlks := []*pb.VirtioBlk{}
+	for _, id := range []string{"VblkEmu0pf0", "VblkEmu0pf2", testVirtioCtrlID, "virtio-blk-43"} {
+		virtioBlk := utils.ProtoClone(&testVirtioCtrl)
+		virtioBlk.Name = utils.ResourceIDToVolumeName(id)
+		virtioBlks = append(virtioBlks, virtioBlk)
+	}
+	activeNames := []string{virtioBlks[0].Name, virtioBlks[1].Name, virtioBlks[2].Name}
 	tests := map[string]struct {
 		in      string
 		out     []*pb.VirtioBlk
@@ -227,15 +390,17 @@ func TestFrontEnd_ListVirtioBlks(t *testing.T) {
 		errMsg  string
 		size    int32
 		token   string
+		active  []string
 	}{
-		"valid request with empty empty result SPDK response": {
+		"valid request with empty result SPDK response": {
 			in:      "subsystem-test",
-			out:     nil,
+			out:     virtioBlks,
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    0,
 			token:   "",
+			active:  nil,
 		},
 		"valid request with empty SPDK response": {
 			in:      "subsystem-test",
@@ -283,116 +448,44 @@ func TestFrontEnd_ListVirtioBlks(t *testing.T) {
 			token:   "unknown-pagination-token",
 		},
 		"pagination": {
-			in: "subsystem-test",
-			out: []*pb.VirtioBlk{
-				{
-					Name: utils.ResourceIDToVolumeName("VblkEmu0pf0"),
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-			},
+			in:      "subsystem-test",
+			out:     virtioBlks[:1],
 			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
 			token:   "",
+			active:  activeNames[:1],
 		},
 		"pagination overflow": {
-			in: "subsystem-test",
-			out: []*pb.VirtioBlk{
-				{
-					Name: utils.ResourceIDToVolumeName("VblkEmu0pf0"),
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-				{
-					Name: utils.ResourceIDToVolumeName("VblkEmu0pf2"),
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-				{
-					Name: testVirtioCtrlName,
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-			},
+			in:      "subsystem-test",
+			out:     virtioBlks,
 			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1000,
 			token:   "",
+			active:  activeNames,
 		},
 		"pagination offset": {
-			in: "subsystem-test",
-			out: []*pb.VirtioBlk{
-				{
-					Name: testVirtioCtrlName,
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-			},
+			in:      "subsystem-test",
+			out:     virtioBlks[1:2],
 			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    1,
-			token:   "existing-pagination-token",
+			token:   existingToken,
+			active:  activeNames[1:2],
 		},
 		"valid request with valid SPDK response": {
-			in: "subsystem-test",
-			out: []*pb.VirtioBlk{
-				{
-					Name: utils.ResourceIDToVolumeName("VblkEmu0pf0"),
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-				{
-					Name: utils.ResourceIDToVolumeName("VblkEmu0pf2"),
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-				{
-					Name: testVirtioCtrlName,
-					PcieId: &pb.PciEndpoint{
-						PhysicalFunction: wrapperspb.Int32(0),
-						VirtualFunction:  wrapperspb.Int32(0),
-						PortId:           wrapperspb.Int32(0),
-					},
-					VolumeNameRef: "TBD",
-				},
-			},
+			in:      "subsystem-test",
+			out:     virtioBlks,
 			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
 			errCode: codes.OK,
 			errMsg:  "",
 			size:    0,
 			token:   "",
+			active:  activeNames,
 		},
 	}
 
@@ -402,14 +495,21 @@ func TestFrontEnd_ListVirtioBlks(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
-			testEnv.opiSpdkServer.Pagination["existing-pagination-token"] = 1
+			for _, virtioBlk := range virtioBlks {
+				_ = testEnv.opiSpdkServer.store.Set(virtioBlk.Name, virtioBlk)
+				_ = testEnv.opiSpdkServer.addToIndex(virtioBlkIndex, virtioBlk.Name)
+			}
 
+			var header metadata.MD
 			request := &pb.ListVirtioBlksRequest{PageSize: tt.size, PageToken: tt.token}
-			response, err := testEnv.client.ListVirtioBlks(testEnv.ctx, request)
+			response, err := testEnv.client.ListVirtioBlks(testEnv.ctx, request, grpc.Header(&header))
 
 			if !utils.EqualProtoSlices(response.GetVirtioBlks(), tt.out) {
 				t.Error("response: expected", tt.out, "received", response.GetVirtioBlks())
 			}
+			if active := header.Get(ActiveVirtioBlksHeader); !reflect.DeepEqual(active, tt.active) {
+				t.Error("active: expected", tt.active, "received", active)
+			}
 
 			// Empty NextPageToken indicates end of results list
 			if tt.size != 1 && response.GetNextPageToken() != "" {
@@ -438,13 +538,15 @@ func TestFrontEnd_GetVirtioBlk(t *testing.T) {
 		spdk    []string
 		errCode codes.Code
 		errMsg  string
+		pciBdf  []string
+		active  []string
 	}{
 		"valid request with empty result SPDK response": {
 			in:      testVirtioCtrlName,
-			out:     nil,
+			out:     &testVirtioCtrlWithName,
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
-			errCode: codes.InvalidArgument,
-			errMsg:  fmt.Sprintf("Could not find Controller: %v", testVirtioCtrlName),
+			errCode: codes.OK,
+			errMsg:  "",
 		},
 		"valid request with empty SPDK response": {
 			in:      testVirtioCtrlName,
@@ -468,19 +570,31 @@ func TestFrontEnd_GetVirtioBlk(t *testing.T) {
 			errMsg:  fmt.Sprintf("controller_list: %v", "json response error: myopierr"),
 		},
 		"valid request with valid SPDK response": {
+			in:      testVirtioCtrlName,
+			out:     &testVirtioCtrlWithName,
+			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":42,"pci_bdf":"ca:00.5"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
+			errCode: codes.OK,
+			errMsg:  "",
+			pciBdf:  []string{"ca:00.5"},
+			active:  []string{testVirtioCtrlName},
+		},
+		"valid request on virtual function": {
 			in: testVirtioCtrlName,
 			out: &pb.VirtioBlk{
 				Name: testVirtioCtrlName,
 				PcieId: &pb.PciEndpoint{
-					PhysicalFunction: wrapperspb.Int32(0),
-					VirtualFunction:  wrapperspb.Int32(0),
+					PhysicalFunction: wrapperspb.Int32(42),
+					VirtualFunction:  wrapperspb.Int32(3),
 					PortId:           wrapperspb.Int32(0),
 				},
-				VolumeNameRef: "TBD",
+				VolumeNameRef: testVirtioCtrlWithName.VolumeNameRef,
+				MaxIoQps:      testVirtioCtrlWithName.MaxIoQps,
 			},
-			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"VblkEmu0pf0","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"name":"VblkEmu0pf2","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":0,"pci_bdf":"ca:00.4"},{"subnqn":"nqn.2020-12.mlnx.snap","cntlid":0,"name":"NvmeEmu0pf0","emulation_manager":"mlx5_0","type":"nvme","pci_index":0,"pci_bdf":"ca:00.2"}],"error":{"code":0,"message":""}}`},
+			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":[{"name":"virtio-blk-42","emulation_manager":"mlx5_0","type":"virtio_blk","pci_index":42,"pci_bdf":"ca:00.4","vf_index":2}],"error":{"code":0,"message":""}}`},
 			errCode: codes.OK,
 			errMsg:  "",
+			pciBdf:  []string{"ca:00.4"},
+			active:  []string{testVirtioCtrlName},
 		},
 		"malformed name": {
 			in:      "-ABC-DEF",
@@ -504,14 +618,21 @@ func TestFrontEnd_GetVirtioBlk(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
-			testEnv.opiSpdkServer.VirtioCtrls[testVirtioCtrlName] = utils.ProtoClone(&testVirtioCtrl)
+			_ = testEnv.opiSpdkServer.store.Set(testVirtioCtrlName, &testVirtioCtrlWithName)
 
+			var header metadata.MD
 			request := &pb.GetVirtioBlkRequest{Name: tt.in}
-			response, err := testEnv.client.GetVirtioBlk(testEnv.ctx, request)
+			response, err := testEnv.client.GetVirtioBlk(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response, tt.out) {
 				t.Error("response: expected", tt.out, "received", response)
 			}
+			if pciBdf := header.Get(PciBdfHeader); !reflect.DeepEqual(pciBdf, tt.pciBdf) {
+				t.Error("PCI address: expected", tt.pciBdf, "received", pciBdf)
+			}
+			if active := header.Get(ActiveVirtioBlksHeader); !reflect.DeepEqual(active, tt.active) {
+				t.Error("active: expected", tt.active, "received", active)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -530,56 +651,78 @@ func TestFrontEnd_GetVirtioBlk(t *testing.T) {
 func TestFrontEnd_VirtioBlkStats(t *testing.T) {
 	t.Cleanup(checkGlobalTestProtoObjectsNotChanged(t, t.Name()))
 	tests := map[string]struct {
-		in      string
-		out     *pb.VolumeStats
-		spdk    []string
-		errCode codes.Code
-		errMsg  string
+		in       string
+		out      *pb.VolumeStats
+		spdk     []string
+		errCode  codes.Code
+		errMsg   string
+		counters []string
+		volume   string
 	}{
 		"valid request with invalid SPDK response": {
-			in:      "namespace-test",
+			in:      testVirtioCtrlName,
 			out:     nil,
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
 			errCode: codes.InvalidArgument,
-			errMsg:  fmt.Sprintf("Could not find Controller: %v", "namespace-test"),
+			errMsg:  fmt.Sprintf("Could not find BdevName: %v", "Malloc42"),
 		},
 		"valid request with invalid marshal SPDK response": {
-			in:      "namespace-test",
+			in:      testVirtioCtrlName,
 			out:     nil,
 			spdk:    []string{`{"id":%d,"error":{"code":0,"message":""},"result":[]}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_virtio_blk_get_iostat: %v", "json: cannot unmarshal array into Go value of type models.NvdaControllerNvmeStatsResult"),
 		},
 		"valid request with empty SPDK response": {
-			in:      "namespace-test",
+			in:      testVirtioCtrlName,
 			out:     nil,
 			spdk:    []string{""},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_virtio_blk_get_iostat: %v", "EOF"),
 		},
 		"valid request with ID mismatch SPDK response": {
-			in:      "namespace-test",
+			in:      testVirtioCtrlName,
 			out:     nil,
 			spdk:    []string{`{"id":0,"error":{"code":0,"message":""},"result":{"controllers":[{"name":"NvmeEmu0pf1","bdevs":[]}]}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_virtio_blk_get_iostat: %v", "json response ID mismatch"),
 		},
 		"valid request with error code from SPDK response": {
-			in:      "namespace-test",
+			in:      testVirtioCtrlName,
 			out:     nil,
 			spdk:    []string{`{"id":%d,"error":{"code":1,"message":"myopierr"}}`},
 			errCode: codes.Unknown,
 			errMsg:  fmt.Sprintf("controller_virtio_blk_get_iostat: %v", "json response error: myopierr"),
 		},
 		"valid request with valid SPDK response": {
-			in: "Malloc0",
+			in: testVirtioCtrlName,
 			out: &pb.VolumeStats{
 				ReadOpsCount:  12345,
 				WriteOpsCount: 54321,
 			},
-			spdk:    []string{`{"jsonrpc":"2.0","id":%d,"result":{"controllers":[{"name":"VblkEmu0pf0","bdevs":[{"bdev_name":"Malloc0","read_ios":12345,"completed_read_ios":0,"completed_unordered_read_ios":0,"write_ios":54321,"completed_write_ios":0,"completed_unordered_write_ios":0,"flush_ios":0,"completed_flush_ios":0,"completed_unordered_flush_ios":0,"err_read_ios":0,"err_write_ios":0,"err_flush_ios":0}]}]},"error":{"code":0,"message":""}}`},
-			errCode: codes.OK,
-			errMsg:  "",
+			spdk:     []string{`{"jsonrpc":"2.0","id":%d,"result":{"controllers":[{"name":"VblkEmu0pf0","bdevs":[{"bdev_name":"Malloc42","read_ios":12345,"completed_read_ios":0,"completed_unordered_read_ios":0,"write_ios":54321,"completed_write_ios":0,"completed_unordered_write_ios":0,"flush_ios":7,"completed_flush_ios":0,"completed_unordered_flush_ios":0,"err_read_ios":1,"err_write_ios":2,"err_flush_ios":3,"queue_depth":4}]}]},"error":{"code":0,"message":""}}`},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"7", "1", "2", "3", "4"},
+		},
+		"valid request with volume named differently from its bdev": {
+			in: testVirtioCtrlName,
+			out: &pb.VolumeStats{
+				ReadOpsCount:  12345,
+				WriteOpsCount: 54321,
+			},
+			spdk:     []string{`{"jsonrpc":"2.0","id":%d,"result":{"controllers":[{"name":"VblkEmu0pf0","bdevs":[{"bdev_name":"Malloc42","read_ios":1,"write_ios":1},{"bdev_name":"Nvme0n1","read_ios":12345,"write_ios":54321}]}]},"error":{"code":0,"message":""}}`},
+			errCode:  codes.OK,
+			errMsg:   "",
+			counters: []string{"0", "0", "0", "0", "0"},
+			volume:   "remote-volume",
+		},
+		"valid request with unknown key": {
+			in:      "unknown-virtio-blk-id",
+			out:     nil,
+			spdk:    []string{},
+			errCode: codes.NotFound,
+			errMsg:  fmt.Sprintf("unable to find key %v", "unknown-virtio-blk-id"),
 		},
 		"malformed name": {
 			in:      "-ABC-DEF",
@@ -596,14 +739,23 @@ func TestFrontEnd_VirtioBlkStats(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
-			testEnv.opiSpdkServer.VirtioCtrls[testVirtioCtrl.Name] = utils.ProtoClone(&testVirtioCtrl)
+			virtioBlk := proto.Clone(&testVirtioCtrlWithName).(*pb.VirtioBlk)
+			if tt.volume != "" {
+				_ = backend.RegisterVolume(testEnv.opiSpdkServer.store, tt.volume, "Nvme0n1")
+				virtioBlk.VolumeNameRef = tt.volume
+			}
+			_ = testEnv.opiSpdkServer.store.Set(testVirtioCtrlName, virtioBlk)
 
+			var header metadata.MD
 			request := &pb.StatsVirtioBlkRequest{Name: tt.in}
-			response, err := testEnv.client.StatsVirtioBlk(testEnv.ctx, request)
+			response, err := testEnv.client.StatsVirtioBlk(testEnv.ctx, request, grpc.Header(&header))
 
 			if !proto.Equal(response.GetStats(), tt.out) {
 				t.Error("response: expected", tt.out, "received", response.GetStats())
 			}
+			if counters := volumeCountersHeader(header); !reflect.DeepEqual(counters, tt.counters) {
+				t.Error("counters: expected", tt.counters, "received", counters)
+			}
 
 			if er, ok := status.FromError(err); ok {
 				if er.Code() != tt.errCode {
@@ -701,7 +853,7 @@ func TestFrontEnd_DeleteVirtioBlk(t *testing.T) {
 			testEnv := createTestEnvironment(tt.spdk)
 			defer testEnv.Close()
 
-			testEnv.opiSpdkServer.VirtioCtrls[testVirtioCtrlName] = utils.ProtoClone(&testVirtioCtrl)
+			_ = testEnv.opiSpdkServer.store.Set(testVirtioCtrlName, &testVirtioCtrlWithName)
 
 			request := &pb.DeleteVirtioBlkRequest{Name: tt.in, AllowMissing: tt.missing}
 			response, err := testEnv.client.DeleteVirtioBlk(testEnv.ctx, request)
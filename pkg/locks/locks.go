@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package locks serializes operations on named resources
+package locks
+
+import (
+	"sync"
+)
+
+// Locks hands out one mutex per resource name. Mutexes are dropped once no
+// goroutine holds or waits for them, so the set of names is not bounded by
+// anything but concurrency. The zero value is ready to use.
+//
+// Deadlocks are avoided by ordering: a goroutine holding the lock of a
+// resource may only acquire locks of its children, so subsystem locks are
+// taken before controller and namespace ones, and those before the locks of
+// the volumes and store keys they use.
+type Locks struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock acquires the locks of names in the given order, parents first, and
+// returns the function releasing them. Repeated names are locked once and
+// empty names are skipped. The returned function may be called more than once.
+func (l *Locks) Lock(names ...string) (unlock func()) {
+	acquired := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == "" || contains(acquired, name) {
+			continue
+		}
+		l.acquire(name).mu.Lock()
+		acquired = append(acquired, name)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for i := len(acquired) - 1; i >= 0; i-- {
+				l.release(acquired[i])
+			}
+		})
+	}
+}
+
+// acquire returns the entry of name, registering the caller as its user
+func (l *Locks) acquire(name string) *entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries == nil {
+		l.entries = make(map[string]*entry)
+	}
+	e, ok := l.entries[name]
+	if !ok {
+		e = &entry{}
+		l.entries[name] = e
+	}
+	e.refs++
+	return e
+}
+
+// release unlocks the entry of name and drops it when it has no more users
+func (l *Locks) release(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[name]
+	e.mu.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(l.entries, name)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (c) 2022-2023 Dell Inc, or its subsidiaries.
+// Copyright (c) 2022 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+// Package locks serializes operations on named resources
+package locks
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLocks_MutualExclusion(t *testing.T) {
+	var locks Locks
+	var wg sync.WaitGroup
+	counters := map[string]int{"a": 0, "b": 0}
+	for i := 0; i < 100; i++ {
+		for _, name := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				unlock := locks.Lock("parent", name)
+				defer unlock()
+				// not atomic, the race detector and the final count catch
+				// concurrent holders
+				counters[name]++
+			}(name)
+		}
+	}
+	wg.Wait()
+	for name, count := range counters {
+		if count != 100 {
+			t.Error("counter", name, "expected", 100, "received", count)
+		}
+	}
+	if len(locks.entries) != 0 {
+		t.Error("entries: expected none, received", locks.entries)
+	}
+}
+
+func TestLocks_RepeatedNames(t *testing.T) {
+	var locks Locks
+	unlock := locks.Lock("a", "", "a", "b")
+	if len(locks.entries) != 2 {
+		t.Error("entries: expected 2, received", locks.entries)
+	}
+	unlock()
+	unlock()
+	if len(locks.entries) != 0 {
+		t.Error("entries: expected none, received", locks.entries)
+	}
+}
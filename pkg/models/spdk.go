@@ -7,9 +7,10 @@ package models
 
 // NvdaSubsystemNvmeCreateParams represents a Nvidia subsystem create request
 type NvdaSubsystemNvmeCreateParams struct {
-	Nqn          string `json:"nqn"`
-	SerialNumber string `json:"serial_number"`
-	ModelNumber  string `json:"model_number"`
+	Nqn           string `json:"nqn"`
+	SerialNumber  string `json:"serial_number"`
+	ModelNumber   string `json:"model_number"`
+	MaxNamespaces int    `json:"nn,omitempty"`
 }
 
 // NvdaSubsystemNvmeCreateResult represents a Nvidia subsystem create result
@@ -38,12 +39,21 @@ type NvdaSubsystemNvmeListResult struct {
 	} `json:"controllers"`
 }
 
+// NvdaEmulationManagersListParams is empty
+
+// NvdaEmulationManagersListResult represents a Nvidia emulation managers list result
+type NvdaEmulationManagersListResult struct {
+	EmulationManager string   `json:"emulation_manager"`
+	HotplugSupport   bool     `json:"hotplug_support"`
+	SupportedTypes   []string `json:"supported_types"`
+}
+
 // NvdaControllerNvmeCreateParams represents a Nvidia Controller create request
 type NvdaControllerNvmeCreateParams struct {
 	Nqn              string `json:"nqn"`
 	EmulationManager string `json:"emulation_manager"`
 	PfID             int    `json:"pf_id"`
-	VfID             int    `json:"vf_id,omitempty"`
+	VfID             *int   `json:"vf_id,omitempty"`
 	NrIoQueues       int    `json:"nr_io_queues,omitempty"`
 	MaxNamespaces    int    `json:"max_namespaces,omitempty"`
 }
@@ -74,6 +84,20 @@ type NvdaControllerListResult struct {
 	Type             string `json:"type"`
 	PciIndex         int    `json:"pci_index"`
 	PciBdf           string `json:"pci_bdf"`
+	VfIndex          *int   `json:"vf_index,omitempty"`
+}
+
+// NvdaEmulationFunctionsListParams represents a Nvidia emulation functions list request
+type NvdaEmulationFunctionsListParams struct {
+	EmulationManager string `json:"emulation_manager"`
+}
+
+// NvdaEmulationFunctionsListResult represents a Nvidia emulation functions list result
+type NvdaEmulationFunctionsListResult struct {
+	EmulationType string `json:"emulation_type"`
+	PfIndex       int    `json:"pf_index"`
+	PciBdf        string `json:"pci_bdf"`
+	NumVfs        int    `json:"num_vfs"`
 }
 
 // NvdaControllerNvmeNamespaceAttachParams represents a Nvidia controller attach namespaces request
@@ -120,22 +144,33 @@ type NvdaControllerNvmeNamespaceListResult struct {
 	} `json:"Namespaces"`
 }
 
+// NvdaControllerStatsBdev represents I/O counters of a single bdev of a Nvidia controller
+type NvdaControllerStatsBdev struct {
+	BdevName          string `json:"bdev_name"`
+	ReadIos           uint64 `json:"read_ios"`
+	CompletedReadIos  uint64 `json:"completed_read_ios"`
+	WriteIos          uint64 `json:"write_ios"`
+	CompletedWriteIos uint64 `json:"completed_write_ios"`
+	FlushIos          uint64 `json:"flush_ios"`
+	CompletedFlushIos uint64 `json:"completed_flush_ios"`
+	ErrReadIos        uint64 `json:"err_read_ios"`
+	ErrWriteIos       uint64 `json:"err_write_ios"`
+	ErrFlushIos       uint64 `json:"err_flush_ios"`
+	BytesRead         uint64 `json:"bytes_read"`
+	BytesWritten      uint64 `json:"bytes_written"`
+	BytesUnmapped     uint64 `json:"bytes_unmapped"`
+	NumUnmapOps       uint64 `json:"num_unmap_ops"`
+	ReadLatencyTicks  uint64 `json:"read_latency_ticks"`
+	WriteLatencyTicks uint64 `json:"write_latency_ticks"`
+	UnmapLatencyTicks uint64 `json:"unmap_latency_ticks"`
+	QueueDepth        uint64 `json:"queue_depth"`
+}
+
 // NvdaControllerNvmeStatsResult represents a Nvidia controller get stats result
 type NvdaControllerNvmeStatsResult struct {
 	Controllers []struct {
-		Name  string `json:"name"`
-		Bdevs []struct {
-			BdevName          string `json:"bdev_name"`
-			ReadIos           int    `json:"read_ios"`
-			CompletedReadIos  int    `json:"completed_read_ios"`
-			WriteIos          int    `json:"write_ios"`
-			CompletedWriteIos int    `json:"completed_write_ios"`
-			FlushIos          int    `json:"flush_ios"`
-			CompletedFlushIos int    `json:"completed_flush_ios"`
-			ErrReadIos        int    `json:"err_read_ios"`
-			ErrWriteIos       int    `json:"err_write_ios"`
-			ErrFlushIos       int    `json:"err_flush_ios"`
-		} `json:"bdevs"`
+		Name  string                    `json:"name"`
+		Bdevs []NvdaControllerStatsBdev `json:"bdevs"`
 	} `json:"controllers"`
 }
 
@@ -144,7 +179,7 @@ type NvdaControllerVirtioBlkCreateParams struct {
 	EmulationManager string `json:"emulation_manager"`
 	BdevType         string `json:"bdev_type"`
 	PfID             int    `json:"pf_id"`
-	VfID             int    `json:"vf_id"`
+	VfID             *int   `json:"vf_id,omitempty"`
 	NumQueues        int    `json:"num_queues"`
 	Bdev             string `json:"bdev"`
 	Serial           string `json:"serial"`
@@ -161,3 +196,12 @@ type NvdaControllerVirtioBlkDeleteParams struct {
 
 // NvdaControllerVirtioBlkDeleteResult represents a Nvidia Controller delete result
 type NvdaControllerVirtioBlkDeleteResult bool
+
+// NvmfSubsystemAllowAnyHostParams represents a NVMe-oF subsystem allow any host request
+type NvmfSubsystemAllowAnyHostParams struct {
+	Nqn          string `json:"nqn"`
+	AllowAnyHost bool   `json:"allow_any_host"`
+}
+
+// NvmfSubsystemAllowAnyHostResult represents a NVMe-oF subsystem allow any host result
+type NvmfSubsystemAllowAnyHostResult bool